@@ -0,0 +1,49 @@
+package api
+
+import (
+	"sync"
+	"time"
+)
+
+// ipLimiter allows each IP address a number of requests within a window
+type ipLimiter struct {
+	max    int
+	window time.Duration
+	hits   map[string][]time.Time
+	mutex  sync.Mutex
+}
+
+func newIPLimiter(max int, window time.Duration) *ipLimiter {
+	return &ipLimiter{
+		max:    max,
+		window: window,
+		hits:   make(map[string][]time.Time),
+	}
+}
+
+// Allow returns true and counts the request if the address hasn't used up its requests for the window
+func (l *ipLimiter) Allow(ip string, now time.Time) bool {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+
+	// Forget requests that are out of the window, and addresses that have none left
+	for addr, hits := range l.hits {
+		recent := hits[:0]
+		for _, hit := range hits {
+			if now.Sub(hit) < l.window {
+				recent = append(recent, hit)
+			}
+		}
+		if len(recent) == 0 {
+			delete(l.hits, addr)
+		} else {
+			l.hits[addr] = recent
+		}
+	}
+
+	if len(l.hits[ip]) >= l.max {
+		return false
+	}
+	l.hits[ip] = append(l.hits[ip], now)
+	return true
+}
@@ -0,0 +1,43 @@
+package api
+
+import (
+	"testing"
+	"time"
+)
+
+func TestIPLimiter(t *testing.T) {
+	l := newIPLimiter(2, time.Hour)
+	now := time.Now()
+
+	if !l.Allow("203.0.113.7", now) || !l.Allow("203.0.113.7", now) {
+		t.Fatal("expected the first requests to be allowed")
+	}
+	if l.Allow("203.0.113.7", now) {
+		t.Error("expected a request over the limit to be refused")
+	}
+	if !l.Allow("203.0.113.8", now) {
+		t.Error("expected another address to have its own limit")
+	}
+	if !l.Allow("203.0.113.7", now.Add(time.Hour)) {
+		t.Error("expected the limit to reset after the window")
+	}
+}
+
+func TestValidEmail(t *testing.T) {
+	tests := []struct {
+		email    string
+		expected bool
+	}{
+		{"toof@example.com", true},
+		{"toof", false},
+		{"@", false},
+		{"Toof <toof@example.com>", false},
+		{" toof@example.com", false},
+	}
+
+	for _, test := range tests {
+		if result := validEmail(test.email); result != test.expected {
+			t.Errorf("expected %q to give %v, got %v", test.email, test.expected, result)
+		}
+	}
+}
@@ -0,0 +1,219 @@
+package api
+
+import (
+	"aim-oscar/mailer"
+	"aim-oscar/models"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/uptrace/bun"
+	"golang.org/x/exp/slog"
+)
+
+// Every request that sends an email counts towards its address's limit, so the API can't be used to flood inboxes
+const (
+	emailsPerIP    = 5
+	emailsPerIPFor = time.Hour
+)
+
+// Server is the HTTP API for signing up for an account and verifying its email address
+type Server struct {
+	db     *bun.DB
+	mailer mailer.Mailer
+	// baseURL is where the API can be reached from, verification links point here
+	baseURL string
+	limiter *ipLimiter
+	logger  *slog.Logger
+}
+
+func NewServer(db *bun.DB, m mailer.Mailer, baseURL string, logger *slog.Logger) *Server {
+	return &Server{
+		db:      db,
+		mailer:  m,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		limiter: newIPLimiter(emailsPerIP, emailsPerIPFor),
+		logger:  logger.With("service", "api"),
+	}
+}
+
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/register", s.register)
+	mux.HandleFunc("/verify", s.verify)
+	mux.HandleFunc("/resend", s.resend)
+	return mux
+}
+
+type registerRequest struct {
+	ScreenName string `json:"screen_name"`
+	Password   string `json:"password"`
+	Email      string `json:"email"`
+}
+
+type resendRequest struct {
+	Email string `json:"email"`
+}
+
+type response struct {
+	Message string `json:"message,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+// validEmail is true for a bare email address, without a display name or anything around it
+func validEmail(email string) bool {
+	addr, err := mail.ParseAddress(email)
+	return err == nil && addr.Name == "" && addr.Address == email
+}
+
+// allow checks the request's address is under its limit, and tells the client to slow down if it isn't
+func (s *Server) allow(w http.ResponseWriter, r *http.Request) bool {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		ip = r.RemoteAddr
+	}
+
+	if !s.limiter.Allow(ip, time.Now()) {
+		s.logger.Info("too many requests", "ip", ip, "path", r.URL.Path)
+		writeJSON(w, http.StatusTooManyRequests, &response{Error: "too many requests, try again later"})
+		return false
+	}
+	return true
+}
+
+func writeJSON(w http.ResponseWriter, status int, resp *response) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(resp)
+}
+
+// register creates an unverified account and emails the user a link to verify it
+func (s *Server) register(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, &response{Error: "method not allowed"})
+		return
+	}
+
+	if !s.allow(w, r) {
+		return
+	}
+
+	var req registerRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, &response{Error: "invalid request"})
+		return
+	}
+	if !validEmail(req.Email) {
+		writeJSON(w, http.StatusBadRequest, &response{Error: "invalid email"})
+		return
+	}
+
+	user, err := models.CreateUser(r.Context(), s.db, req.ScreenName, req.Password, req.Email)
+	switch err {
+	case nil:
+	case models.ErrScreenNameLength, models.ErrScreenNameCharacters, models.ErrScreenNameReserved, models.ErrPasswordLength:
+		writeJSON(w, http.StatusBadRequest, &response{Error: err.Error()})
+		return
+	case models.ErrScreenNameTaken, models.ErrEmailTaken:
+		writeJSON(w, http.StatusConflict, &response{Error: err.Error()})
+		return
+	default:
+		s.logger.Error("could not create user", "screen_name", req.ScreenName, "err", err.Error())
+		writeJSON(w, http.StatusInternalServerError, &response{Error: "could not create account"})
+		return
+	}
+
+	s.logger.Info("registered user", "screen_name", user.ScreenName)
+
+	if err := s.sendVerification(r.Context(), user); err != nil {
+		s.logger.Error("could not send verification email", "screen_name", user.ScreenName, "err", err.Error())
+		writeJSON(w, http.StatusInternalServerError, &response{Error: "account created but the verification email could not be sent, try resending it"})
+		return
+	}
+
+	writeJSON(w, http.StatusCreated, &response{Message: "check your email to verify your account"})
+}
+
+// verify uses up the token from a verification email. It takes GET so the link in the email works.
+func (s *Server) verify(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, &response{Error: "method not allowed"})
+		return
+	}
+
+	token := r.URL.Query().Get("token")
+	if token == "" {
+		writeJSON(w, http.StatusBadRequest, &response{Error: "missing token"})
+		return
+	}
+
+	user, err := models.VerifyEmail(r.Context(), s.db, token, time.Now())
+	if err == models.ErrVerificationInvalid {
+		writeJSON(w, http.StatusBadRequest, &response{Error: err.Error()})
+		return
+	}
+	if err != nil {
+		s.logger.Error("could not verify email", "err", err.Error())
+		writeJSON(w, http.StatusInternalServerError, &response{Error: "could not verify email"})
+		return
+	}
+
+	s.logger.Info("verified user", "screen_name", user.ScreenName)
+	writeJSON(w, http.StatusOK, &response{Message: fmt.Sprintf("%s is verified, you can sign on now", user.ScreenName)})
+}
+
+// resend sends a new verification email. It answers the same whether or not the email is registered so it
+// can't be used to find out who has an account.
+func (s *Server) resend(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSON(w, http.StatusMethodNotAllowed, &response{Error: "method not allowed"})
+		return
+	}
+
+	if !s.allow(w, r) {
+		return
+	}
+
+	var req resendRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeJSON(w, http.StatusBadRequest, &response{Error: "invalid request"})
+		return
+	}
+
+	user, err := models.UserByEmail(r.Context(), s.db, req.Email)
+	if err != nil {
+		s.logger.Error("could not look up user", "err", err.Error())
+		writeJSON(w, http.StatusInternalServerError, &response{Error: "could not resend verification email"})
+		return
+	}
+
+	if user != nil && !user.Verified {
+		if err := s.sendVerification(r.Context(), user); err != nil {
+			s.logger.Error("could not send verification email", "screen_name", user.ScreenName, "err", err.Error())
+			writeJSON(w, http.StatusInternalServerError, &response{Error: "could not resend verification email"})
+			return
+		}
+	}
+
+	writeJSON(w, http.StatusOK, &response{Message: "if that email has an unverified account, a new verification email is on its way"})
+}
+
+func (s *Server) sendVerification(ctx context.Context, user *models.User) error {
+	verification, err := models.CreateEmailVerification(ctx, s.db, user)
+	if err != nil {
+		return err
+	}
+
+	link := s.baseURL + "/verify?token=" + url.QueryEscape(verification.Token)
+	return s.mailer.Send(ctx, &mailer.Message{
+		To:      user.Email,
+		Subject: "Verify your screen name",
+		Body:    fmt.Sprintf("Hi %s,\r\n\r\nFollow this link to verify your account within %s:\r\n\r\n%s\r\n", user.ScreenName, models.EmailVerificationLifetime, link),
+	})
+}
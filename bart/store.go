@@ -0,0 +1,67 @@
+// Package bart stores the Buddy Art (buddy icons and friends) that users upload. Items are content
+// addressed by the MD5 hash of their data, which is also how clients refer to them.
+package bart
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// Store saves and loads items by their hash
+type Store interface {
+	// Put saves an item and returns its hash
+	Put(data []byte) ([]byte, error)
+	// Get loads an item by its hash, returning nil if there is no such item
+	Get(hash []byte) ([]byte, error)
+}
+
+// Hash returns the hash an item is stored under
+func Hash(data []byte) []byte {
+	sum := md5.Sum(data)
+	return sum[:]
+}
+
+// FileStore keeps every item in its own file in a directory
+type FileStore struct {
+	dir string
+}
+
+func NewFileStore(dir string) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "could not create BART directory")
+	}
+	return &FileStore{dir: dir}, nil
+}
+
+func (s *FileStore) path(hash []byte) string {
+	return filepath.Join(s.dir, hex.EncodeToString(hash))
+}
+
+func (s *FileStore) Put(data []byte) ([]byte, error) {
+	hash := Hash(data)
+
+	// Items never change, so one that's already stored doesn't need to be written again
+	if _, err := os.Stat(s.path(hash)); err == nil {
+		return hash, nil
+	}
+
+	if err := os.WriteFile(s.path(hash), data, 0644); err != nil {
+		return nil, errors.Wrap(err, "could not write BART item")
+	}
+	return hash, nil
+}
+
+func (s *FileStore) Get(hash []byte) ([]byte, error) {
+	data, err := os.ReadFile(s.path(hash))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read BART item")
+	}
+	return data, nil
+}
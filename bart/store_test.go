@@ -0,0 +1,35 @@
+package bart
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestFileStore(t *testing.T) {
+	store, err := NewFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	icon := []byte("GIF89a not really")
+	hash, err := store.Put(icon)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(hash, Hash(icon)) {
+		t.Fatalf("expected item to be stored under its hash, got %x", hash)
+	}
+
+	data, err := store.Get(hash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(data, icon) {
+		t.Fatalf("expected stored item back, got %q", data)
+	}
+
+	missing, err := store.Get(Hash([]byte("missing")))
+	if err != nil || missing != nil {
+		t.Fatalf("expected nothing for a missing item, got %q (err: %v)", missing, err)
+	}
+}
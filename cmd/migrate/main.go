@@ -4,6 +4,7 @@ import (
 	"aim-oscar/cmd/migrate/migrations"
 	"aim-oscar/config"
 	"aim-oscar/db"
+	"aim-oscar/models"
 	"context"
 	"flag"
 	"fmt"
@@ -14,7 +15,7 @@ import (
 
 func usage() {
 	flag.Usage()
-	log.Fatalf("Usage: migrate --config <config path> <init|up|down|status|mark_applied>\n")
+	log.Fatalf("Usage: migrate --config <config path> <init|up|down|status|mark_applied|hash_passwords>\n")
 }
 
 func main() {
@@ -92,5 +93,14 @@ func main() {
 		}
 
 		fmt.Printf("marked as applied %s\n", group)
+	} else if cmd == "hash_passwords" {
+		// Run after migrating up. Hashed passwords can't be turned back into plaintext, so clients that only
+		// know the old MD5 login can't sign on afterwards.
+		count, err := models.HashPasswords(ctx, db)
+		if err != nil {
+			panic(err)
+		}
+
+		fmt.Printf("hashed %d passwords\n", count)
 	}
 }
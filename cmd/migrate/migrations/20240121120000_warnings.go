@@ -0,0 +1,24 @@
+package migrations
+
+import (
+	"aim-oscar/models"
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.NewAddColumn().Model((*models.User)(nil)).ColumnExpr("warning_level SMALLINT NOT NULL DEFAULT 0").IfNotExists().Exec(ctx); err != nil {
+			return err
+		}
+		_, err := db.NewAddColumn().Model((*models.User)(nil)).ColumnExpr("warned_at TIMESTAMPTZ").IfNotExists().Exec(ctx)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.NewDropColumn().Model((*models.User)(nil)).Column("warning_level").Exec(ctx); err != nil {
+			return err
+		}
+		_, err := db.NewDropColumn().Model((*models.User)(nil)).Column("warned_at").Exec(ctx)
+		return err
+	})
+}
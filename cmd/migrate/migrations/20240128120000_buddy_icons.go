@@ -0,0 +1,18 @@
+package migrations
+
+import (
+	"aim-oscar/models"
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		_, err := db.NewAddColumn().Model((*models.User)(nil)).ColumnExpr("icon_hash BYTEA").IfNotExists().Exec(ctx)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		_, err := db.NewDropColumn().Model((*models.User)(nil)).Column("icon_hash").Exec(ctx)
+		return err
+	})
+}
@@ -0,0 +1,44 @@
+package migrations
+
+import (
+	"aim-oscar/models"
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+var icqColumns = []struct {
+	name string
+	expr string
+}{
+	{"icq_nickname", "icq_nickname VARCHAR"},
+	{"icq_first_name", "icq_first_name VARCHAR"},
+	{"icq_last_name", "icq_last_name VARCHAR"},
+	{"icq_city", "icq_city VARCHAR"},
+	{"icq_state", "icq_state VARCHAR"},
+	{"icq_phone", "icq_phone VARCHAR"},
+	{"icq_zip", "icq_zip VARCHAR"},
+	{"icq_country", "icq_country INTEGER NOT NULL DEFAULT 0"},
+	{"icq_gender", "icq_gender SMALLINT NOT NULL DEFAULT 0"},
+	{"icq_age", "icq_age SMALLINT NOT NULL DEFAULT 0"},
+	{"icq_homepage", "icq_homepage VARCHAR"},
+	{"icq_about", "icq_about VARCHAR"},
+}
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		for _, column := range icqColumns {
+			if _, err := db.NewAddColumn().Model((*models.User)(nil)).ColumnExpr(column.expr).IfNotExists().Exec(ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}, func(ctx context.Context, db *bun.DB) error {
+		for _, column := range icqColumns {
+			if _, err := db.NewDropColumn().Model((*models.User)(nil)).Column(column.name).Exec(ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
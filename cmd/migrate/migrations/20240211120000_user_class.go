@@ -0,0 +1,24 @@
+package migrations
+
+import (
+	"aim-oscar/models"
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.NewAddColumn().Model((*models.User)(nil)).ColumnExpr("admin BOOLEAN NOT NULL DEFAULT FALSE").IfNotExists().Exec(ctx); err != nil {
+			return err
+		}
+		_, err := db.NewAddColumn().Model((*models.User)(nil)).ColumnExpr("bot BOOLEAN NOT NULL DEFAULT FALSE").IfNotExists().Exec(ctx)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.NewDropColumn().Model((*models.User)(nil)).Column("admin").Exec(ctx); err != nil {
+			return err
+		}
+		_, err := db.NewDropColumn().Model((*models.User)(nil)).Column("bot").Exec(ctx)
+		return err
+	})
+}
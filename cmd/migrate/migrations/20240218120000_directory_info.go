@@ -0,0 +1,18 @@
+package migrations
+
+import (
+	"aim-oscar/models"
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		_, err := db.NewCreateTable().Model((*models.DirectoryInfo)(nil)).IfNotExists().ForeignKey(`("user_uin") REFERENCES "users" ("uin") ON DELETE CASCADE`).Exec(ctx)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		_, err := db.NewDropTable().Model((*models.DirectoryInfo)(nil)).IfExists().Exec(ctx)
+		return err
+	})
+}
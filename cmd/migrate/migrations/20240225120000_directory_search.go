@@ -0,0 +1,24 @@
+package migrations
+
+import (
+	"aim-oscar/models"
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.NewAddColumn().Model((*models.DirectoryInfo)(nil)).ColumnExpr("interests VARCHAR[]").IfNotExists().Exec(ctx); err != nil {
+			return err
+		}
+		_, err := db.NewAddColumn().Model((*models.DirectoryInfo)(nil)).ColumnExpr("searchable BOOLEAN NOT NULL DEFAULT TRUE").IfNotExists().Exec(ctx)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.NewDropColumn().Model((*models.DirectoryInfo)(nil)).Column("interests").Exec(ctx); err != nil {
+			return err
+		}
+		_, err := db.NewDropColumn().Model((*models.DirectoryInfo)(nil)).Column("searchable").Exec(ctx)
+		return err
+	})
+}
@@ -0,0 +1,24 @@
+package migrations
+
+import (
+	"aim-oscar/models"
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.NewAddColumn().Model((*models.User)(nil)).ColumnExpr("password_hash VARCHAR NOT NULL DEFAULT ''").IfNotExists().Exec(ctx); err != nil {
+			return err
+		}
+		_, err := db.NewAddColumn().Model((*models.User)(nil)).ColumnExpr("password_md5 VARCHAR NOT NULL DEFAULT ''").IfNotExists().Exec(ctx)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.NewDropColumn().Model((*models.User)(nil)).Column("password_hash").Exec(ctx); err != nil {
+			return err
+		}
+		_, err := db.NewDropColumn().Model((*models.User)(nil)).Column("password_md5").Exec(ctx)
+		return err
+	})
+}
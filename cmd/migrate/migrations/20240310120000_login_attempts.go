@@ -0,0 +1,24 @@
+package migrations
+
+import (
+	"aim-oscar/models"
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.NewCreateTable().Model((*models.LoginAttempt)(nil)).IfNotExists().Exec(ctx); err != nil {
+			return err
+		}
+		if _, err := db.NewCreateIndex().Model((*models.LoginAttempt)(nil)).Index("login_attempts_ip_idx").Column("ip", "created_at").IfNotExists().Exec(ctx); err != nil {
+			return err
+		}
+		_, err := db.NewCreateIndex().Model((*models.LoginAttempt)(nil)).Index("login_attempts_login_idx").Column("login", "created_at").IfNotExists().Exec(ctx)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		_, err := db.NewDropTable().Model((*models.LoginAttempt)(nil)).IfExists().Exec(ctx)
+		return err
+	})
+}
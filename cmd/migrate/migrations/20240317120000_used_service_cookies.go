@@ -0,0 +1,21 @@
+package migrations
+
+import (
+	"aim-oscar/models"
+	"context"
+
+	"github.com/uptrace/bun"
+)
+
+func init() {
+	Migrations.MustRegister(func(ctx context.Context, db *bun.DB) error {
+		if _, err := db.NewCreateTable().Model((*models.UsedServiceCookie)(nil)).IfNotExists().Exec(ctx); err != nil {
+			return err
+		}
+		_, err := db.NewCreateIndex().Model((*models.UsedServiceCookie)(nil)).Index("used_service_cookies_expires_at_idx").Column("expires_at").IfNotExists().Exec(ctx)
+		return err
+	}, func(ctx context.Context, db *bun.DB) error {
+		_, err := db.NewDropTable().Model((*models.UsedServiceCookie)(nil)).IfExists().Exec(ctx)
+		return err
+	})
+}
@@ -9,11 +9,12 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"time"
 )
 
 func usage() {
 	flag.Usage()
-	fmt.Printf("commands:\n\tadd <screen_name> <password> <email>\n\tverify <screen_name>\n")
+	fmt.Printf("commands:\n\tadd <screen_name> <password> <email>\n\tadd-icq <password> <email>\n\tverify <screen_name>\n\tunlock <screen_name>\n")
 }
 
 func main() {
@@ -61,6 +62,26 @@ func main() {
 		}
 
 		log.Printf("Verified user")
+	} else if cmd == "add-icq" {
+		if len(flag.Args()) < 3 {
+			log.Println("missing arguments")
+			usage()
+			os.Exit(1)
+		}
+
+		password := flag.Arg(1)
+		email := flag.Arg(2)
+		user, err := models.CreateICQUser(ctx, db, password, email)
+		if err != nil {
+			log.Fatalf("could not add ICQ user: %s", err)
+		}
+
+		user.Verified = true
+		if err = user.Update(ctx, db, "verified"); err != nil {
+			log.Fatalf("could not verify user: %s", err)
+		}
+
+		log.Printf("Added ICQ user with UIN %d", user.UIN)
 	} else if cmd == "verify" {
 		if len(flag.Args()) < 2 {
 			log.Println("missing arguments")
@@ -85,5 +106,26 @@ func main() {
 		}
 
 		log.Printf("Verified %s", screenName)
+	} else if cmd == "unlock" {
+		if len(flag.Args()) < 2 {
+			log.Println("missing arguments")
+			usage()
+			os.Exit(1)
+		}
+
+		screenName := flag.Arg(1)
+		user, err := models.UserByLogin(ctx, db, screenName)
+		if err != nil {
+			log.Fatalf("could not get User by Screen Name: %s", err)
+		}
+		if user == nil {
+			log.Fatalf("no such user %s", screenName)
+		}
+
+		if err := models.UnlockAccount(ctx, db, user, time.Now()); err != nil {
+			log.Fatalf("could not unlock user: %s", err)
+		}
+
+		log.Printf("Unlocked %s", screenName)
 	}
 }
@@ -1,19 +1,97 @@
 package config
 
 import (
+	"time"
+
 	"github.com/ilyakaznacheev/cleanenv"
+	"github.com/pkg/errors"
 )
 
 type config struct {
 	AppConfig   AppConfig   `yaml:"app"`
 	DBConfig    DBConfig    `yaml:"db"`
 	OscarConfig OscarConfig `yaml:"oscar"`
+	BARTConfig  BARTConfig  `yaml:"bart"`
+	APIConfig   APIConfig   `yaml:"api"`
 }
 
 type AppConfig struct {
-	LogLevel string        `yaml:"log_level" env-default:"debug"`
-	LogStyle string        `yaml:"log_style" env-default:"human"`
-	Metrics  MetricsConfig `yaml:"metrics"`
+	LogLevel    string            `yaml:"log_level" env-default:"debug"`
+	LogStyle    string            `yaml:"log_style" env-default:"human"`
+	Metrics     MetricsConfig     `yaml:"metrics"`
+	RateClasses []RateClassConfig `yaml:"rate_classes"`
+
+	OfflineMessages OfflineMessagesConfig `yaml:"offline_messages"`
+	Directory       DirectoryConfig       `yaml:"directory"`
+}
+
+// DirectoryConfig limits directory searches. Searches return at most max_results users.
+type DirectoryConfig struct {
+	MaxResults int `yaml:"max_results" env-default:"50"`
+}
+
+// OfflineMessagesConfig limits the messages that are stored for users who are offline. Senders are told the
+// recipient is offline once the recipient has max_per_recipient messages waiting, and messages that wait
+// longer than expiry are thrown away.
+type OfflineMessagesConfig struct {
+	MaxPerRecipient int           `yaml:"max_per_recipient" env-default:"100"`
+	Expiry          time.Duration `yaml:"expiry" env-default:"720h"`
+}
+
+// RateClassConfig describes a group of SNACs that share a rate limit. Levels are the average number of
+// milliseconds between SNACs over the last window_size SNACs. SNACs that aren't listed in any class
+// belong to the first class.
+type RateClassConfig struct {
+	ID              uint16                 `yaml:"id"`
+	WindowSize      uint32                 `yaml:"window_size"`
+	ClearLevel      uint32                 `yaml:"clear_level"`
+	AlertLevel      uint32                 `yaml:"alert_level"`
+	LimitLevel      uint32                 `yaml:"limit_level"`
+	DisconnectLevel uint32                 `yaml:"disconnect_level"`
+	MaxLevel        uint32                 `yaml:"max_level"`
+	SNACs           []RateClassSNACsConfig `yaml:"snacs"`
+}
+
+// Validate checks that the class has a window and that its levels go down from max to disconnect
+func (c RateClassConfig) Validate() error {
+	if c.WindowSize < 1 {
+		return errors.Errorf("rate class %d: window_size must be at least 1", c.ID)
+	}
+	if !(c.MaxLevel >= c.ClearLevel && c.ClearLevel > c.AlertLevel && c.AlertLevel > c.LimitLevel && c.LimitLevel > c.DisconnectLevel) {
+		return errors.Errorf("rate class %d: levels must be ordered max_level >= clear_level > alert_level > limit_level > disconnect_level", c.ID)
+	}
+	return nil
+}
+
+type RateClassSNACsConfig struct {
+	Family   uint16   `yaml:"family"`
+	Subtypes []uint16 `yaml:"subtypes"`
+}
+
+// DefaultRateClasses are used when no rate classes are configured. Sending messages and warning
+// other users is limited more strictly than everything else.
+var DefaultRateClasses = []RateClassConfig{
+	{
+		ID:              1,
+		WindowSize:      80,
+		ClearLevel:      2500,
+		AlertLevel:      2000,
+		LimitLevel:      1500,
+		DisconnectLevel: 800,
+		MaxLevel:        6000,
+	},
+	{
+		ID:              2,
+		WindowSize:      80,
+		ClearLevel:      3000,
+		AlertLevel:      2000,
+		LimitLevel:      1500,
+		DisconnectLevel: 1000,
+		MaxLevel:        6000,
+		SNACs: []RateClassSNACsConfig{
+			{Family: 0x04, Subtypes: []uint16{0x06, 0x08}},
+		},
+	},
 }
 
 type MetricsConfig struct {
@@ -23,8 +101,115 @@ type MetricsConfig struct {
 }
 
 type OscarConfig struct {
-	Addr string `yaml:"addr" env:"OSCAR_ADDR" env-required:"true"`
-	BOS  string `yaml:"bos" env:"OSCAR_BOS" env-required:"true"`
+	// Addr is a single listener that does everything, it's only used when no listeners are configured
+	Addr string `yaml:"addr" env:"OSCAR_ADDR"`
+	// BOS is where the authorizer sends clients after they log in
+	BOS string `yaml:"bos" env:"OSCAR_BOS" env-required:"true"`
+
+	Listeners []ListenerConfig `yaml:"listeners"`
+
+	// CookieSecret signs the cookies that take clients from the authorizer to BOS and the ones that let them
+	// open connections for other services. A random secret is used if it isn't set, which only works while
+	// there's a single server, so it has to be set when the listeners are split up.
+	CookieSecret string `yaml:"cookie_secret" env:"OSCAR_COOKIE_SECRET"`
+	// BindCookieIP only lets clients sign on to BOS from the IP address they logged in to the authorizer from
+	BindCookieIP bool `yaml:"bind_cookie_ip" env:"OSCAR_BIND_COOKIE_IP"`
+
+	Proxy ProxyConfig `yaml:"proxy"`
+}
+
+// ValidateListeners checks that every listener has what its role needs. Service listeners and the rendezvous proxy
+// have to run in the same server as BOS, since chat rooms and the connections users are signed on with are only
+// kept in that server's memory.
+func (c *OscarConfig) ValidateListeners() error {
+	servesBOS := false
+	for _, listener := range c.Listeners {
+		switch listener.Role {
+		case ListenerRoleAll, ListenerRoleBOS:
+			servesBOS = true
+		case ListenerRoleAuth:
+		case ListenerRoleService:
+			if listener.Addr == "" || len(listener.Families) == 0 || listener.Host == "" {
+				return errors.Errorf("service listener %q needs an addr, families and a host", listener.Addr)
+			}
+		default:
+			return errors.Errorf("unknown listener role %q", listener.Role)
+		}
+	}
+
+	for _, listener := range c.Listeners {
+		if listener.Role == ListenerRoleService && !servesBOS {
+			return errors.Errorf("service listener %q needs a bos listener in the same server", listener.Addr)
+		}
+	}
+	if c.Proxy.Addr != "" && !servesBOS {
+		return errors.New("the rendezvous proxy needs a bos listener in the same server")
+	}
+
+	return nil
+}
+
+// SplitListeners is true if the authorizer and BOS can run in different processes, which then have to share the
+// cookie secret
+func (c *OscarConfig) SplitListeners() bool {
+	for _, listener := range c.Listeners {
+		if listener.Role == ListenerRoleAuth || listener.Role == ListenerRoleBOS {
+			return true
+		}
+	}
+	return false
+}
+
+// Listener roles
+const (
+	// ListenerRoleAll logs users in and serves them, like a server without separate listeners
+	ListenerRoleAll = "all"
+	// ListenerRoleAuth only logs users in (family 0x17) and sends them on to BOS with a cookie
+	ListenerRoleAuth = "auth"
+	// ListenerRoleBOS serves users who sign on with a cookie from the authorizer
+	ListenerRoleBOS = "bos"
+	// ListenerRoleService serves the connections users open for a single service, like a chat room
+	ListenerRoleService = "service"
+)
+
+// ListenerConfig is an address the server accepts OSCAR connections on and what it does for them. Families
+// limits which services the listener offers, and is required for service listeners. Clients asking for one of a
+// service listener's families are sent to host.
+type ListenerConfig struct {
+	Addr     string   `yaml:"addr"`
+	Role     string   `yaml:"role"`
+	Host     string   `yaml:"host"`
+	Families []uint16 `yaml:"families"`
+}
+
+// ProxyConfig turns on the rendezvous proxy that clients fall back on for file transfers and direct IMs when
+// they can't connect to each other. The proxy is off if addr isn't set. Only users signed on to the same server
+// can send through it.
+type ProxyConfig struct {
+	Addr string `yaml:"addr" env:"OSCAR_PROXY_ADDR"`
+	// IP clients are told to connect to
+	IP string `yaml:"ip" env:"OSCAR_PROXY_IP"`
+	// MaxBytes limits how much each client can send in a single transfer, 0 means no limit
+	MaxBytes int64 `yaml:"max_bytes" env:"OSCAR_PROXY_MAX_BYTES"`
+}
+
+// APIConfig turns on the HTTP API for signing up for an account. The API is off if addr isn't set.
+type APIConfig struct {
+	Addr string `yaml:"addr" env:"API_ADDR"`
+	// BaseURL is where users can reach the API, verification emails link here
+	BaseURL string       `yaml:"base_url" env:"API_BASE_URL"`
+	Mailer  MailerConfig `yaml:"mailer"`
+}
+
+// MailerConfig picks how emails are sent: "stdout" prints them and "file" saves each one in dir
+type MailerConfig struct {
+	Kind string `yaml:"kind" env:"MAILER_KIND" env-default:"stdout"`
+	Dir  string `yaml:"dir" env:"MAILER_DIR" env-default:"mail"`
+}
+
+// BARTConfig is where uploaded buddy icons are kept
+type BARTConfig struct {
+	Dir string `yaml:"dir" env:"BART_DIR" env-default:"bart"`
 }
 
 type DBConfig struct {
@@ -43,5 +228,31 @@ func FromFile(filepath string) (*config, error) {
 	if err != nil {
 		return nil, err
 	}
+
+	if len(cfg.AppConfig.RateClasses) == 0 {
+		cfg.AppConfig.RateClasses = DefaultRateClasses
+	}
+
+	for _, class := range cfg.AppConfig.RateClasses {
+		if err := class.Validate(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(cfg.OscarConfig.Listeners) == 0 {
+		if cfg.OscarConfig.Addr == "" {
+			return nil, errors.New("oscar.addr or oscar.listeners must be set")
+		}
+		cfg.OscarConfig.Listeners = []ListenerConfig{{Addr: cfg.OscarConfig.Addr, Role: ListenerRoleAll}}
+	}
+
+	if err := cfg.OscarConfig.ValidateListeners(); err != nil {
+		return nil, err
+	}
+
+	if cfg.OscarConfig.CookieSecret == "" && cfg.OscarConfig.SplitListeners() {
+		return nil, errors.New("oscar.cookie_secret must be set when listeners have separate roles")
+	}
+
 	return &cfg, nil
 }
@@ -0,0 +1,77 @@
+package config
+
+import (
+	"testing"
+)
+
+func TestRateClassValidate(t *testing.T) {
+	for _, class := range DefaultRateClasses {
+		if err := class.Validate(); err != nil {
+			t.Errorf("expected default rate class %d to be valid: %s", class.ID, err)
+		}
+	}
+
+	noWindow := DefaultRateClasses[0]
+	noWindow.WindowSize = 0
+	if err := noWindow.Validate(); err == nil {
+		t.Error("expected a rate class without a window to be invalid")
+	}
+
+	unordered := DefaultRateClasses[0]
+	unordered.LimitLevel = unordered.AlertLevel
+	if err := unordered.Validate(); err == nil {
+		t.Error("expected a rate class with unordered levels to be invalid")
+	}
+}
+
+func TestSplitListeners(t *testing.T) {
+	tests := []struct {
+		name      string
+		listeners []ListenerConfig
+		expected  bool
+	}{
+		{"single", []ListenerConfig{{Addr: ":5190", Role: ListenerRoleAll}}, false},
+		{"local service", []ListenerConfig{{Addr: ":5190", Role: ListenerRoleAll}, {Addr: ":5191", Role: ListenerRoleService}}, false},
+		{"auth", []ListenerConfig{{Addr: ":5190", Role: ListenerRoleAuth}}, true},
+		{"bos", []ListenerConfig{{Addr: ":5191", Role: ListenerRoleBOS}}, true},
+	}
+
+	for _, test := range tests {
+		c := &OscarConfig{Listeners: test.listeners}
+		if result := c.SplitListeners(); result != test.expected {
+			t.Errorf("%s: expected %v, got %v", test.name, test.expected, result)
+		}
+	}
+}
+
+func TestValidateListeners(t *testing.T) {
+	service := ListenerConfig{Addr: ":5192", Role: ListenerRoleService, Host: "example.com:5192", Families: []uint16{0x0e}}
+	tests := []struct {
+		name      string
+		listeners []ListenerConfig
+		valid     bool
+	}{
+		{"single", []ListenerConfig{{Addr: ":5190", Role: ListenerRoleAll}}, true},
+		{"split", []ListenerConfig{{Addr: ":5190", Role: ListenerRoleAuth}, {Addr: ":5191", Role: ListenerRoleBOS}, service}, true},
+		{"auth only", []ListenerConfig{{Addr: ":5190", Role: ListenerRoleAuth}}, true},
+		{"service without bos", []ListenerConfig{{Addr: ":5190", Role: ListenerRoleAuth}, service}, false},
+		{"service without addr", []ListenerConfig{{Addr: ":5190", Role: ListenerRoleAll}, {Role: ListenerRoleService, Host: "example.com:5192", Families: []uint16{0x0e}}}, false},
+		{"service without families", []ListenerConfig{{Addr: ":5190", Role: ListenerRoleAll}, {Addr: ":5192", Role: ListenerRoleService, Host: "example.com:5192"}}, false},
+		{"unknown role", []ListenerConfig{{Addr: ":5190", Role: "chat"}}, false},
+	}
+
+	for _, test := range tests {
+		c := &OscarConfig{Listeners: test.listeners}
+		if err := c.ValidateListeners(); (err == nil) != test.valid {
+			t.Errorf("%s: expected valid to be %v, got %v", test.name, test.valid, err)
+		}
+	}
+
+	proxy := ProxyConfig{Addr: ":5194"}
+	if err := (&OscarConfig{Listeners: []ListenerConfig{{Addr: ":5190", Role: ListenerRoleAll}}, Proxy: proxy}).ValidateListeners(); err != nil {
+		t.Errorf("expected a proxy next to bos to be valid, got %v", err)
+	}
+	if err := (&OscarConfig{Listeners: []ListenerConfig{{Addr: ":5190", Role: ListenerRoleAuth}}, Proxy: proxy}).ValidateListeners(); err == nil {
+		t.Error("expected a proxy without bos to be invalid")
+	}
+}
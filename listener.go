@@ -0,0 +1,69 @@
+package main
+
+import (
+	"aim-oscar/config"
+	"aim-oscar/services"
+)
+
+// Listener is an address the server accepts connections on, along with what it does for the clients that connect
+type Listener struct {
+	Addr string
+	Role string
+	// Families the listener serves, nil means every family its role allows
+	Families map[uint16]bool
+}
+
+func NewListener(c config.ListenerConfig) *Listener {
+	l := &Listener{Addr: c.Addr, Role: c.Role}
+	if len(c.Families) > 0 {
+		l.Families = make(map[uint16]bool)
+		for _, family := range c.Families {
+			l.Families[family] = true
+		}
+	}
+	return l
+}
+
+// Serves returns true if SNACs for a family can be sent to this listener
+func (l *Listener) Serves(family uint16) bool {
+	switch l.Role {
+	case config.ListenerRoleAuth:
+		return family == 0x17
+	case config.ListenerRoleBOS, config.ListenerRoleService:
+		if family == 0x17 {
+			return false
+		}
+	}
+
+	// Every connection besides the authorizer's needs generic service controls
+	if family == 0x01 || l.Families == nil {
+		return true
+	}
+	return l.Families[family]
+}
+
+// LogsIn is true if users can log in to this listener with their password
+func (l *Listener) LogsIn() bool {
+	return l.Role == config.ListenerRoleAll || l.Role == config.ListenerRoleAuth
+}
+
+// SignsOn is true if users can sign on to this listener with a cookie from the authorizer
+func (l *Listener) SignsOn() bool {
+	return l.Role == config.ListenerRoleAll || l.Role == config.ListenerRoleBOS
+}
+
+// serviceAddresses is where clients are sent for the families that have service listeners of their own
+func serviceAddresses(listeners []config.ListenerConfig) map[uint16]string {
+	addresses := make(map[uint16]string)
+	for _, listener := range listeners {
+		if listener.Role != config.ListenerRoleService {
+			continue
+		}
+		for _, family := range listener.Families {
+			if services.RedirectedFamilies[family] {
+				addresses[family] = listener.Host
+			}
+		}
+	}
+	return addresses
+}
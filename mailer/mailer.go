@@ -0,0 +1,72 @@
+package mailer
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Message is an email to send
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer sends emails to users
+type Mailer interface {
+	Send(ctx context.Context, message *Message) error
+}
+
+func writeMessage(w io.Writer, message *Message, now time.Time) error {
+	_, err := fmt.Fprintf(w, "Date: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n", now.Format(time.RFC1123Z), message.To, message.Subject, message.Body)
+	return err
+}
+
+// WriterMailer writes emails out instead of sending them, like to stdout while developing
+type WriterMailer struct {
+	w     io.Writer
+	mutex sync.Mutex
+}
+
+func NewWriterMailer(w io.Writer) *WriterMailer {
+	return &WriterMailer{w: w}
+}
+
+func (m *WriterMailer) Send(ctx context.Context, message *Message) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return errors.Wrap(writeMessage(m.w, message, time.Now()), "could not write email")
+}
+
+// FileMailer saves each email to its own file in a directory
+type FileMailer struct {
+	dir string
+}
+
+func NewFileMailer(dir string) (*FileMailer, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, errors.Wrap(err, "could not create mail directory")
+	}
+	return &FileMailer{dir: dir}, nil
+}
+
+func (m *FileMailer) Send(ctx context.Context, message *Message) error {
+	now := time.Now()
+	name := fmt.Sprintf("%d-%s.eml", now.UnixNano(), strings.NewReplacer("/", "_", "\\", "_").Replace(message.To))
+
+	f, err := os.Create(filepath.Join(m.dir, name))
+	if err != nil {
+		return errors.Wrap(err, "could not create email file")
+	}
+	defer f.Close()
+
+	return errors.Wrap(writeMessage(f, message, now), "could not write email")
+}
@@ -0,0 +1,40 @@
+package mailer
+
+import (
+	"bytes"
+	"context"
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestWriterMailer(t *testing.T) {
+	buf := &bytes.Buffer{}
+	m := NewWriterMailer(buf)
+	if err := m.Send(context.Background(), &Message{To: "toof@example.com", Subject: "hi", Body: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !strings.Contains(buf.String(), "To: toof@example.com\r\n") || !strings.HasSuffix(buf.String(), "\r\n\r\nhello\r\n") {
+		t.Errorf("unexpected email: %q", buf.String())
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	m, err := NewFileMailer(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Send(context.Background(), &Message{To: "toof@example.com", Subject: "hi", Body: "hello"}); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 {
+		t.Errorf("expected one email file, got %d", len(entries))
+	}
+}
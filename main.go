@@ -1,11 +1,16 @@
 package main
 
 import (
+	"aim-oscar/api"
+	"aim-oscar/bart"
 	"aim-oscar/config"
 	"aim-oscar/db"
+	"aim-oscar/mailer"
 	"aim-oscar/models"
+	"aim-oscar/proxy"
 	"aim-oscar/services"
 	"context"
+	"crypto/rand"
 	"flag"
 	"fmt"
 	"log"
@@ -57,43 +62,76 @@ func main() {
 	db.AddQueryHook(bundebug.NewQueryHook(bundebug.WithVerbose(conf.AppConfig.LogLevel == slog.LevelDebug.String())))
 
 	// Register our DB models
-	db.RegisterModel((*models.User)(nil), (*models.Message)(nil), (*models.Buddy)(nil), (*models.EmailVerification)(nil))
+	db.RegisterModel((*models.User)(nil), (*models.Message)(nil), (*models.Buddy)(nil), (*models.EmailVerification)(nil), (*models.Feedbag)(nil))
 
 	// On start, all users must be offline bc there are no connections (while this is a one-server operation)
 	ctx := context.Background()
-	if _, err := db.NewUpdate().Model(&models.User{}).Set("status = ?", models.UserStatusAway).Where("status != ?", models.UserStatusAway).Exec(ctx); err != nil {
+	if _, err := db.NewUpdate().Model(&models.User{}).Set("status = ?", models.UserStatusOffline).Where("status != ?", models.UserStatusOffline).Exec(ctx); err != nil {
 		logger.Error("could not set all users as offline", "err", err.Error())
 		os.Exit(1)
 	}
 
-	listener, err := net.Listen("tcp", conf.OscarConfig.Addr)
+	netListeners := make(map[*Listener]net.Listener)
+	for _, listenerConfig := range conf.OscarConfig.Listeners {
+		netListener, err := net.Listen("tcp", listenerConfig.Addr)
+		if err != nil {
+			fmt.Println("Error listening: ", err.Error())
+			os.Exit(1)
+		}
+		defer netListener.Close()
+
+		netListeners[NewListener(listenerConfig)] = netListener
+	}
+
+	cookieKey := []byte(conf.OscarConfig.CookieSecret)
+	if len(cookieKey) == 0 {
+		logger.Warn("no cookie secret configured, using a random one")
+		cookieKey = make([]byte, 32)
+		if _, err := rand.Read(cookieKey); err != nil {
+			logger.Error("could not generate cookie secret", "err", err.Error())
+			os.Exit(1)
+		}
+	}
+
+	bartStore, err := bart.NewFileStore(conf.BARTConfig.Dir)
 	if err != nil {
-		fmt.Println("Error listening: ", err.Error())
+		logger.Error("could not open BART store", "err", err.Error())
 		os.Exit(1)
 	}
-	defer listener.Close()
 
 	sessionManager := NewSessionManager()
+	roomManager := NewRoomManager()
+
+	icbm := &services.ICBM{Sessions: sessionManager, MaxOfflineMessages: conf.AppConfig.OfflineMessages.MaxPerRecipient}
 
 	// Goroutine that listens for messages to deliver and tries to find a user socket to push them to
-	commCh, messageRoutine := MessageDelivery(sessionManager, logger)
+	commCh, messageRoutine := MessageDelivery(sessionManager, icbm, logger)
+	icbm.CommCh = commCh
 	go messageRoutine(db)
 
 	// Goroutine that listens for users who change their online status and notifies their buddies
 	onlineCh, onlineRoutine := OnlineNotification(sessionManager, logger)
 	go onlineRoutine(db)
+	icbm.OnlineCh = onlineCh
+
+	loginCookies := &services.LoginCookies{Key: cookieKey, BindIP: conf.OscarConfig.BindCookieIP}
 
 	serviceManager := NewServiceManager()
-	serviceManager.RegisterService(0x01, &services.GenericServiceControls{OnlineCh: onlineCh, ServerHostname: conf.OscarConfig.Addr})
-	serviceManager.RegisterService(0x02, &services.LocationServices{OnlineCh: onlineCh})
+	serviceManager.RegisterService(0x01, &services.GenericServiceControls{OnlineCh: onlineCh, CommCh: commCh, OfflineMessageExpiry: conf.AppConfig.OfflineMessages.Expiry, BOSAddress: conf.OscarConfig.BOS, CookieKey: cookieKey, Rooms: roomManager, Sessions: sessionManager, ServiceAddresses: serviceAddresses(conf.OscarConfig.Listeners)})
+	serviceManager.RegisterService(0x02, &services.LocationServices{OnlineCh: onlineCh, Sessions: sessionManager})
 	serviceManager.RegisterService(0x03, &services.BuddyListManagement{OnlineCh: onlineCh})
-	serviceManager.RegisterService(0x04, &services.ICBM{CommCh: commCh})
-	// serviceManager.RegisterService(0x0f, &services.DirectorySearchService{})
-	// serviceManager.RegisterService(0x13, &services.FeedbagService{})
-	serviceManager.RegisterService(0x17, &services.AuthorizationRegistrationService{BOSAddress: conf.OscarConfig.BOS})
+	serviceManager.RegisterService(0x04, icbm)
+	serviceManager.RegisterService(0x09, &services.PrivacyManagement{OnlineCh: onlineCh})
+	serviceManager.RegisterService(0x0d, &services.ChatNavigationService{Rooms: roomManager})
+	serviceManager.RegisterService(0x0e, &services.ChatService{})
+	serviceManager.RegisterService(0x0f, &services.DirectorySearchService{MaxResults: conf.AppConfig.Directory.MaxResults})
+	serviceManager.RegisterService(0x10, &services.BARTService{OnlineCh: onlineCh, Store: bartStore})
+	serviceManager.RegisterService(0x13, &services.FeedbagService{OnlineCh: onlineCh})
+	serviceManager.RegisterService(0x15, &services.ICQService{})
+	serviceManager.RegisterService(0x17, &services.AuthorizationRegistrationService{BOSAddress: conf.OscarConfig.BOS, Cookies: loginCookies})
 	serviceManager.RegisterService(0x18, &services.AlertService{})
 
-	handler := NewHandler(&conf.AppConfig, db, logger, sessionManager, serviceManager, onlineCh)
+	handler := NewHandler(&conf.AppConfig, db, logger, sessionManager, roomManager, serviceManager, onlineCh, cookieKey, loginCookies, conf.OscarConfig.BOS)
 
 	var metricsServer *http.Server
 	if conf.AppConfig.Metrics.Addr != "" {
@@ -115,6 +153,53 @@ func main() {
 		}()
 	}
 
+	var apiServer *http.Server
+	if conf.APIConfig.Addr != "" {
+		var m mailer.Mailer
+		switch conf.APIConfig.Mailer.Kind {
+		case "stdout":
+			m = mailer.NewWriterMailer(os.Stdout)
+		case "file":
+			if m, err = mailer.NewFileMailer(conf.APIConfig.Mailer.Dir); err != nil {
+				logger.Error("could not set up mailer", "err", err.Error())
+				os.Exit(1)
+			}
+		default:
+			logger.Error("unknown mailer kind", "kind", conf.APIConfig.Mailer.Kind)
+			os.Exit(1)
+		}
+
+		apiServer = &http.Server{
+			Addr:    conf.APIConfig.Addr,
+			Handler: api.NewServer(db, m, conf.APIConfig.BaseURL, logger).Handler(),
+		}
+		go func() {
+			logger.Info("API started", "api_addr", apiServer.Addr)
+			apiServer.ListenAndServe()
+		}()
+	}
+
+	var proxyListener net.Listener
+	if conf.OscarConfig.Proxy.Addr != "" {
+		proxyIP := net.ParseIP(conf.OscarConfig.Proxy.IP)
+		if proxyIP == nil || proxyIP.To4() == nil {
+			logger.Error("rendezvous proxy needs an IPv4 address for clients to connect to", "ip", conf.OscarConfig.Proxy.IP)
+			os.Exit(1)
+		}
+
+		proxyListener, err = net.Listen("tcp", conf.OscarConfig.Proxy.Addr)
+		if err != nil {
+			logger.Error("could not listen for rendezvous proxy", "err", err.Error())
+			os.Exit(1)
+		}
+
+		proxyServer := proxy.NewServer(proxyIP, conf.OscarConfig.Proxy.MaxBytes, sessionManager, logger)
+		go func() {
+			logger.Info("Rendezvous proxy started", "proxy_addr", conf.OscarConfig.Proxy.Addr)
+			proxyServer.Serve(proxyListener)
+		}()
+	}
+
 	exitChan := make(chan os.Signal, 1)
 	signal.Notify(exitChan, os.Interrupt, syscall.SIGINT, syscall.SIGTERM, syscall.SIGABRT)
 	go func() {
@@ -125,20 +210,32 @@ func main() {
 		if metricsServer != nil {
 			metricsServer.Close()
 		}
+		if apiServer != nil {
+			apiServer.Close()
+		}
+		if proxyListener != nil {
+			proxyListener.Close()
+		}
 
 		logger.Info("Shutting down")
 		os.Exit(1)
 	}()
 
-	logger.Info("Listening on " + conf.OscarConfig.Addr)
 	logger.Info("BOS host " + conf.OscarConfig.BOS)
-	for {
-		conn, err := listener.Accept()
-		if err != nil {
-			logger.Error("error accepting connection: ", err.Error())
-			os.Exit(1)
-		}
-
-		go handler.Handle(conn, logger)
+	for listener, netListener := range netListeners {
+		logger.Info("Listening on "+listener.Addr, "role", listener.Role)
+		go func(listener *Listener, netListener net.Listener) {
+			for {
+				conn, err := netListener.Accept()
+				if err != nil {
+					logger.Error("error accepting connection: ", err.Error())
+					os.Exit(1)
+				}
+
+				go handler.Handle(conn, listener, logger)
+			}
+		}(listener, netListener)
 	}
+
+	select {}
 }
@@ -3,6 +3,7 @@ package main
 import (
 	"aim-oscar/models"
 	"aim-oscar/oscar"
+	"aim-oscar/services"
 	"aim-oscar/util"
 	"context"
 	"time"
@@ -13,7 +14,7 @@ import (
 
 type routineFn func(db *bun.DB)
 
-func MessageDelivery(sm *SessionManager, parentLogger *slog.Logger) (chan *models.Message, routineFn) {
+func MessageDelivery(sm *SessionManager, icbm *services.ICBM, parentLogger *slog.Logger) (chan *models.Message, routineFn) {
 	commCh := make(chan *models.Message, 1)
 	logger := parentLogger.With(slog.String("routine", "message_delivery"))
 
@@ -31,17 +32,11 @@ func MessageDelivery(sm *SessionManager, parentLogger *slog.Logger) (chan *model
 				With(slog.Group("message", slog.String("from", message.From), slog.String("to", message.To), slog.Uint64("cookie", message.Cookie)))
 
 			// If the user isn't connected, don't send the message
-			session := sm.GetSession(message.To)
+			session := sm.GetSessionForFamily(message.To, 0x04)
 			if session == nil {
 				continue
 			}
 
-			messageSnac := oscar.NewSNAC(4, 7)
-			messageSnac.Data.WriteUint64(message.Cookie)
-			messageSnac.Data.WriteUint16(1)
-			messageSnac.Data.WriteLPString(message.From)
-			messageSnac.Data.WriteUint16(0) // TODO: sender's warning level
-
 			ctx := context.Background()
 			user, err := models.UserByScreenName(ctx, db, message.From)
 			if err != nil {
@@ -49,28 +44,14 @@ func MessageDelivery(sm *SessionManager, parentLogger *slog.Logger) (chan *model
 				continue
 			}
 
-			tlvs := []*oscar.TLV{
-				oscar.NewTLV(1, util.Word(0)),                                                     // TODO: user class
-				oscar.NewTLV(6, util.Dword(uint32(user.Status))),                                  // TODO: user status
-				oscar.NewTLV(0x0f, util.Dword(uint32(time.Since(user.LastActivityAt).Seconds()))), // idle time
-				oscar.NewTLV(0x03, util.Dword(uint32(user.LastActivityAt.Second()))),              // TODO: signon time
-				// oscar.NewTLV(4, []byte{}), // TODO: this TLV appears in automated responses like away messages
+			// The recipient's client may not want messages from users who have been warned too much
+			if !icbm.AcceptsMessageFrom(message.To, user) {
+				msgLogger.Info("recipient doesn't accept messages at the author's warning level")
+				continue
 			}
 
-			messageSnac.AppendTLVs(tlvs)
-
-			frag := oscar.Buffer{}
-			frag.Write([]byte{5, 1, 0, 4, 1, 1, 1, 2})          // TODO: first fragment [id, version, len, len, (cap * len)... ]
-			frag.Write([]byte{1, 1})                            // message text fragment start (this is a busted "TLV")
-			frag.WriteUint16(uint16(len(message.Contents) + 4)) // length of TLV
-			frag.Write([]byte{0, 0, 0, 0})                      // TODO: message charset number, message charset subset
-			frag.WriteString(message.Contents)
-
-			// Append the fragments
-			messageSnac.Data.WriteBinary(oscar.NewTLV(2, frag.Bytes()))
-
 			messageFlap := oscar.NewFLAP(2)
-			messageFlap.Data.WriteBinary(messageSnac)
+			messageFlap.Data.WriteBinary(messageSNAC(message, user, sm.GetSession(message.From)))
 			if err := session.Send(messageFlap); err != nil {
 				msgLogger.Error("Could not deliver message", slog.String("err", err.Error()))
 				continue
@@ -83,8 +64,91 @@ func MessageDelivery(sm *SessionManager, parentLogger *slog.Logger) (chan *model
 					msgLogger.Error("could not mark message as delivered", slog.String("err", err.Error()))
 				}
 			}
+
+			// Let the author know if the recipient is away. Auto-responses and stored messages don't get one.
+			if message.Channel != 2 && !message.AutoResponse && !message.Offline {
+				if err := sendAutoResponse(ctx, db, sm, icbm, message); err != nil {
+					msgLogger.Error("could not send auto-response", slog.String("err", err.Error()))
+				}
+			}
 		}
 	}
 
 	return commCh, routine
 }
+
+// messageSNAC builds the 0x04/0x07 that hands a message from its author to the recipient. The author's session
+// is nil if they signed off since sending the message.
+func messageSNAC(message *models.Message, author *models.User, authorSession *oscar.Session) *oscar.SNAC {
+	msgChannel := message.Channel
+	if msgChannel == 0 {
+		msgChannel = 1
+	}
+
+	messageSnac := oscar.NewSNAC(4, 7)
+	messageSnac.Data.WriteUint64(message.Cookie)
+	messageSnac.Data.WriteUint16(msgChannel)
+	services.WriteUserInfo(&messageSnac.Data, author, authorSession)
+
+	// Messages that waited for the recipient to sign on say when they were sent
+	if message.Offline {
+		messageSnac.Data.WriteBinary(oscar.NewTLV(0x16, util.Dword(uint32(message.CreatedAt.Unix()))))
+	}
+
+	// Rendezvous messages already have their rendezvous block ready to go
+	if msgChannel == 2 {
+		messageSnac.Data.WriteBinary(oscar.NewTLV(5, message.Data))
+		return messageSnac
+	}
+
+	frag := oscar.Buffer{}
+	frag.Write([]byte{5, 1, 0, 4, 1, 1, 1, 2})          // TODO: first fragment [id, version, len, len, (cap * len)... ]
+	frag.Write([]byte{1, 1})                            // message text fragment start (this is a busted "TLV")
+	frag.WriteUint16(uint16(len(message.Contents) + 4)) // length of TLV
+	frag.Write([]byte{0, 0, 0, 0})                      // TODO: message charset number, message charset subset
+	frag.WriteString(message.Contents)
+
+	// Append the fragments
+	messageSnac.Data.WriteBinary(oscar.NewTLV(2, frag.Bytes()))
+
+	// Automated responses like away messages are marked so clients don't treat them as typed by the author
+	if message.AutoResponse {
+		messageSnac.Data.WriteBinary(oscar.NewTLV(4, []byte{}))
+	}
+
+	return messageSnac
+}
+
+// sendAutoResponse sends the recipient's away message back to the message's author while they're away. The
+// recipient's client may also send one itself, which the ICBM service drops if the server already answered for it
+// recently.
+func sendAutoResponse(ctx context.Context, db *bun.DB, sm *SessionManager, icbm *services.ICBM, message *models.Message) error {
+	recipient, err := models.UserByScreenName(ctx, db, message.To)
+	if err != nil {
+		return err
+	}
+	if recipient == nil || !recipient.Status.Away() || recipient.AwayMessage == "" {
+		return nil
+	}
+
+	authorSession := sm.GetSessionForFamily(message.From, 0x04)
+	if authorSession == nil {
+		return nil
+	}
+
+	if !icbm.AllowAutoResponse(message.To, message.From, time.Now()) {
+		return nil
+	}
+
+	autoResponse := &models.Message{
+		Cookie:       message.Cookie,
+		From:         message.To,
+		To:           message.From,
+		Contents:     recipient.AwayMessage,
+		AutoResponse: true,
+	}
+
+	autoResponseFlap := oscar.NewFLAP(2)
+	autoResponseFlap.Data.WriteBinary(messageSNAC(autoResponse, recipient, sm.GetSession(message.To)))
+	return authorSession.Send(autoResponseFlap)
+}
@@ -0,0 +1,136 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+// DirectoryInfo is what a user tells the directory about themselves
+type DirectoryInfo struct {
+	bun.BaseModel `bun:"table:directory_info"`
+	UserUIN       int64 `bun:",pk"`
+	FirstName     string
+	MiddleName    string
+	LastName      string
+	MaidenName    string
+	Nickname      string
+	Street        string
+	City          string
+	State         string
+	Zip           string
+	Country       string
+	Interests     []string `bun:",array"`
+	// Searchable is false for users who don't want to be found in directory searches
+	Searchable bool      `bun:",notnull,default:true"`
+	UpdatedAt  time.Time `bun:",nullzero,notnull,default:current_timestamp"`
+
+	User *User `bun:"rel:belongs-to,join:user_uin=uin"`
+}
+
+// DirectoryInfoForUser returns a user's directory info, or nil if they never set any
+func DirectoryInfoForUser(ctx context.Context, db *bun.DB, uin int64) (*DirectoryInfo, error) {
+	info := new(DirectoryInfo)
+	if err := db.NewSelect().Model(info).Where("user_uin = ?", uin).Scan(ctx); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "could not fetch directory info")
+	}
+	return info, nil
+}
+
+// NewDirectoryInfo is the directory info of a user who hasn't filled any out
+func NewDirectoryInfo(user *User) *DirectoryInfo {
+	return &DirectoryInfo{UserUIN: user.UIN, Searchable: true, User: user}
+}
+
+// SearchDirectoryByEmail finds the user with an email address, unless they opted out of searches
+func SearchDirectoryByEmail(ctx context.Context, db *bun.DB, email string) ([]*DirectoryInfo, error) {
+	user := new(User)
+	if err := db.NewSelect().Model(user).Where("lower(email) = lower(?)", email).Scan(ctx); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "could not search users by email")
+	}
+
+	info, err := DirectoryInfoForUser(ctx, db, user.UIN)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		info = NewDirectoryInfo(user)
+	}
+	if !info.Searchable {
+		return nil, nil
+	}
+	info.User = user
+
+	return []*DirectoryInfo{info}, nil
+}
+
+// SearchDirectory finds searchable users whose directory info matches every field set in query, ignoring
+// case. A query without any fields set finds nobody.
+func SearchDirectory(ctx context.Context, db *bun.DB, query *DirectoryInfo, limit int) ([]*DirectoryInfo, error) {
+	fields := map[string]string{
+		"first_name":  query.FirstName,
+		"middle_name": query.MiddleName,
+		"last_name":   query.LastName,
+		"maiden_name": query.MaidenName,
+		"nickname":    query.Nickname,
+		"street":      query.Street,
+		"city":        query.City,
+		"state":       query.State,
+		"zip":         query.Zip,
+		"country":     query.Country,
+	}
+
+	q := db.NewSelect().Model((*DirectoryInfo)(nil)).Relation("User").Where("searchable")
+	criteria := 0
+	for column, value := range fields {
+		if value == "" {
+			continue
+		}
+		q = q.Where("lower(?) = lower(?)", bun.Ident("directory_info."+column), value)
+		criteria++
+	}
+	if criteria == 0 {
+		return nil, nil
+	}
+
+	var results []*DirectoryInfo
+	if err := q.Order("directory_info.user_uin").Limit(limit).Scan(ctx, &results); err != nil {
+		return nil, errors.Wrap(err, "could not search directory")
+	}
+	return results, nil
+}
+
+// SearchDirectoryByInterest finds searchable users who listed an interest, ignoring case
+func SearchDirectoryByInterest(ctx context.Context, db *bun.DB, interest string, limit int) ([]*DirectoryInfo, error) {
+	var results []*DirectoryInfo
+	err := db.NewSelect().
+		Model(&results).
+		Relation("User").
+		Where("searchable").
+		Where("EXISTS (SELECT 1 FROM unnest(directory_info.interests) AS interest WHERE lower(interest) = lower(?))", interest).
+		Order("directory_info.user_uin").
+		Limit(limit).
+		Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not search directory by interest")
+	}
+	return results, nil
+}
+
+// Save replaces the user's directory info
+func (d *DirectoryInfo) Save(ctx context.Context, db *bun.DB) error {
+	d.UpdatedAt = time.Now()
+	if _, err := db.NewInsert().Model(d).On("CONFLICT (user_uin) DO UPDATE").Exec(ctx); err != nil {
+		return errors.Wrap(err, "could not save directory info")
+	}
+	return nil
+}
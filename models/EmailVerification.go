@@ -1,12 +1,22 @@
 package models
 
 import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/uptrace/bun"
 )
 
-// TODO: move this out of here and into API server
+// EmailVerificationLifetime is how long a verification token can be used after it's sent
+const EmailVerificationLifetime = 48 * time.Hour
+
+var ErrVerificationInvalid = errors.New("verification token is invalid or expired")
+
+// EmailVerification is the token sent to a new user's email address to prove it's theirs
 type EmailVerification struct {
 	bun.BaseModel `bun:"table:email_verification"`
 	UserUIN       int64     `bun:",pk,notnull,unique"`
@@ -16,3 +26,62 @@ type EmailVerification struct {
 	CreatedAt     time.Time `bun:",nullzero,notnull,default:current_timestamp"`
 	UpdatedAt     time.Time `bun:",nullzero,notnull,default:current_timestamp"`
 }
+
+// CreateEmailVerification makes a new token for a user, replacing any token they were sent before
+func CreateEmailVerification(ctx context.Context, db *bun.DB, user *User) (*EmailVerification, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, errors.Wrap(err, "could not generate verification token")
+	}
+
+	verification := &EmailVerification{
+		UserUIN:   user.UIN,
+		User:      user,
+		Token:     hex.EncodeToString(token),
+		UpdatedAt: time.Now(),
+	}
+	_, err := db.NewInsert().
+		Model(verification).
+		On("CONFLICT (user_uin) DO UPDATE").
+		Set("token = EXCLUDED.token").
+		Set("used = FALSE").
+		Set("updated_at = EXCLUDED.updated_at").
+		Exec(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create email verification")
+	}
+	return verification, nil
+}
+
+// VerifyEmail uses up a verification token and marks its user as verified
+func VerifyEmail(ctx context.Context, db *bun.DB, token string, now time.Time) (*User, error) {
+	verification := new(EmailVerification)
+	err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if err := tx.NewSelect().Model(verification).Relation("User").Where("token = ?", token).Where("NOT used").For("UPDATE OF email_verification").Scan(ctx); err != nil {
+			if err == sql.ErrNoRows {
+				return ErrVerificationInvalid
+			}
+			return err
+		}
+		if now.Sub(verification.UpdatedAt) > EmailVerificationLifetime {
+			return ErrVerificationInvalid
+		}
+
+		verification.Used = true
+		verification.UpdatedAt = now
+		if _, err := tx.NewUpdate().Model(verification).Column("used", "updated_at").WherePK().Exec(ctx); err != nil {
+			return err
+		}
+
+		verification.User.Verified = true
+		_, err := tx.NewUpdate().Model(verification.User).Column("verified").WherePK().Exec(ctx)
+		return err
+	})
+	if err == ErrVerificationInvalid {
+		return nil, err
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "could not verify email")
+	}
+	return verification.User, nil
+}
@@ -1,19 +1,133 @@
 package models
 
 import (
+	"context"
+	"database/sql"
 	"time"
 
+	"github.com/pkg/errors"
 	"github.com/uptrace/bun"
 )
 
 type Feedbag struct {
 	bun.BaseModel `bun:"table:feedbag"`
 
-	ScreenName   string
-	GroupId      int
-	ItemId       int
+	ScreenName   string `bun:",pk"`
+	GroupId      int    `bun:",pk"`
+	ItemId       int    `bun:",pk"`
 	ClassId      int
 	Name         string
 	Attributes   []byte
 	LastModified time.Time
 }
+
+// FeedbagItems returns all of the server-stored items for a user, ordered the way the client stored them
+func FeedbagItems(ctx context.Context, db *bun.DB, screen_name string) ([]*Feedbag, error) {
+	var items []*Feedbag
+	if err := db.NewSelect().Model(&items).Where("screen_name = ?", screen_name).Order("group_id", "item_id").Scan(ctx); err != nil {
+		if err == sql.ErrNoRows {
+			return items, nil
+		}
+		return nil, errors.Wrap(err, "could not fetch feedbag")
+	}
+	return items, nil
+}
+
+// FeedbagItem returns a single item from a user's feedbag, or nil if it doesn't exist
+func FeedbagItem(ctx context.Context, db *bun.DB, screen_name string, groupID, itemID int) (*Feedbag, error) {
+	item := new(Feedbag)
+	if err := db.NewSelect().Model(item).Where("screen_name = ?", screen_name).Where("group_id = ?", groupID).Where("item_id = ?", itemID).Scan(ctx); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "could not fetch feedbag item")
+	}
+	return item, nil
+}
+
+// FeedbagLastModified returns the most recent modification time of a user's feedbag and how many items are in it
+func FeedbagLastModified(ctx context.Context, db *bun.DB, screen_name string) (time.Time, int, error) {
+	var lastModified time.Time
+	var count int
+	err := db.NewSelect().
+		Model((*Feedbag)(nil)).
+		ColumnExpr("COALESCE(MAX(last_modified), to_timestamp(0))").
+		ColumnExpr("COUNT(*)").
+		Where("screen_name = ?", screen_name).
+		Scan(ctx, &lastModified, &count)
+	if err != nil {
+		return time.Time{}, 0, errors.Wrap(err, "could not get feedbag modification time")
+	}
+	return lastModified, count, nil
+}
+
+func (f *Feedbag) Insert(ctx context.Context, db *bun.DB) error {
+	f.LastModified = time.Now()
+	if _, err := db.NewInsert().Model(f).Exec(ctx); err != nil {
+		return errors.Wrap(err, "could not insert feedbag item")
+	}
+	return nil
+}
+
+func (f *Feedbag) Update(ctx context.Context, db *bun.DB) error {
+	f.LastModified = time.Now()
+	if _, err := db.NewUpdate().Model(f).WherePK().Exec(ctx); err != nil {
+		return errors.Wrap(err, "could not update feedbag item")
+	}
+	return nil
+}
+
+func (f *Feedbag) Delete(ctx context.Context, db *bun.DB) error {
+	if _, err := db.NewDelete().Model(f).WherePK().Exec(ctx); err != nil {
+		return errors.Wrap(err, "could not delete feedbag item")
+	}
+	return nil
+}
+
+// FeedbagHasName checks if a user has an item of a certain class with a name, like a screen name on their deny list
+func FeedbagHasName(ctx context.Context, db *bun.DB, screen_name string, classID int, name string) (bool, error) {
+	exists, err := db.NewSelect().
+		Model((*Feedbag)(nil)).
+		Where("screen_name = ?", screen_name).
+		Where("class_id = ?", classID).
+		Where("name = ?", name).
+		Exists(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, "could not look up feedbag item")
+	}
+	return exists, nil
+}
+
+// FeedbagItemByName returns the first item of a certain class with a name, or nil if there isn't one
+func FeedbagItemByName(ctx context.Context, db *bun.DB, screen_name string, classID int, name string) (*Feedbag, error) {
+	item := new(Feedbag)
+	err := db.NewSelect().
+		Model(item).
+		Where("screen_name = ?", screen_name).
+		Where("class_id = ?", classID).
+		Where("name = ?", name).
+		Limit(1).
+		Scan(ctx)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "could not fetch feedbag item")
+	}
+	return item, nil
+}
+
+// NextFeedbagItemID finds an unused item id in one of a user's feedbag groups
+func NextFeedbagItemID(ctx context.Context, db *bun.DB, screen_name string, groupID int) (int, error) {
+	var maxID int
+	err := db.NewSelect().
+		Model((*Feedbag)(nil)).
+		ColumnExpr("COALESCE(MAX(item_id), 0)").
+		Where("screen_name = ?", screen_name).
+		Where("group_id = ?", groupID).
+		Scan(ctx, &maxID)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not find next feedbag item id")
+	}
+	return maxID + 1, nil
+}
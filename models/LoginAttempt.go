@@ -0,0 +1,134 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+// LoginResult is how a login attempt turned out
+type LoginResult string
+
+const (
+	LoginResultSuccess     LoginResult = "success"
+	LoginResultBadPassword LoginResult = "bad_password"
+	LoginResultNoSuchUser  LoginResult = "no_such_user"
+	LoginResultLocked      LoginResult = "locked"
+	LoginResultRateLimited LoginResult = "rate_limited"
+
+	// LoginResultUnlocked marks where an admin unlocked an account, failures before it don't count
+	LoginResultUnlocked LoginResult = "unlocked"
+)
+
+const (
+	// Accounts are locked after this many failed logins in a row, and addresses are rate limited after this many
+	// failed logins, within LoginFailureWindow
+	MaxAccountLoginFailures = 5
+	MaxIPLoginFailures      = 20
+	LoginFailureWindow      = time.Hour
+
+	// The first lockout lasts LockoutBase and every failure after that doubles it, up to MaxLockout
+	LockoutBase = time.Minute
+	MaxLockout  = time.Hour
+)
+
+// LoginAttempt records a login for auditing and to lock out accounts and addresses with too many failed logins.
+// Login is normalized, so logins that don't match any user are counted the same way as ones that do and a lockout
+// doesn't give away that an account exists.
+type LoginAttempt struct {
+	bun.BaseModel `bun:"table:login_attempts"`
+	ID            int64       `bun:",pk,autoincrement"`
+	Login         string      `bun:",notnull"`
+	UserUIN       int64       `bun:",nullzero"`
+	IP            string      `bun:",notnull"`
+	Result        LoginResult `bun:",notnull"`
+	CreatedAt     time.Time   `bun:",nullzero,notnull,default:current_timestamp"`
+}
+
+// LockoutDuration is how long logins are refused after a number of failures, once there have been at least
+// threshold of them
+func LockoutDuration(failures int, threshold int) time.Duration {
+	if failures < threshold {
+		return 0
+	}
+
+	lockout := LockoutBase
+	for i := threshold; i < failures && lockout < MaxLockout; i++ {
+		lockout *= 2
+	}
+
+	if lockout > MaxLockout {
+		return MaxLockout
+	}
+	return lockout
+}
+
+// RecordLoginAttempt saves a login attempt. user is nil when the login didn't match anyone.
+func RecordLoginAttempt(ctx context.Context, db *bun.DB, login string, user *User, ip string, result LoginResult, now time.Time) error {
+	attempt := &LoginAttempt{
+		Login:     NormalizeScreenName(login),
+		IP:        ip,
+		Result:    result,
+		CreatedAt: now,
+	}
+	if user != nil {
+		attempt.UserUIN = user.UIN
+	}
+
+	if _, err := db.NewInsert().Model(attempt).Exec(ctx); err != nil {
+		return errors.Wrap(err, "could not record login attempt")
+	}
+	return nil
+}
+
+// IPLockedUntil is when an address may try logging in again after too many failed logins, or the zero time if
+// it isn't locked out
+func IPLockedUntil(ctx context.Context, db *bun.DB, ip string, now time.Time) (time.Time, error) {
+	q := db.NewSelect().Model((*LoginAttempt)(nil)).Where("ip = ?", ip)
+	return lockedUntil(ctx, q, MaxIPLoginFailures, now)
+}
+
+// AccountLockedUntil is when a login may be tried again after too many failed logins in a row, or the zero time if
+// it isn't locked out
+func AccountLockedUntil(ctx context.Context, db *bun.DB, login string, now time.Time) (time.Time, error) {
+	login = NormalizeScreenName(login)
+	lastReset := db.NewSelect().Model((*LoginAttempt)(nil)).
+		ColumnExpr("max(created_at)").
+		Where("login = ?", login).
+		Where("result IN (?)", bun.In([]LoginResult{LoginResultSuccess, LoginResultUnlocked}))
+
+	q := db.NewSelect().Model((*LoginAttempt)(nil)).
+		Where("login = ?", login).
+		Where("created_at > coalesce((?), '-infinity')", lastReset)
+	return lockedUntil(ctx, q, MaxAccountLoginFailures, now)
+}
+
+// lockedUntil counts the failed logins matched by a query within the window and works out when the lockout ends
+func lockedUntil(ctx context.Context, q *bun.SelectQuery, threshold int, now time.Time) (time.Time, error) {
+	var failures int
+	var lastFailure sql.NullTime
+	err := q.
+		ColumnExpr("count(*)").
+		ColumnExpr("max(created_at)").
+		Where("result IN (?)", bun.In([]LoginResult{LoginResultBadPassword, LoginResultNoSuchUser})).
+		Where("created_at > ?", now.Add(-LoginFailureWindow)).
+		Scan(ctx, &failures, &lastFailure)
+	if err != nil {
+		return time.Time{}, errors.Wrap(err, "could not count failed logins")
+	}
+
+	lockout := LockoutDuration(failures, threshold)
+	if lockout == 0 || !lastFailure.Valid {
+		return time.Time{}, nil
+	}
+
+	return lastFailure.Time.Add(lockout), nil
+}
+
+// UnlockAccount lets the user log in again right away by forgetting their failed logins
+func UnlockAccount(ctx context.Context, db *bun.DB, user *User, now time.Time) error {
+	return RecordLoginAttempt(ctx, db, user.ScreenName, user, "", LoginResultUnlocked, now)
+}
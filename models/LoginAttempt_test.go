@@ -0,0 +1,26 @@
+package models
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	tests := []struct {
+		failures int
+		expected time.Duration
+	}{
+		{0, 0},
+		{4, 0},
+		{5, LockoutBase},
+		{6, 2 * LockoutBase},
+		{8, 8 * LockoutBase},
+		{100, MaxLockout},
+	}
+
+	for _, test := range tests {
+		if result := LockoutDuration(test.failures, 5); result != test.expected {
+			t.Errorf("expected %d failures to give %s, got %s", test.failures, test.expected, result)
+		}
+	}
+}
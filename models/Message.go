@@ -19,6 +19,16 @@ type Message struct {
 	StoreOffline  bool
 	CreatedAt     time.Time `bun:",nullzero,notnull,default:current_timestamp"`
 	DeliveredAt   time.Time `bun:",nullzero"`
+
+	// Offline is set on stored messages that are delivered after the recipient signs back on
+	Offline bool `bun:"-"`
+
+	// AutoResponse is set on away messages sent back automatically, which clients show differently
+	AutoResponse bool `bun:"-"`
+
+	// Channel 2 (rendezvous) messages are never stored and carry their rendezvous block instead of contents
+	Channel uint16 `bun:"-"`
+	Data    []byte `bun:"-"`
 }
 
 func InsertMessage(ctx context.Context, db *bun.DB, cookie uint64, from string, to string, contents string) (*Message, error) {
@@ -36,6 +46,35 @@ func InsertMessage(ctx context.Context, db *bun.DB, cookie uint64, from string,
 	return msg, nil
 }
 
+// CountUndeliveredMessages returns how many stored messages are waiting for a user
+func CountUndeliveredMessages(ctx context.Context, db *bun.DB, to string) (int, error) {
+	count, err := db.NewSelect().Model((*Message)(nil)).Where(`"to" = ?`, to).Where("delivered_at IS NULL").Count(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not count undelivered messages")
+	}
+	return count, nil
+}
+
+// UndeliveredMessages returns the stored messages waiting for a user in the order they were sent
+func UndeliveredMessages(ctx context.Context, db *bun.DB, to string) ([]*Message, error) {
+	var messages []*Message
+	err := db.NewSelect().Model(&messages).Where(`"to" = ?`, to).Where("delivered_at IS NULL").Order("created_at ASC", "id ASC").Scan(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get undelivered messages")
+	}
+	return messages, nil
+}
+
+// DeleteExpiredMessages throws away the stored messages for a user that were sent before a point in time and
+// were never delivered
+func DeleteExpiredMessages(ctx context.Context, db *bun.DB, to string, before time.Time) (int64, error) {
+	res, err := db.NewDelete().Model((*Message)(nil)).Where(`"to" = ?`, to).Where("delivered_at IS NULL").Where("created_at < ?", before).Exec(ctx)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not delete expired messages")
+	}
+	return res.RowsAffected()
+}
+
 func (m *Message) String() string {
 	return fmt.Sprintf("<Message from=%s to=%s content=\"%s\">", m.From, m.To, m.Contents)
 }
@@ -44,7 +83,7 @@ func (m *Message) MarkDelivered(ctx context.Context, db *bun.DB) error {
 	// Once messages are delivered, clear their contents
 	m.DeliveredAt = time.Now()
 	m.Contents = "####"
-	if _, err := db.NewUpdate().Model(m).Where("cookie = ?", m.Cookie).Exec(ctx); err != nil {
+	if _, err := db.NewUpdate().Model(m).Column("delivered_at", "contents").WherePK().Exec(ctx); err != nil {
 		return errors.Wrap(err, "could not mark message as updated")
 	}
 
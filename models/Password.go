@@ -0,0 +1,96 @@
+package models
+
+import (
+	"context"
+	"crypto/md5"
+	"crypto/subtle"
+	"encoding/hex"
+	"io"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// AIMMD5String is mixed into every MD5 login hash
+const AIMMD5String = "AOL Instant Messenger (SM)"
+
+// HashPassword fills in the user's bcrypt hash, which checks passwords that clients send in full, and the MD5 of
+// the password that newer clients log in with. The plaintext password is cleared.
+func (user *User) HashPassword(password string) error {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	if err != nil {
+		return errors.Wrap(err, "could not hash password")
+	}
+
+	sum := md5.Sum([]byte(password))
+	user.PasswordHash = string(hash)
+	user.PasswordMD5 = hex.EncodeToString(sum[:])
+	user.Password = ""
+	return nil
+}
+
+// PasswordHashed is false for users that were created before passwords were hashed and haven't been converted yet
+func (user *User) PasswordHashed() bool {
+	return user.PasswordHash != ""
+}
+
+// CheckPassword checks a password that a client sent in full
+func (user *User) CheckPassword(password string) bool {
+	if !user.PasswordHashed() {
+		return subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(user.PasswordHash), []byte(password)) == nil
+}
+
+// MD5LoginHash is the hash a client sends to log in with the cipher it was given. Clients that send TLV 0x4C
+// hash the MD5 of the password instead of the password itself, which is the only kind of login that still works
+// once the password is hashed. ok is false when the user's password can't be used for the kind of login.
+func (user *User) MD5LoginHash(cipher string, hashedPassword bool) (hash []byte, ok bool) {
+	h := md5.New()
+	io.WriteString(h, cipher)
+
+	switch {
+	case hashedPassword && user.PasswordMD5 != "":
+		sum, err := hex.DecodeString(user.PasswordMD5)
+		if err != nil {
+			return nil, false
+		}
+		h.Write(sum)
+	case hashedPassword:
+		sum := md5.Sum([]byte(user.Password))
+		h.Write(sum[:])
+	case !user.PasswordHashed():
+		io.WriteString(h, user.Password)
+	default:
+		return nil, false
+	}
+
+	io.WriteString(h, AIMMD5String)
+	return h.Sum(nil), true
+}
+
+// CheckMD5Login checks the hash a client logged in with against the cipher it was given
+func (user *User) CheckMD5Login(cipher string, hash []byte, hashedPassword bool) bool {
+	expected, ok := user.MD5LoginHash(cipher, hashedPassword)
+	return ok && subtle.ConstantTimeCompare(expected, hash) == 1
+}
+
+// HashPasswords converts every user that still has a plaintext password and returns how many were converted
+func HashPasswords(ctx context.Context, db *bun.DB) (int, error) {
+	var users []*User
+	if err := db.NewSelect().Model(&users).Where("password_hash = ''").Where("password != ''").Scan(ctx); err != nil {
+		return 0, errors.Wrap(err, "could not find users with plaintext passwords")
+	}
+
+	for i, user := range users {
+		if err := user.HashPassword(user.Password); err != nil {
+			return i, err
+		}
+		if err := user.Update(ctx, db, "password", "password_hash", "password_md5"); err != nil {
+			return i, err
+		}
+	}
+
+	return len(users), nil
+}
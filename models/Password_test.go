@@ -0,0 +1,70 @@
+package models
+
+import (
+	"crypto/md5"
+	"io"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	plaintext := &User{Password: "hunter2"}
+	hashed := &User{}
+	if err := hashed.HashPassword("hunter2"); err != nil {
+		t.Fatal(err)
+	}
+
+	if hashed.Password != "" {
+		t.Errorf("expected the plaintext password to be cleared")
+	}
+
+	for _, user := range []*User{plaintext, hashed} {
+		if !user.CheckPassword("hunter2") {
+			t.Errorf("expected the right password to be accepted (hashed: %v)", user.PasswordHashed())
+		}
+		if user.CheckPassword("hunter3") {
+			t.Errorf("expected the wrong password to be rejected (hashed: %v)", user.PasswordHashed())
+		}
+	}
+}
+
+func TestCheckMD5Login(t *testing.T) {
+	const cipher = "ABCDEFGH"
+
+	h := md5.New()
+	io.WriteString(h, cipher)
+	io.WriteString(h, "hunter2")
+	io.WriteString(h, AIMMD5String)
+	oldStyle := h.Sum(nil)
+
+	sum := md5.Sum([]byte("hunter2"))
+	h = md5.New()
+	io.WriteString(h, cipher)
+	h.Write(sum[:])
+	io.WriteString(h, AIMMD5String)
+	newStyle := h.Sum(nil)
+
+	plaintext := &User{Password: "hunter2"}
+	hashed := &User{}
+	if err := hashed.HashPassword("hunter2"); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		user           *User
+		hash           []byte
+		hashedPassword bool
+		expected       bool
+	}{
+		{plaintext, oldStyle, false, true},
+		{plaintext, newStyle, true, true},
+		{hashed, newStyle, true, true},
+		{hashed, oldStyle, false, false},
+		{hashed, oldStyle, true, false},
+	}
+
+	for i, test := range tests {
+		if result := test.user.CheckMD5Login(cipher, test.hash, test.hashedPassword); result != test.expected {
+			t.Errorf("test %d: expected %v, got %v", i, test.expected, result)
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package models
+
+import (
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+const (
+	MinScreenNameLength = 3
+	MaxScreenNameLength = 16
+	MinPasswordLength   = 4
+	MaxPasswordLength   = 16
+)
+
+var (
+	ErrScreenNameLength     = errors.Errorf("screen names must be %d to %d characters long", MinScreenNameLength, MaxScreenNameLength)
+	ErrScreenNameCharacters = errors.New("screen names can only have letters, numbers and spaces and must start with a letter")
+	ErrScreenNameReserved   = errors.New("screen name is reserved")
+	ErrScreenNameTaken      = errors.New("screen name is taken")
+	ErrEmailTaken           = errors.New("email is already registered")
+	ErrPasswordLength       = errors.Errorf("passwords must be %d to %d characters long", MinPasswordLength, MaxPasswordLength)
+)
+
+// reservedScreenNames can't be registered, compared without case or spaces. Numbering one doesn't make it
+// available, e.g. "Admin 2" is reserved too.
+var reservedScreenNames = map[string]bool{
+	"aim":           true,
+	"aimbot":        true,
+	"aol":           true,
+	"icq":           true,
+	"admin":         true,
+	"administrator": true,
+	"root":          true,
+	"system":        true,
+	"support":       true,
+	"staff":         true,
+	"moderator":     true,
+	"postmaster":    true,
+	"abuse":         true,
+}
+
+// NormalizeScreenName is how screen names are compared: without case or spaces
+func NormalizeScreenName(screen_name string) string {
+	return strings.ToLower(strings.ReplaceAll(screen_name, " ", ""))
+}
+
+// ValidateScreenName checks a screen name against the rules for registering one. ICQ users get their UIN as their
+// screen name instead, which doesn't go through these rules.
+func ValidateScreenName(screen_name string) error {
+	if len(screen_name) < MinScreenNameLength || len(screen_name) > MaxScreenNameLength {
+		return ErrScreenNameLength
+	}
+
+	for i, c := range screen_name {
+		isLetter := (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+		isDigit := c >= '0' && c <= '9'
+		if i == 0 && !isLetter {
+			return ErrScreenNameCharacters
+		}
+		if !isLetter && !isDigit && c != ' ' {
+			return ErrScreenNameCharacters
+		}
+	}
+	if strings.HasSuffix(screen_name, " ") || strings.Contains(screen_name, "  ") {
+		return ErrScreenNameCharacters
+	}
+
+	if reservedScreenNames[strings.TrimRight(NormalizeScreenName(screen_name), "0123456789")] {
+		return ErrScreenNameReserved
+	}
+
+	return nil
+}
+
+// ValidatePassword checks a password against the rules for registering one. Older clients can't send longer ones.
+func ValidatePassword(password string) error {
+	if len(password) < MinPasswordLength || len(password) > MaxPasswordLength {
+		return ErrPasswordLength
+	}
+	return nil
+}
+
+// ValidateLogin checks the screen name or UIN a client is signing on with could belong to someone, so logins
+// that could never have been registered are turned away before looking them up
+func ValidateLogin(login string) error {
+	if IsUIN(login) {
+		return nil
+	}
+	if len(login) < MinScreenNameLength || len(login) > MaxScreenNameLength {
+		return ErrScreenNameLength
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package models
+
+import (
+	"testing"
+)
+
+func TestValidateScreenName(t *testing.T) {
+	tests := []struct {
+		screenName string
+		expected   error
+	}{
+		{"toof", nil},
+		{"Toof Man 99", nil},
+		{"ab", ErrScreenNameLength},
+		{"abcdefghijklmnopq", ErrScreenNameLength},
+		{"9lives", ErrScreenNameCharacters},
+		{"toof!", ErrScreenNameCharacters},
+		{"toof ", ErrScreenNameCharacters},
+		{"to  of", ErrScreenNameCharacters},
+		{"AIM Bot", ErrScreenNameReserved},
+		{"admin1", ErrScreenNameReserved},
+		{"Admin 2", ErrScreenNameReserved},
+		{"Aimee", nil},
+		{"Aolani", nil},
+		{"Rootbeer", nil},
+		{"Systemic", nil},
+		{"Staffordshire", nil},
+		{"Supportive", nil},
+		{"Admin2b", nil},
+	}
+
+	for _, test := range tests {
+		if err := ValidateScreenName(test.screenName); err != test.expected {
+			t.Errorf("expected %q to give %v, got %v", test.screenName, test.expected, err)
+		}
+	}
+}
+
+func TestValidateLogin(t *testing.T) {
+	if err := ValidateLogin("100001"); err != nil {
+		t.Errorf("expected a UIN to be a valid login, got %v", err)
+	}
+	if err := ValidateLogin("x"); err == nil {
+		t.Errorf("expected a screen name that's too short to be an invalid login")
+	}
+}
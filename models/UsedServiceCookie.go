@@ -0,0 +1,37 @@
+package models
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+// UsedServiceCookie is a service cookie that a user signed on with. They're kept in the database so that a cookie
+// can only be used once, whichever server it's used on, and are deleted once they expire.
+type UsedServiceCookie struct {
+	bun.BaseModel `bun:"table:used_service_cookies"`
+	Nonce         string    `bun:",pk"`
+	ExpiresAt     time.Time `bun:",notnull"`
+}
+
+// UseServiceCookie marks a service cookie as used. Returns false if it had been used already.
+func UseServiceCookie(ctx context.Context, db *bun.DB, nonce string, expiresAt time.Time, now time.Time) (bool, error) {
+	// Expired cookies are refused anyway, there's no need to remember them
+	if _, err := db.NewDelete().Model((*UsedServiceCookie)(nil)).Where("expires_at < ?", now).Exec(ctx); err != nil {
+		return false, errors.Wrap(err, "could not delete expired service cookies")
+	}
+
+	cookie := &UsedServiceCookie{Nonce: nonce, ExpiresAt: expiresAt}
+	res, err := db.NewInsert().Model(cookie).On("CONFLICT (nonce) DO NOTHING").Exec(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, "could not use service cookie")
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "could not use service cookie")
+	}
+	return n == 1, nil
+}
@@ -3,6 +3,8 @@ package models
 import (
 	"context"
 	"database/sql"
+	"fmt"
+	"strconv"
 	"time"
 
 	"github.com/pkg/errors"
@@ -13,6 +15,8 @@ type UserStatus int16
 
 func (u UserStatus) String() string {
 	switch u {
+	case UserStatusOffline:
+		return "Offline"
 	case UserStatusOnline:
 		return "Online"
 	case UserStatusAway:
@@ -32,16 +36,17 @@ func (u UserStatus) String() string {
 	}
 }
 
+// Connected is true when the user is signed on, whatever status they picked
 func (u UserStatus) Connected() bool {
 	switch u {
 	case UserStatusOnline:
 		return true
 	case UserStatusAway:
-		return false
+		return true
 	case UserStatusDnd:
-		return false
+		return true
 	case UserStatusNA:
-		return false
+		return true
 	case UserStatusOccupied:
 		return true
 	case UserStatusFree4Chat:
@@ -53,7 +58,59 @@ func (u UserStatus) Connected() bool {
 	}
 }
 
+// Away is true for the statuses a user isn't at their computer in, which are the ones an away message answers for
+func (u UserStatus) Away() bool {
+	switch u {
+	case UserStatusAway, UserStatusDnd, UserStatusNA, UserStatusOccupied:
+		return true
+	default:
+		return false
+	}
+}
+
+// Flags are the status bits sent to clients in the user info TLV 0x06. ICQ clients expect the busier states to
+// include the bits of the states below them, e.g. DND is also Occupied and Away.
+func (u UserStatus) Flags() uint16 {
+	switch u {
+	case UserStatusAway:
+		return 0x0001
+	case UserStatusDnd:
+		return 0x0013
+	case UserStatusNA:
+		return 0x0005
+	case UserStatusOccupied:
+		return 0x0011
+	case UserStatusFree4Chat:
+		return 0x0020
+	case UserStatusInvisible:
+		return 0x0100
+	default:
+		return 0x0000
+	}
+}
+
+// UserStatusFromFlags picks the status for the status bits a client sent, going by the most specific bit set
+func UserStatusFromFlags(flags uint16) UserStatus {
+	switch {
+	case flags&0x0100 != 0:
+		return UserStatusInvisible
+	case flags&0x0020 != 0:
+		return UserStatusFree4Chat
+	case flags&0x0002 != 0:
+		return UserStatusDnd
+	case flags&0x0010 != 0:
+		return UserStatusOccupied
+	case flags&0x0004 != 0:
+		return UserStatusNA
+	case flags&0x0001 != 0:
+		return UserStatusAway
+	default:
+		return UserStatusOnline
+	}
+}
+
 const (
+	UserStatusOffline   = -1
 	UserStatusOnline    = 0
 	UserStatusAway      = 1
 	UserStatusDnd       = 2
@@ -63,35 +120,190 @@ const (
 	UserStatusInvisible = 0x100
 )
 
+// PDMode is the permit/deny (privacy) mode a user picked for who can see them and message them
+type PDMode uint8
+
+const (
+	PDModeAllowAll     PDMode = 1
+	PDModeBlockAll     PDMode = 2
+	PDModePermitSome   PDMode = 3
+	PDModeDenySome     PDMode = 4
+	PDModeAllowBuddies PDMode = 5
+)
+
+func (m PDMode) String() string {
+	switch m {
+	case PDModeAllowAll:
+		return "AllowAll"
+	case PDModeBlockAll:
+		return "BlockAll"
+	case PDModePermitSome:
+		return "PermitSome"
+	case PDModeDenySome:
+		return "DenySome"
+	case PDModeAllowBuddies:
+		return "AllowBuddies"
+	default:
+		return "Unknown"
+	}
+}
+
+const (
+	// Warning levels are stored in tenths of a percent, so 999 is 99.9%
+	MaxWarningLevel = 999
+
+	// A normal warning adds 10%, an anonymous warning only adds 3%
+	WarningIncrease          = 100
+	AnonymousWarningIncrease = 30
+
+	// Warnings wear off by 5% every 10 minutes
+	WarningDecay         = 50
+	WarningDecayInterval = 10 * time.Minute
+)
+
 type User struct {
-	bun.BaseModel       `bun:"table:users"`
-	UIN                 int64  `bun:",pk,autoincrement"`
-	Email               string `bun:",unique"`
-	ScreenName          string `bun:",unique"`
-	Password            string
+	bun.BaseModel `bun:"table:users"`
+	UIN           int64  `bun:",pk,autoincrement"`
+	Email         string `bun:",unique"`
+	ScreenName    string `bun:",unique"`
+	// Password is only set for users whose password hasn't been hashed yet, see HashPasswords
+	Password     string
+	PasswordHash string `bun:",notnull,default:''"`
+	PasswordMD5  string `bun:"password_md5,notnull,default:''"`
+	// Cipher is the nonce of the user's latest login cookie, cleared once it's used to sign on
 	Cipher              string
 	CreatedAt           time.Time  `bun:",nullzero,notnull,default:current_timestamp"`
 	UpdatedAt           time.Time  `bun:",nullzero,notnull,default:current_timestamp"`
 	DeletedAt           *time.Time `bun:",nullzero"`
 	Status              UserStatus
 	Verified            bool `bun:",notnull,default:false"`
+	Admin               bool `bun:",notnull,default:false"`
+	Bot                 bool `bun:",notnull,default:false"`
 	Profile             string
 	ProfileEncoding     string
 	AwayMessage         string
 	AwayMessageEncoding string
+	PDMode              PDMode    `bun:",notnull,default:1"`
+	WarningLevel        uint16    `bun:",notnull,default:0"`
+	WarnedAt            time.Time `bun:",nullzero"`
+	IconHash            []byte    `bun:",nullzero"`
+	ICQNickname         string
+	ICQFirstName        string
+	ICQLastName         string
+	ICQCity             string
+	ICQState            string
+	ICQPhone            string
+	ICQZip              string
+	ICQCountry          uint16 `bun:",notnull,default:0"`
+	ICQGender           uint8  `bun:",notnull,default:0"`
+	ICQAge              uint16 `bun:",notnull,default:0"`
+	ICQHomepage         string
+	ICQAbout            string
+	ICQPublishEmail     bool      `bun:",notnull,default:false"`
 	LastActivityAt      time.Time `bin:"-"`
 }
 
-func (user *User) SetAway(ctx context.Context, db *bun.DB) error {
-	user.Status = UserStatusAway
+func (user *User) SetOffline(ctx context.Context, db *bun.DB) error {
+	user.Status = UserStatusOffline
 	user.Cipher = ""
-	if err := user.Update(ctx, db, "status", "cipher"); err != nil {
+	// Clients set their away message again if they sign on away
+	user.AwayMessage = ""
+	user.AwayMessageEncoding = ""
+	if err := user.Update(ctx, db, "status", "cipher", "away_message", "away_message_encoding"); err != nil {
 		return errors.Wrap(err, "could not set user as inactive")
 	}
 
 	return nil
 }
 
+// ConsumeCipher clears the cipher the user logged in with, as long as it hasn't changed or been cleared already.
+// Returns false if someone else got to it first.
+func (user *User) ConsumeCipher(ctx context.Context, db *bun.DB, cipher string) (bool, error) {
+	if cipher == "" {
+		return false, nil
+	}
+
+	res, err := db.NewUpdate().Model(user).Set("cipher = ''").Where("uin = ?", user.UIN).Where("cipher = ?", cipher).Exec(ctx)
+	if err != nil {
+		return false, errors.Wrap(err, "could not clear cipher")
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, errors.Wrap(err, "could not clear cipher")
+	}
+
+	if n != 1 {
+		return false, nil
+	}
+
+	user.Cipher = ""
+	return true, nil
+}
+
+// WarningLevelAt is the user's warning level at a point in time, after it has decayed since they were last warned
+func (user *User) WarningLevelAt(t time.Time) uint16 {
+	if user.WarningLevel == 0 || user.WarnedAt.IsZero() || t.Before(user.WarnedAt) {
+		return user.WarningLevel
+	}
+
+	decay := int64(t.Sub(user.WarnedAt)/WarningDecayInterval) * WarningDecay
+	if decay >= int64(user.WarningLevel) {
+		return 0
+	}
+	return user.WarningLevel - uint16(decay)
+}
+
+// CurrentWarningLevel is the user's warning level right now
+func (user *User) CurrentWarningLevel() uint16 {
+	return user.WarningLevelAt(time.Now())
+}
+
+// Warn raises the user's warning level and returns how much it went up by
+func (user *User) Warn(ctx context.Context, db *bun.DB, anonymous bool) (uint16, error) {
+	now := time.Now()
+	previous := user.WarningLevelAt(now)
+
+	increase := uint16(WarningIncrease)
+	if anonymous {
+		increase = AnonymousWarningIncrease
+	}
+
+	level := previous + increase
+	if level > MaxWarningLevel {
+		level = MaxWarningLevel
+	}
+
+	user.WarningLevel = level
+	user.WarnedAt = now
+	if err := user.Update(ctx, db, "warning_level", "warned_at"); err != nil {
+		return 0, errors.Wrap(err, "could not warn user")
+	}
+
+	return level - previous, nil
+}
+
+// WithStoredPresence returns a copy of the user with the warning level and buddy icon that are in the database.
+// Users are warned from other users' connections and set their icon from their BART connection, so the copy any
+// one connection has can be out of date.
+func (user *User) WithStoredPresence(ctx context.Context, db *bun.DB) (*User, error) {
+	stored := &User{UIN: user.UIN}
+	if err := db.NewSelect().Model(stored).Column("warning_level", "warned_at", "icon_hash").WherePK().Scan(ctx); err != nil {
+		return nil, errors.Wrap(err, "could not fetch stored presence")
+	}
+	return user.withPresence(stored), nil
+}
+
+// withPresence returns a copy of the user with the parts of their presence that other connections change taken
+// from stored
+func (user *User) withPresence(stored *User) *User {
+	updated := *user
+	updated.WarningLevel = stored.WarningLevel
+	updated.WarnedAt = stored.WarnedAt
+	updated.IconHash = stored.IconHash
+	return &updated
+}
+
 type userKey string
 
 func (s userKey) String() string {
@@ -102,21 +314,78 @@ var (
 	currentUser = userKey("user")
 )
 
+// CreateUser registers a user with a screen name that follows the rules in ValidateScreenName
 func CreateUser(ctx context.Context, db *bun.DB, screen_name, password, email string) (*User, error) {
+	if err := ValidateScreenName(screen_name); err != nil {
+		return nil, err
+	}
+	if err := ValidatePassword(password); err != nil {
+		return nil, err
+	}
+
+	taken, err := db.NewSelect().Model((*User)(nil)).Where("lower(replace(screen_name, ' ', '')) = ?", NormalizeScreenName(screen_name)).Exists(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not look up screen name")
+	}
+	if taken {
+		return nil, ErrScreenNameTaken
+	}
+
+	taken, err = db.NewSelect().Model((*User)(nil)).Where("lower(email) = lower(?)", email).Exists(ctx)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not look up email")
+	}
+	if taken {
+		return nil, ErrEmailTaken
+	}
+
 	user := &User{
 		ScreenName: screen_name,
-		Password:   password,
 		Email:      email,
+		Status:     UserStatusOffline,
+	}
+	if err := user.HashPassword(password); err != nil {
+		return nil, err
 	}
 
-	_, err := db.NewInsert().Model(user).Exec(ctx, user)
-	if err != nil {
+	if _, err := db.NewInsert().Model(user).Exec(ctx, user); err != nil {
 		return nil, errors.Wrap(err, "could not create user")
 	}
 
 	return user, nil
 }
 
+// CreateICQUser creates a user whose screen name is their UIN, which is what ICQ clients know each other by
+func CreateICQUser(ctx context.Context, db *bun.DB, password, email string) (*User, error) {
+	if err := ValidatePassword(password); err != nil {
+		return nil, err
+	}
+
+	user := &User{
+		ScreenName: fmt.Sprintf("icq-%s", email),
+		Email:      email,
+		Status:     UserStatusOffline,
+	}
+	if err := user.HashPassword(password); err != nil {
+		return nil, err
+	}
+
+	err := db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		if _, err := tx.NewInsert().Model(user).Exec(ctx, user); err != nil {
+			return err
+		}
+
+		user.ScreenName = strconv.FormatInt(user.UIN, 10)
+		_, err := tx.NewUpdate().Model(user).Column("screen_name").WherePK("uin").Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return nil, errors.Wrap(err, "could not create ICQ user")
+	}
+
+	return user, nil
+}
+
 func UserByScreenName(ctx context.Context, db *bun.DB, screen_name string) (*User, error) {
 	user := new(User)
 	if err := db.NewSelect().Model(user).Where("screen_name = ?", screen_name).Scan(ctx, user); err != nil {
@@ -128,6 +397,42 @@ func UserByScreenName(ctx context.Context, db *bun.DB, screen_name string) (*Use
 	return user, nil
 }
 
+// UserByEmail finds the user registered with an email address, ignoring case
+func UserByEmail(ctx context.Context, db *bun.DB, email string) (*User, error) {
+	user := new(User)
+	if err := db.NewSelect().Model(user).Where("lower(email) = lower(?)", email).Scan(ctx, user); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, errors.Wrap(err, "could not fetch user")
+	}
+	return user, nil
+}
+
+// RegisteredWithICQ returns true if the user signed up from an ICQ client, which makes their UIN their screen name
+func (user *User) RegisteredWithICQ() bool {
+	return IsUIN(user.ScreenName)
+}
+
+// IsUIN returns true if a login is an ICQ number rather than a screen name
+func IsUIN(login string) bool {
+	if login == "" || len(login) > 10 {
+		return false
+	}
+	_, err := strconv.ParseInt(login, 10, 64)
+	return err == nil
+}
+
+// UserByLogin finds the user signing on with a login, which is a UIN for ICQ clients and a screen name for
+// everyone else
+func UserByLogin(ctx context.Context, db *bun.DB, login string) (*User, error) {
+	if IsUIN(login) {
+		uin, _ := strconv.ParseInt(login, 10, 64)
+		return UserByUIN(ctx, db, uin)
+	}
+	return UserByScreenName(ctx, db, login)
+}
+
 func UserByUIN(ctx context.Context, db *bun.DB, uin int64) (*User, error) {
 	user := new(User)
 	if err := db.NewSelect().Model(user).Where("uin = ?", uin).Scan(ctx, user); err != nil {
@@ -151,6 +456,20 @@ func UserFromContext(ctx context.Context) *User {
 	return v.(*User)
 }
 
+// Reload refreshes columns that another session may have changed since the user was loaded
+func (u *User) Reload(ctx context.Context, db *bun.DB, cols ...string) error {
+	q := db.NewSelect().Model(u).WherePK("uin")
+
+	if len(cols) > 0 {
+		q = q.Column(cols...)
+	}
+
+	if err := q.Scan(ctx); err != nil {
+		return errors.Wrap(err, "could not reload user")
+	}
+	return nil
+}
+
 func (u *User) Update(ctx context.Context, db *bun.DB, cols ...string) error {
 	q := db.NewUpdate().Model(u).WherePK("uin")
 
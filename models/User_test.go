@@ -0,0 +1,95 @@
+package models
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestWarningLevelDecay(t *testing.T) {
+	warnedAt := time.Date(2023, 1, 1, 12, 0, 0, 0, time.UTC)
+	user := &User{WarningLevel: 130, WarnedAt: warnedAt}
+
+	tests := []struct {
+		after    time.Duration
+		expected uint16
+	}{
+		{0, 130},
+		{9 * time.Minute, 130},
+		{10 * time.Minute, 80},
+		{25 * time.Minute, 30},
+		{30 * time.Minute, 0},
+		{24 * time.Hour, 0},
+	}
+
+	for _, test := range tests {
+		level := user.WarningLevelAt(warnedAt.Add(test.after))
+		if level != test.expected {
+			t.Errorf("expected warning level %d after %s, got %d", test.expected, test.after, level)
+		}
+	}
+}
+
+func TestWarningLevelNeverWarned(t *testing.T) {
+	user := &User{}
+	if level := user.CurrentWarningLevel(); level != 0 {
+		t.Errorf("expected a user who was never warned to have warning level 0, got %d", level)
+	}
+}
+
+func TestUserStatusFlags(t *testing.T) {
+	statuses := []UserStatus{UserStatusOnline, UserStatusAway, UserStatusDnd, UserStatusNA, UserStatusOccupied, UserStatusFree4Chat, UserStatusInvisible}
+	for _, status := range statuses {
+		if got := UserStatusFromFlags(status.Flags()); got != status {
+			t.Errorf("expected %s to round trip through its flags, got %s", status, got)
+		}
+		if !status.Connected() {
+			t.Errorf("expected %s to be connected", status)
+		}
+	}
+
+	if UserStatus(UserStatusOffline).Connected() {
+		t.Errorf("expected offline to not be connected")
+	}
+}
+
+func TestUserStatusAway(t *testing.T) {
+	away := map[UserStatus]bool{
+		UserStatusOffline:   false,
+		UserStatusOnline:    false,
+		UserStatusAway:      true,
+		UserStatusDnd:       true,
+		UserStatusNA:        true,
+		UserStatusOccupied:  true,
+		UserStatusFree4Chat: false,
+		UserStatusInvisible: false,
+	}
+	for status, expected := range away {
+		if status.Away() != expected {
+			t.Errorf("expected %s to be away: %v", status, expected)
+		}
+	}
+}
+
+func TestWithPresence(t *testing.T) {
+	bos := &User{UIN: 1, ScreenName: "toof", Status: UserStatusAway, AwayMessage: "brb"}
+	bart := *bos
+
+	// The icon is set on the BART connection's copy and saved, then BOS broadcasts with the saved columns
+	bart.IconHash = []byte{1, 2, 3}
+	bart.WarningLevel = 100
+	updated := bos.withPresence(&bart)
+
+	if !bytes.Equal(updated.IconHash, bart.IconHash) {
+		t.Errorf("expected the stored icon hash, got %x", updated.IconHash)
+	}
+	if updated.WarningLevel != 100 {
+		t.Errorf("expected the stored warning level, got %d", updated.WarningLevel)
+	}
+	if updated.Status != UserStatusAway || updated.AwayMessage != "brb" {
+		t.Error("expected the rest of the broadcasting connection's copy to be kept")
+	}
+	if len(bos.IconHash) != 0 {
+		t.Error("expected the broadcasting connection's copy to be left alone")
+	}
+}
@@ -3,10 +3,10 @@ package main
 import (
 	"aim-oscar/models"
 	"aim-oscar/oscar"
+	"aim-oscar/services"
 	"aim-oscar/util"
 	"context"
 	"fmt"
-	"time"
 
 	"github.com/uptrace/bun"
 	"golang.org/x/exp/slog"
@@ -29,110 +29,115 @@ func OnlineNotification(sm *SessionManager, parentLogger *slog.Logger) (chan *mo
 			userLogger := logger.With(slog.String("screen_name", user.ScreenName), slog.String("status", user.Status.String()))
 			userLogger.Info("Status change")
 
-			// Find buddies who are friends with the user
 			ctx := context.Background()
-			var buddies []*models.Buddy
-			err := db.NewSelect().Model(&buddies).Where("with_uin = ?", user.UIN).Relation("Source").Scan(ctx, &buddies)
+
+			// The user may have been warned or changed their icon since this connection loaded them
+			user, err := user.WithStoredPresence(ctx, db)
+			if err != nil {
+				userLogger.Error("Could not fetch user's presence", slog.String("err", err.Error()))
+				continue
+			}
+
+			// Find buddies who are friends with the user
+			var watchers []*models.Buddy
+			err = db.NewSelect().Model(&watchers).Where("with_uin = ?", user.UIN).Relation("Source").Scan(ctx, &watchers)
 			if err != nil {
 				userLogger.Error("Could not find user's buddies", slog.String("err", err.Error()))
 				continue
 			}
 
 			// Inform each buddy that the user is now online
-			for _, buddy := range buddies {
-				if buddy.Source.Status == models.UserStatusAway || buddy.Source.Status == models.UserStatusDnd {
+			for _, watcher := range watchers {
+				if !watcher.Source.Status.Connected() {
 					continue
 				}
-				userLogger.Debug(fmt.Sprintf("notifying %s", buddy.Source.ScreenName))
-
-				if buddySession := sm.GetSession(buddy.Source.ScreenName); buddySession != nil {
-					// If the user is now online...
-					if user.Status == models.UserStatusOnline {
-						onlineSnac := oscar.NewSNAC(0x3, 0xb)
-						onlineSnac.Data.WriteLPString(user.ScreenName)
-						onlineSnac.Data.WriteUint16(0) // TODO: user warning level
-
-						tlvs := []*oscar.TLV{
-							oscar.NewTLV(0x01, util.Word(0x0004)), // TODO: user class
-							oscar.NewTLV(0x06, util.Dword(uint32(user.Status))),
-							oscar.NewTLV(0x0f, util.Dword(uint32(time.Since(user.LastActivityAt).Seconds()))), // Idle Time
-							oscar.NewTLV(0x03, util.Dword(uint32(time.Now().Unix()))),                         // Client Signon Time
-							oscar.NewTLV(0x05, util.Dword(uint32(user.CreatedAt.Unix()))),                     // Member since
-						}
-						onlineSnac.AppendTLVs(tlvs)
-
-						onlineFlap := oscar.NewFLAP(2)
-						onlineFlap.Data.WriteBinary(onlineSnac)
-						if err := buddySession.Send(onlineFlap); err != nil {
-							userLogger.Error(fmt.Sprintf("could not tell %s that %s is online", buddy.Source.ScreenName, user.ScreenName), slog.String("err", err.Error()))
-						}
-
-						// If the user is now away
-					} else if user.Status == models.UserStatusAway {
-						offlineSnac := oscar.NewSNAC(0x3, 0xc)
-						offlineSnac.Data.WriteLPString(user.ScreenName)
-						offlineSnac.Data.WriteUint16(0) // TODO: user warning level
-						tlvs := []*oscar.TLV{
-							oscar.NewTLV(1, util.Dword(0x0020)),
-						}
-						offlineSnac.AppendTLVs(tlvs)
-
-						offlineFlap := oscar.NewFLAP(2)
-						offlineFlap.Data.WriteBinary(offlineSnac)
-						if err := buddySession.Send(offlineFlap); err != nil {
-							userLogger.Error(fmt.Sprintf("could not tell %s that %s is offline", buddy.Source.ScreenName, user.ScreenName), slog.String("err", err.Error()))
-						}
+
+				watcherSession := sm.GetSessionForFamily(watcher.Source.ScreenName, 0x03)
+				if watcherSession == nil {
+					continue
+				}
+
+				userLogger.Debug(fmt.Sprintf("notifying %s", watcher.Source.ScreenName))
+
+				// Users that are blocked by the user's permit/deny settings or who the user is invisible to always
+				// see them as offline
+				canSee, err := services.IsVisibleTo(ctx, db, user, watcher.Source)
+				if err != nil {
+					userLogger.Error(fmt.Sprintf("could not check if %s can see %s", watcher.Source.ScreenName, user.ScreenName), slog.String("err", err.Error()))
+					continue
+				}
+
+				if user.Status.Connected() && canSee {
+					if err := sendArrived(watcherSession, user, sm.GetSession(user.ScreenName)); err != nil {
+						userLogger.Error(fmt.Sprintf("could not tell %s that %s is online", watcher.Source.ScreenName, user.ScreenName), slog.String("err", err.Error()))
+					}
+				} else {
+					if err := sendDeparted(watcherSession, user); err != nil {
+						userLogger.Error(fmt.Sprintf("could not tell %s that %s is offline", watcher.Source.ScreenName, user.ScreenName), slog.String("err", err.Error()))
 					}
 				}
 			}
 
-			userSession := sm.GetSession(user.ScreenName)
+			userSession := sm.GetSessionForFamily(user.ScreenName, 0x03)
 			// If the user is disconnected, don't try to send them notifications
 			if userSession == nil {
 				continue
 			}
 
-			// Get the user's list of online buddies and tell the user that they are online
+			// Get the user's list of buddies and tell the user which of them are online
+			var buddies []*models.Buddy
+			err = db.NewSelect().Model(&buddies).Where("source_uin = ?", user.UIN).Relation("Target").Scan(ctx, &buddies)
+			if err != nil {
+				userLogger.Error("Could not find user's buddy list", slog.String("err", err.Error()))
+				continue
+			}
+
 			for _, buddy := range buddies {
-				// If the buddy is away, tell the user
-				if buddy.Source.Status == models.UserStatusAway {
-					offlineSnac := oscar.NewSNAC(0x3, 0xc)
-					offlineSnac.Data.WriteLPString(buddy.Source.ScreenName)
-					offlineSnac.Data.WriteUint16(0) // TODO: user warning level
-					tlvs := []*oscar.TLV{
-						oscar.NewTLV(1, util.Dword(0x0020)),
-					}
-					offlineSnac.AppendTLVs(tlvs)
+				canSee, err := services.IsVisibleTo(ctx, db, buddy.Target, user)
+				if err != nil {
+					userLogger.Error(fmt.Sprintf("could not check if %s can see %s", user.ScreenName, buddy.Target.ScreenName), slog.String("err", err.Error()))
+					continue
+				}
 
-					offlineFlap := oscar.NewFLAP(2)
-					offlineFlap.Data.WriteBinary(offlineSnac)
-					if err := userSession.Send(offlineFlap); err != nil {
-						userLogger.Error(fmt.Sprintf("could not tell %s that %s is offline", user.ScreenName, buddy.Source.ScreenName), slog.String("err", err.Error()))
-					}
-				} else if buddy.Source.Status == models.UserStatusOnline {
-					onlineSnac := oscar.NewSNAC(3, 0xb)
-					onlineSnac.Data.WriteLPString(buddy.Source.ScreenName)
-					onlineSnac.Data.WriteUint16(0) // TODO: user warning level
-
-					tlvs := []*oscar.TLV{
-						oscar.NewTLV(0x01, util.Word(0x0004)), // TODO: user class
-						oscar.NewTLV(0x06, util.Dword(uint32(buddy.Source.Status))),
-						oscar.NewTLV(0x0f, util.Dword(uint32(time.Since(buddy.Source.LastActivityAt).Seconds()))), // Idle Time
-						oscar.NewTLV(0x03, util.Dword(uint32(time.Now().Unix()))),                                 // Client Signon Time
-						oscar.NewTLV(0x05, util.Dword(uint32(buddy.Source.CreatedAt.Unix()))),                     // Member since
+				// If the buddy is offline or hiding from the user, tell the user they're offline
+				if !buddy.Target.Status.Connected() || !canSee {
+					if err := sendDeparted(userSession, buddy.Target); err != nil {
+						userLogger.Error(fmt.Sprintf("could not tell %s that %s is offline", user.ScreenName, buddy.Target.ScreenName), slog.String("err", err.Error()))
 					}
-					onlineSnac.AppendTLVs(tlvs)
-
-					onlineFlap := oscar.NewFLAP(2)
-					onlineFlap.Data.WriteBinary(onlineSnac)
-					if err := userSession.Send(onlineFlap); err != nil {
-						userLogger.Error(fmt.Sprintf("could not tell %s that %s is online", user.ScreenName, buddy.Source.ScreenName), slog.String("err", err.Error()))
+				} else {
+					if err := sendArrived(userSession, buddy.Target, sm.GetSession(buddy.Target.ScreenName)); err != nil {
+						userLogger.Error(fmt.Sprintf("could not tell %s that %s is online", user.ScreenName, buddy.Target.ScreenName), slog.String("err", err.Error()))
 					}
 				}
-
 			}
 		}
 	}
 
 	return commCh, routine
 }
+
+// sendArrived tells a session that a buddy is online. The buddy's own session has the parts of their info that
+// only exist while they're signed on.
+func sendArrived(session *oscar.Session, buddy *models.User, buddySession *oscar.Session) error {
+	onlineSnac := oscar.NewSNAC(0x3, 0xb)
+	services.WriteUserInfo(&onlineSnac.Data, buddy, buddySession)
+
+	onlineFlap := oscar.NewFLAP(2)
+	onlineFlap.Data.WriteBinary(onlineSnac)
+	return session.Send(onlineFlap)
+}
+
+// sendDeparted tells a session that a buddy went offline
+func sendDeparted(session *oscar.Session, buddy *models.User) error {
+	offlineSnac := oscar.NewSNAC(0x3, 0xc)
+	offlineSnac.Data.WriteLPString(buddy.ScreenName)
+	offlineSnac.Data.WriteUint16(buddy.CurrentWarningLevel())
+	tlvs := []*oscar.TLV{
+		oscar.NewTLV(1, util.Dword(0x0020)),
+	}
+	offlineSnac.AppendTLVs(tlvs)
+
+	offlineFlap := oscar.NewFLAP(2)
+	offlineFlap.Data.WriteBinary(offlineSnac)
+	return session.Send(offlineFlap)
+}
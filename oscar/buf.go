@@ -83,6 +83,35 @@ func (b *Buffer) ReadLPString() (string, error) {
 	return str, nil
 }
 
+// ReadLPUint16String reads a string prefixed with a 2 byte length. Returns io.EOF if there are
+// less bytes than indicated.
+func (b *Buffer) ReadLPUint16String() (string, error) {
+	length, err := b.ReadUint16()
+	if err != nil {
+		return "", err
+	}
+
+	if len(b.d) < int(length) {
+		return "", io.EOF
+	}
+
+	str := string(b.d[:length])
+	b.d = b.d[length:]
+	return str, nil
+}
+
+// ReadBytes reads the next n bytes and moves the read cursor past them
+func (b *Buffer) ReadBytes(n int) ([]byte, error) {
+	if len(b.d) < n {
+		return nil, io.EOF
+	}
+
+	ret := make([]byte, n)
+	copy(ret, b.d[:n])
+	b.d = b.d[n:]
+	return ret, nil
+}
+
 func (b *Buffer) WriteUint8(x uint8) {
 	b.d = append(b.d, x)
 }
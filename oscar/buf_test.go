@@ -53,3 +53,39 @@ func TestBufferLPString(t *testing.T) {
 		t.Errorf("expected to read %s, got %s", expectedStr, str)
 	}
 }
+
+func TestBufferLPUint16String(t *testing.T) {
+	b := Buffer{}
+
+	expectedStr := "Buddies"
+	b.WriteUint16(uint16(len(expectedStr)))
+	b.WriteString(expectedStr)
+	b.WriteUint8(7)
+
+	str, err := b.ReadLPUint16String()
+	fail(t, err, "ReadLPUint16String")
+	if str != expectedStr {
+		t.Errorf("expected to read %s, got %s", expectedStr, str)
+	}
+
+	x, err := b.ReadUint8()
+	fail(t, err, "ReadUint8")
+	if x != 7 {
+		t.Errorf("expected ReadUint8 to read 7 after the string, got %d", x)
+	}
+}
+
+func TestBufferReadBytes(t *testing.T) {
+	b := Buffer{}
+	b.Write([]byte{1, 2, 3, 4})
+
+	d, err := b.ReadBytes(3)
+	fail(t, err, "ReadBytes")
+	if len(d) != 3 || d[0] != 1 || d[2] != 3 {
+		t.Errorf("expected to read [1 2 3], got %v", d)
+	}
+
+	if _, err := b.ReadBytes(2); err == nil {
+		t.Errorf("expected ReadBytes past the end of the buffer to fail")
+	}
+}
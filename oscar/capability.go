@@ -0,0 +1,74 @@
+package oscar
+
+import (
+	"encoding/hex"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Capability is a UUID clients send to say which features they support
+type Capability [16]byte
+
+func mustCapability(uuid string) Capability {
+	b, err := hex.DecodeString(strings.ReplaceAll(uuid, "-", ""))
+	if err != nil || len(b) != 16 {
+		panic("invalid capability " + uuid)
+	}
+	var c Capability
+	copy(c[:], b)
+	return c
+}
+
+var (
+	CapabilityVoice        = mustCapability("09461341-4C7F-11D1-8222-444553540000")
+	CapabilityFileTransfer = mustCapability("09461343-4C7F-11D1-8222-444553540000")
+	CapabilityDirectIM     = mustCapability("09461345-4C7F-11D1-8222-444553540000")
+	CapabilityBuddyIcon    = mustCapability("09461346-4C7F-11D1-8222-444553540000")
+	CapabilityGetFile      = mustCapability("09461348-4C7F-11D1-8222-444553540000")
+	CapabilityUTF8         = mustCapability("0946134E-4C7F-11D1-8222-444553540000")
+	CapabilityChat         = mustCapability("748F2420-6287-11D1-8222-444553540000")
+	CapabilityTyping       = mustCapability("563FC809-0B6F-41BD-9F79-422609DFA2F3")
+)
+
+var capabilityNames = map[Capability]string{
+	CapabilityVoice:        "voice",
+	CapabilityFileTransfer: "file transfer",
+	CapabilityDirectIM:     "direct IM",
+	CapabilityBuddyIcon:    "buddy icon",
+	CapabilityGetFile:      "get file",
+	CapabilityUTF8:         "UTF-8 messages",
+	CapabilityChat:         "chat",
+	CapabilityTyping:       "typing",
+}
+
+func (c Capability) String() string {
+	if name, ok := capabilityNames[c]; ok {
+		return name
+	}
+	return hex.EncodeToString(c[:])
+}
+
+// ParseCapabilities reads a list of capabilities packed one after another, like in TLV 0x05 of 0x02/0x04
+func ParseCapabilities(data []byte) ([]Capability, error) {
+	if len(data)%16 != 0 {
+		return nil, errors.Errorf("capability list should be a multiple of 16 bytes, got %d", len(data))
+	}
+
+	capabilities := make([]Capability, 0, len(data)/16)
+	for i := 0; i < len(data); i += 16 {
+		var c Capability
+		copy(c[:], data[i:i+16])
+		capabilities = append(capabilities, c)
+	}
+	return capabilities, nil
+}
+
+// MarshalCapabilities packs capabilities one after another
+func MarshalCapabilities(capabilities []Capability) []byte {
+	data := make([]byte, 0, len(capabilities)*16)
+	for _, c := range capabilities {
+		data = append(data, c[:]...)
+	}
+	return data
+}
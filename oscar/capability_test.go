@@ -0,0 +1,33 @@
+package oscar
+
+import (
+	"testing"
+)
+
+func TestParseCapabilities(t *testing.T) {
+	data := MarshalCapabilities([]Capability{CapabilityBuddyIcon, CapabilityChat})
+
+	capabilities, err := ParseCapabilities(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(capabilities) != 2 || capabilities[0] != CapabilityBuddyIcon || capabilities[1] != CapabilityChat {
+		t.Errorf("expected buddy icon and chat capabilities, got %v", capabilities)
+	}
+
+	if _, err := ParseCapabilities(data[:20]); err == nil {
+		t.Errorf("expected a partial capability to be an error")
+	}
+}
+
+func TestSessionHasCapability(t *testing.T) {
+	session := NewSession(nil, nil)
+	session.SetCapabilities([]Capability{CapabilityFileTransfer})
+
+	if !session.HasCapability(CapabilityFileTransfer) {
+		t.Errorf("expected session to have the file transfer capability")
+	}
+	if session.HasCapability(CapabilityDirectIM) {
+		t.Errorf("expected session to not have the direct IM capability")
+	}
+}
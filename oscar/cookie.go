@@ -0,0 +1,118 @@
+package oscar
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/json"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Every kind of cookie starts with its own byte so that one kind can't be passed off as another
+const (
+	cookieKindService byte = 1
+	cookieKindLogin   byte = 2
+)
+
+// ServiceCookie lets a signed on user open another connection for a single service, like a chat room.
+// Clients get it in a service redirect (0x01/0x05) and send it back when they sign on to the new connection.
+// Nonce is random so the server can remember which cookies were used.
+type ServiceCookie struct {
+	ScreenName string
+	Family     uint16
+	Nonce      string
+	ExpiresAt  int64
+
+	// Chat connections are for a single room
+	ChatExchange uint16 `json:",omitempty"`
+	ChatRoom     string `json:",omitempty"`
+}
+
+// LoginCookie lets a user who logged in to the authorizer sign on to BOS. Nonce is the cipher the user was given
+// when they logged in, which BOS clears on sign on so the cookie can't be used twice.
+type LoginCookie struct {
+	UIN       int64
+	Nonce     string
+	ExpiresAt int64
+
+	// IP is the address the user logged in from, when cookies are bound to it
+	IP string `json:",omitempty"`
+}
+
+// SignServiceCookie serializes the cookie and appends an HMAC-SHA256 of it so it can't be forged
+func SignServiceCookie(key []byte, cookie *ServiceCookie) ([]byte, error) {
+	return signCookie(key, cookieKindService, cookie)
+}
+
+// VerifyServiceCookie checks the signature and expiry of a cookie made by SignServiceCookie. Checking that the
+// cookie hasn't been used yet is up to the caller.
+func VerifyServiceCookie(key []byte, data []byte, now time.Time) (*ServiceCookie, error) {
+	cookie := &ServiceCookie{}
+	if err := verifyCookie(key, cookieKindService, data, cookie); err != nil {
+		return nil, errors.Wrap(err, "invalid service cookie")
+	}
+
+	if now.Unix() > cookie.ExpiresAt {
+		return nil, errors.New("service cookie expired")
+	}
+
+	return cookie, nil
+}
+
+// SignLoginCookie serializes the cookie and appends an HMAC-SHA256 of it so it can't be forged
+func SignLoginCookie(key []byte, cookie *LoginCookie) ([]byte, error) {
+	return signCookie(key, cookieKindLogin, cookie)
+}
+
+// VerifyLoginCookie checks the signature and expiry of a cookie made by SignLoginCookie. Checking that the cookie
+// hasn't been used yet is up to the caller.
+func VerifyLoginCookie(key []byte, data []byte, now time.Time) (*LoginCookie, error) {
+	cookie := &LoginCookie{}
+	if err := verifyCookie(key, cookieKindLogin, data, cookie); err != nil {
+		return nil, errors.Wrap(err, "invalid login cookie")
+	}
+
+	if now.Unix() > cookie.ExpiresAt {
+		return nil, errors.New("login cookie expired")
+	}
+
+	return cookie, nil
+}
+
+func signCookie(key []byte, kind byte, cookie interface{}) ([]byte, error) {
+	payload, err := json.Marshal(cookie)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not marshal cookie")
+	}
+	payload = append([]byte{kind}, payload...)
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	return mac.Sum(payload), nil
+}
+
+func verifyCookie(key []byte, kind byte, data []byte, cookie interface{}) error {
+	if len(data) <= sha256.Size+1 {
+		return errors.New("cookie too short")
+	}
+
+	payload := data[:len(data)-sha256.Size]
+	signature := data[len(data)-sha256.Size:]
+
+	mac := hmac.New(sha256.New, key)
+	mac.Write(payload)
+	if !hmac.Equal(signature, mac.Sum(nil)) {
+		return errors.New("bad signature")
+	}
+
+	if payload[0] != kind {
+		return errors.New("wrong kind of cookie")
+	}
+
+	if err := json.Unmarshal(payload[1:], cookie); err != nil {
+		return errors.Wrap(err, "could not unmarshal cookie")
+	}
+
+	return nil
+}
@@ -0,0 +1,79 @@
+package oscar
+
+import (
+	"testing"
+	"time"
+)
+
+func TestServiceCookie(t *testing.T) {
+	key := []byte("secret")
+	now := time.Now()
+
+	data, err := SignServiceCookie(key, &ServiceCookie{
+		ScreenName:   "toof",
+		Family:       0x0e,
+		ExpiresAt:    now.Add(time.Minute).Unix(),
+		ChatExchange: 4,
+		ChatRoom:     "Lobby",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookie, err := VerifyServiceCookie(key, data, now)
+	if err != nil {
+		t.Fatalf("expected cookie to verify: %s", err)
+	}
+	if cookie.ScreenName != "toof" || cookie.Family != 0x0e || cookie.ChatExchange != 4 || cookie.ChatRoom != "Lobby" {
+		t.Fatalf("unexpected cookie contents: %+v", cookie)
+	}
+
+	if _, err := VerifyServiceCookie([]byte("other secret"), data, now); err == nil {
+		t.Fatal("expected cookie signed with another key to be rejected")
+	}
+
+	if _, err := VerifyServiceCookie(key, data, now.Add(2*time.Minute)); err == nil {
+		t.Fatal("expected expired cookie to be rejected")
+	}
+
+	tampered := append([]byte{}, data...)
+	tampered[2] ^= 0xff
+	if _, err := VerifyServiceCookie(key, tampered, now); err == nil {
+		t.Fatal("expected tampered cookie to be rejected")
+	}
+}
+
+func TestLoginCookie(t *testing.T) {
+	key := []byte("secret")
+	now := time.Now()
+
+	data, err := SignLoginCookie(key, &LoginCookie{UIN: 1, Nonce: "ABCD", ExpiresAt: now.Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cookie, err := VerifyLoginCookie(key, data, now)
+	if err != nil {
+		t.Fatalf("expected cookie to verify: %s", err)
+	}
+	if cookie.UIN != 1 || cookie.Nonce != "ABCD" {
+		t.Fatalf("unexpected cookie contents: %+v", cookie)
+	}
+
+	if _, err := VerifyLoginCookie(key, data, now.Add(2*time.Minute)); err == nil {
+		t.Fatal("expected expired cookie to be rejected")
+	}
+
+	// Login and service cookies are signed with the same key but can't stand in for each other
+	if _, err := VerifyServiceCookie(key, data, now); err == nil {
+		t.Fatal("expected login cookie to be rejected as a service cookie")
+	}
+
+	serviceData, err := SignServiceCookie(key, &ServiceCookie{ScreenName: "toof", ExpiresAt: now.Add(time.Minute).Unix()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := VerifyLoginCookie(key, serviceData, now); err == nil {
+		t.Fatal("expected service cookie to be rejected as a login cookie")
+	}
+}
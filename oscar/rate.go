@@ -0,0 +1,159 @@
+package oscar
+
+import (
+	"sync"
+	"time"
+)
+
+// RateSNAC identifies a SNAC family/subtype pair that belongs to a rate class
+type RateSNAC struct {
+	Family  uint16
+	Subtype uint16
+}
+
+// RateClass is a group of SNACs that share a rate limit. Levels are a moving average of the milliseconds
+// between SNACs in the class, so sending faster makes the level go down.
+type RateClass struct {
+	ID              uint16
+	WindowSize      uint32
+	ClearLevel      uint32
+	AlertLevel      uint32
+	LimitLevel      uint32
+	DisconnectLevel uint32
+	MaxLevel        uint32
+	SNACs           []RateSNAC
+}
+
+// RateStatus is the code sent to clients in 0x01/0x0A when a rate class changes state
+type RateStatus uint16
+
+const (
+	RateStatusChanged RateStatus = 1
+	RateStatusAlert   RateStatus = 2
+	RateStatusLimited RateStatus = 3
+	RateStatusClear   RateStatus = 4
+
+	// Disconnect is never sent to clients, they just get disconnected
+	RateStatusDisconnect RateStatus = 5
+)
+
+type rateState struct {
+	level  uint32
+	last   time.Time
+	status RateStatus
+}
+
+// RateLimiter tracks the rate levels of a single connection for every rate class
+type RateLimiter struct {
+	classes []*RateClass
+	bySNAC  map[RateSNAC]*RateClass
+	states  map[uint16]*rateState
+	mutex   *sync.Mutex
+}
+
+func NewRateLimiter(classes []*RateClass) *RateLimiter {
+	r := &RateLimiter{
+		classes: classes,
+		bySNAC:  make(map[RateSNAC]*RateClass),
+		states:  make(map[uint16]*rateState),
+		mutex:   &sync.Mutex{},
+	}
+
+	for _, class := range classes {
+		for _, snac := range class.SNACs {
+			r.bySNAC[snac] = class
+		}
+		r.states[class.ID] = &rateState{level: class.MaxLevel, status: RateStatusClear}
+	}
+
+	return r
+}
+
+// Classes returns the rate classes in the order they were configured
+func (r *RateLimiter) Classes() []*RateClass {
+	return r.classes
+}
+
+// ClassFor returns the rate class of a SNAC. SNACs that aren't assigned to a class belong to the first class.
+func (r *RateLimiter) ClassFor(family, subtype uint16) *RateClass {
+	if class, ok := r.bySNAC[RateSNAC{family, subtype}]; ok {
+		return class
+	}
+	if len(r.classes) > 0 {
+		return r.classes[0]
+	}
+	return nil
+}
+
+// Check records a SNAC arriving at a point in time and returns the status of its rate class afterwards, and
+// if the status changed because of this SNAC.
+func (r *RateLimiter) Check(family, subtype uint16, now time.Time) (*RateClass, RateStatus, bool) {
+	class := r.ClassFor(family, subtype)
+	if class == nil {
+		return nil, RateStatusClear, false
+	}
+
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	state := r.states[class.ID]
+
+	if state.last.IsZero() {
+		state.last = now
+		return class, state.status, false
+	}
+
+	delta := uint64(now.Sub(state.last).Milliseconds())
+	level := (uint64(state.level)*uint64(class.WindowSize-1) + delta) / uint64(class.WindowSize)
+	if level > uint64(class.MaxLevel) {
+		level = uint64(class.MaxLevel)
+	}
+	state.level = uint32(level)
+	state.last = now
+
+	previous := state.status
+	switch {
+	case state.level < class.DisconnectLevel:
+		state.status = RateStatusDisconnect
+	case state.level < class.LimitLevel:
+		state.status = RateStatusLimited
+	case state.level < class.AlertLevel:
+		// A limited class stays limited until the level climbs back above the clear level
+		if state.status != RateStatusLimited {
+			state.status = RateStatusAlert
+		}
+	case state.level >= class.ClearLevel:
+		state.status = RateStatusClear
+	}
+
+	return class, state.status, state.status != previous
+}
+
+// WriteClass writes the parameters of a rate class along with the connection's current level, the
+// format used by both 0x01/0x07 and 0x01/0x0A
+func (r *RateLimiter) WriteClass(buf *Buffer, class *RateClass) {
+	r.mutex.Lock()
+	state := r.states[class.ID]
+	level := state.level
+	status := state.status
+	var last uint32
+	if !state.last.IsZero() {
+		last = uint32(time.Since(state.last).Milliseconds())
+	}
+	r.mutex.Unlock()
+
+	buf.WriteUint16(class.ID)
+	buf.WriteUint32(class.WindowSize)
+	buf.WriteUint32(class.ClearLevel)
+	buf.WriteUint32(class.AlertLevel)
+	buf.WriteUint32(class.LimitLevel)
+	buf.WriteUint32(class.DisconnectLevel)
+	buf.WriteUint32(level)
+	buf.WriteUint32(class.MaxLevel)
+	buf.WriteUint32(last) // Time since the last SNAC in this class
+	if status == RateStatusLimited {
+		buf.WriteUint8(1)
+	} else {
+		buf.WriteUint8(0)
+	}
+}
@@ -0,0 +1,91 @@
+package oscar
+
+import (
+	"testing"
+	"time"
+)
+
+func testRateClass() *RateClass {
+	return &RateClass{
+		ID:              1,
+		WindowSize:      10,
+		ClearLevel:      2500,
+		AlertLevel:      2000,
+		LimitLevel:      1500,
+		DisconnectLevel: 800,
+		MaxLevel:        6000,
+	}
+}
+
+func TestRateLimiterSlowClient(t *testing.T) {
+	r := NewRateLimiter([]*RateClass{testRateClass()})
+	now := time.Now()
+
+	for i := 0; i < 20; i++ {
+		now = now.Add(5 * time.Second)
+		_, status, changed := r.Check(0x04, 0x06, now)
+		if status != RateStatusClear || changed {
+			t.Fatalf("expected a slow client to stay clear, got status %d (changed: %t)", status, changed)
+		}
+	}
+}
+
+func TestRateLimiterFloodingClient(t *testing.T) {
+	r := NewRateLimiter([]*RateClass{testRateClass()})
+	now := time.Now()
+
+	seen := map[RateStatus]bool{}
+	for i := 0; i < 100; i++ {
+		now = now.Add(10 * time.Millisecond)
+		_, status, changed := r.Check(0x04, 0x06, now)
+		if changed {
+			seen[status] = true
+		}
+		if status == RateStatusDisconnect {
+			break
+		}
+	}
+
+	for _, status := range []RateStatus{RateStatusAlert, RateStatusLimited, RateStatusDisconnect} {
+		if !seen[status] {
+			t.Errorf("expected a flooding client to pass through status %d", status)
+		}
+	}
+}
+
+func TestRateLimiterClearsAfterLimit(t *testing.T) {
+	r := NewRateLimiter([]*RateClass{testRateClass()})
+	now := time.Now()
+
+	status := RateStatusClear
+	for status != RateStatusLimited {
+		now = now.Add(100 * time.Millisecond)
+		_, status, _ = r.Check(0x01, 0x02, now)
+	}
+
+	// Backing off should eventually clear the limit
+	cleared := false
+	for i := 0; i < 50 && !cleared; i++ {
+		now = now.Add(10 * time.Second)
+		_, status, _ = r.Check(0x01, 0x02, now)
+		cleared = status == RateStatusClear
+	}
+	if !cleared {
+		t.Errorf("expected the rate class to clear after the client slowed down")
+	}
+}
+
+func TestRateLimiterClassFor(t *testing.T) {
+	defaultClass := testRateClass()
+	icbmClass := testRateClass()
+	icbmClass.ID = 2
+	icbmClass.SNACs = []RateSNAC{{0x04, 0x06}}
+
+	r := NewRateLimiter([]*RateClass{defaultClass, icbmClass})
+	if class := r.ClassFor(0x04, 0x06); class.ID != 2 {
+		t.Errorf("expected 0x04/0x06 to be in class 2, got %d", class.ID)
+	}
+	if class := r.ClassFor(0x02, 0x05); class.ID != 1 {
+		t.Errorf("expected unassigned SNACs to be in the first class, got %d", class.ID)
+	}
+}
@@ -3,6 +3,8 @@ package oscar
 import (
 	"context"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"golang.org/x/exp/slog"
@@ -24,6 +26,21 @@ type Session struct {
 	GreetedClient  bool
 	ScreenName     string
 	Logger         *slog.Logger
+	RateLimiter    *RateLimiter
+
+	// Family is the service this connection was redirected to, or 0 for the main BOS connection
+	Family uint16
+
+	// SignonAt is when the user signed on with this connection
+	SignonAt time.Time
+
+	// When the user went idle according to their client, zero while they're active
+	idleSince time.Time
+	idleMutex sync.Mutex
+
+	// Capabilities the client said it supports
+	capabilities []Capability
+	capMutex     sync.RWMutex
 }
 
 func NewSession(conn net.Conn, logger *slog.Logger) *Session {
@@ -49,6 +66,67 @@ func SessionFromContext(ctx context.Context) (session *Session, err error) {
 	return s.(*Session), nil
 }
 
+// Serves returns true if SNACs for a family can go over this connection. Redirected connections only serve
+// their own family and generic service controls.
+func (s *Session) Serves(family uint16) bool {
+	if s.Family == 0 || family == 0x01 {
+		return true
+	}
+	return s.Family == family
+}
+
+// SetIdle records how long the client says the user has been idle, 0 means they're active again. Returns
+// true if the user went idle or came back.
+func (s *Session) SetIdle(idle time.Duration, now time.Time) bool {
+	s.idleMutex.Lock()
+	defer s.idleMutex.Unlock()
+
+	wasIdle := !s.idleSince.IsZero()
+	if idle == 0 {
+		s.idleSince = time.Time{}
+	} else {
+		s.idleSince = now.Add(-idle)
+	}
+	return wasIdle != !s.idleSince.IsZero()
+}
+
+// IdleTime returns how long the user has been idle, or 0 if they're active
+func (s *Session) IdleTime(now time.Time) time.Duration {
+	s.idleMutex.Lock()
+	defer s.idleMutex.Unlock()
+
+	if s.idleSince.IsZero() {
+		return 0
+	}
+	return now.Sub(s.idleSince)
+}
+
+// SetCapabilities records the capabilities the client supports
+func (s *Session) SetCapabilities(capabilities []Capability) {
+	s.capMutex.Lock()
+	s.capabilities = capabilities
+	s.capMutex.Unlock()
+}
+
+// Capabilities returns the capabilities the client supports
+func (s *Session) Capabilities() []Capability {
+	s.capMutex.RLock()
+	defer s.capMutex.RUnlock()
+	return s.capabilities
+}
+
+// HasCapability returns true if the client said it supports a capability
+func (s *Session) HasCapability(c Capability) bool {
+	s.capMutex.RLock()
+	defer s.capMutex.RUnlock()
+	for _, capability := range s.capabilities {
+		if capability == c {
+			return true
+		}
+	}
+	return false
+}
+
 func (s *Session) RemoteAddr() net.Addr {
 	return s.conn.RemoteAddr()
 }
@@ -0,0 +1,33 @@
+package oscar
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSessionIdle(t *testing.T) {
+	session := NewSession(nil, nil)
+	now := time.Now()
+
+	if idle := session.IdleTime(now); idle != 0 {
+		t.Fatalf("expected a new session to be active, got idle for %s", idle)
+	}
+
+	if changed := session.SetIdle(10*time.Minute, now); !changed {
+		t.Errorf("expected going idle to be a change")
+	}
+	if idle := session.IdleTime(now.Add(time.Minute)); idle != 11*time.Minute {
+		t.Errorf("expected idle time to keep counting up, got %s", idle)
+	}
+
+	if changed := session.SetIdle(12*time.Minute, now.Add(2*time.Minute)); changed {
+		t.Errorf("expected staying idle to not be a change")
+	}
+
+	if changed := session.SetIdle(0, now.Add(3*time.Minute)); !changed {
+		t.Errorf("expected coming back to be a change")
+	}
+	if idle := session.IdleTime(now.Add(3 * time.Minute)); idle != 0 {
+		t.Errorf("expected session to be active again, got idle for %s", idle)
+	}
+}
@@ -0,0 +1,118 @@
+package proxy
+
+import (
+	"aim-oscar/oscar"
+	"aim-oscar/util"
+	"encoding"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+var _ encoding.BinaryUnmarshaler = &Packet{}
+var _ encoding.BinaryMarshaler = &Packet{}
+
+// Every proxy packet starts with this version
+const PacketVersion = 0x044a
+
+// Proxy commands
+const (
+	CommandError    = 0x0001
+	CommandInitSend = 0x0002
+	CommandAck      = 0x0003
+	CommandInitRecv = 0x0004
+	CommandReady    = 0x0005
+)
+
+// Proxy error codes
+const (
+	ErrorBadRequest   = 0x000d
+	ErrorNotConnected = 0x001a
+	ErrorTimedOut     = 0x001b
+)
+
+type PacketHeader struct {
+	Length  uint16 // Length of everything after this field
+	Version uint16
+	Command uint16
+	Unknown uint32
+	Flags   uint16
+}
+
+// Packet is a single message between a client and the rendezvous proxy, which comes before the proxy starts
+// passing data between the two clients
+type Packet struct {
+	Header PacketHeader
+	Data   oscar.Buffer
+}
+
+func NewPacket(command uint16) *Packet {
+	return &Packet{
+		Header: PacketHeader{
+			Version: PacketVersion,
+			Command: command,
+		},
+	}
+}
+
+func (p *Packet) MarshalBinary() ([]byte, error) {
+	p.Header.Length = uint16(10 + len(p.Data.Bytes()))
+
+	buf := oscar.Buffer{}
+	binary.Write(&buf, binary.BigEndian, p.Header)
+	buf.Write(p.Data.Bytes())
+	return buf.Bytes(), nil
+}
+
+func (p *Packet) UnmarshalBinary(data []byte) error {
+	if len(data) < 12 {
+		return fmt.Errorf("proxy packet needs at least 12 bytes but has %d", len(data))
+	}
+
+	p.Header.Length = binary.BigEndian.Uint16(data[0:2])
+	p.Header.Version = binary.BigEndian.Uint16(data[2:4])
+	p.Header.Command = binary.BigEndian.Uint16(data[4:6])
+	p.Header.Unknown = binary.BigEndian.Uint32(data[6:10])
+	p.Header.Flags = binary.BigEndian.Uint16(data[10:12])
+
+	if p.Header.Version != PacketVersion {
+		return fmt.Errorf("unexpected proxy packet version 0x%04x", p.Header.Version)
+	}
+
+	p.Data.Write(data[12:])
+	return nil
+}
+
+func (p *Packet) String() string {
+	return fmt.Sprintf("ProxyPacket(CMD:0x%04x):\n%s", p.Header.Command, util.PrettyBytes(p.Data.Bytes()))
+}
+
+// ReadPacket reads the next whole packet from a connection
+func ReadPacket(r io.Reader) (*Packet, error) {
+	lengthBytes := make([]byte, 2)
+	if _, err := io.ReadFull(r, lengthBytes); err != nil {
+		return nil, err
+	}
+
+	length := binary.BigEndian.Uint16(lengthBytes)
+	rest := make([]byte, length)
+	if _, err := io.ReadFull(r, rest); err != nil {
+		return nil, err
+	}
+
+	p := &Packet{}
+	if err := p.UnmarshalBinary(append(lengthBytes, rest...)); err != nil {
+		return nil, err
+	}
+	return p, nil
+}
+
+// WritePacket writes a packet to a connection
+func WritePacket(w io.Writer, p *Packet) error {
+	data, err := p.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,309 @@
+package proxy
+
+import (
+	"io"
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"golang.org/x/exp/slog"
+)
+
+const (
+	// The receiving client has to show up this long after the sending client to connect
+	pendingTimeout = 2 * time.Minute
+
+	// Senders waiting for a receiver, in total and from a single IP address
+	maxPending      = 1024
+	maxPendingPerIP = 16
+)
+
+var (
+	transfersTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "aim_proxy_transfers_total",
+		Help: "Rendezvous proxy transfers by how they ended",
+	}, []string{"result"})
+	transferBytes = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "aim_proxy_bytes_total",
+		Help: "Bytes passed between clients by the rendezvous proxy",
+	})
+	activeTransfers = promauto.NewGauge(prometheus.GaugeOpts{
+		Name: "aim_proxy_active_transfers",
+		Help: "Rendezvous proxy transfers that are currently connected",
+	})
+)
+
+// pendingTransfer is a sending client waiting for the receiving client to connect
+type pendingTransfer struct {
+	screenName string
+	cookie     uint64
+	ip         string
+	conn       net.Conn
+	ready      chan net.Conn
+}
+
+// SignOns tells the proxy who is signed on, so it only passes data for AIM users
+type SignOns interface {
+	// SignedOnFrom is true if the user's BOS connection comes from the IP address
+	SignedOnFrom(screenName string, ip net.IP) bool
+}
+
+// Server is an AIM rendezvous proxy. Clients that can't connect to each other directly both connect to
+// the proxy, which passes data between them.
+type Server struct {
+	// IP is the address clients are told to connect to
+	IP net.IP
+	// MaxBytes limits how much each client can send over a transfer, 0 means no limit
+	MaxBytes int64
+
+	signOns     SignOns
+	logger      *slog.Logger
+	pending     map[uint16]*pendingTransfer
+	pendingByIP map[string]int
+	mutex       *sync.Mutex
+}
+
+func NewServer(ip net.IP, maxBytes int64, signOns SignOns, logger *slog.Logger) *Server {
+	return &Server{
+		IP:          ip,
+		MaxBytes:    maxBytes,
+		signOns:     signOns,
+		logger:      logger.With("service", "rendezvous proxy"),
+		pending:     make(map[uint16]*pendingTransfer),
+		pendingByIP: make(map[string]int),
+		mutex:       &sync.Mutex{},
+	}
+}
+
+// Serve accepts proxy connections until the listener is closed
+func (s *Server) Serve(listener net.Listener) error {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return err
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *Server) handle(conn net.Conn) {
+	logger := s.logger.With("ip", conn.RemoteAddr().String())
+
+	conn.SetReadDeadline(time.Now().Add(pendingTimeout))
+	packet, err := ReadPacket(conn)
+	if err != nil {
+		logger.Error("could not read proxy packet", "err", err.Error())
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	switch packet.Header.Command {
+	case CommandInitSend:
+		err = s.initSend(conn, packet, logger)
+	case CommandInitRecv:
+		err = s.initRecv(conn, packet, logger)
+	default:
+		err = errors.Errorf("unexpected proxy command 0x%04x", packet.Header.Command)
+		sendError(conn, ErrorBadRequest)
+	}
+
+	if err != nil {
+		logger.Error("proxy transfer failed", "err", err.Error())
+		conn.Close()
+	}
+}
+
+// initSend registers the sending client and waits for the receiving client. Only users who are signed on from
+// the same address can send, so the proxy isn't open to anyone who wants to relay traffic.
+func (s *Server) initSend(conn net.Conn, packet *Packet, logger *slog.Logger) error {
+	screenName, err := packet.Data.ReadLPString()
+	if err != nil {
+		sendError(conn, ErrorBadRequest)
+		return errors.Wrap(err, "could not read screen name")
+	}
+
+	cookie, err := packet.Data.ReadUint64()
+	if err != nil {
+		sendError(conn, ErrorBadRequest)
+		return errors.Wrap(err, "could not read cookie")
+	}
+
+	ip, _, err := net.SplitHostPort(conn.RemoteAddr().String())
+	if err != nil {
+		sendError(conn, ErrorBadRequest)
+		return errors.Wrap(err, "could not read sender address")
+	}
+
+	if !s.signOns.SignedOnFrom(screenName, net.ParseIP(ip)) {
+		sendError(conn, ErrorNotConnected)
+		return errors.Errorf("sender %s isn't signed on from %s", screenName, ip)
+	}
+
+	transfer := &pendingTransfer{
+		screenName: screenName,
+		cookie:     cookie,
+		ip:         ip,
+		conn:       conn,
+		ready:      make(chan net.Conn, 1),
+	}
+	port, ok := s.addPending(transfer)
+	if !ok {
+		sendError(conn, ErrorBadRequest)
+		return errors.New("too many senders waiting")
+	}
+
+	// The sender passes the port on to the receiver in a rendezvous message so the receiver can find them
+	ack := NewPacket(CommandAck)
+	ack.Data.WriteUint16(port)
+	ack.Data.Write(s.IP.To4())
+	if err := WritePacket(conn, ack); err != nil {
+		s.removePending(port)
+		return errors.Wrap(err, "could not send ack")
+	}
+
+	logger.Info("waiting for receiver", "screen_name", screenName, "port", port)
+
+	select {
+	case <-time.After(pendingTimeout):
+		// A receiver that showed up at the same time already has the connection
+		if s.removePending(port) == nil {
+			return nil
+		}
+		transfersTotal.WithLabelValues("timed_out").Inc()
+		sendError(conn, ErrorTimedOut)
+		return errors.New("receiver never connected")
+	case <-transfer.ready:
+		// The receiving side takes over the connection
+		return nil
+	}
+}
+
+// initRecv pairs the receiving client up with the sending client and passes data between them
+func (s *Server) initRecv(conn net.Conn, packet *Packet, logger *slog.Logger) error {
+	screenName, err := packet.Data.ReadLPString()
+	if err != nil {
+		sendError(conn, ErrorBadRequest)
+		return errors.Wrap(err, "could not read screen name")
+	}
+
+	port, err := packet.Data.ReadUint16()
+	if err != nil {
+		sendError(conn, ErrorBadRequest)
+		return errors.Wrap(err, "could not read port")
+	}
+
+	cookie, err := packet.Data.ReadUint64()
+	if err != nil {
+		sendError(conn, ErrorBadRequest)
+		return errors.Wrap(err, "could not read cookie")
+	}
+
+	transfer := s.removePending(port)
+	if transfer == nil || transfer.cookie != cookie {
+		sendError(conn, ErrorNotConnected)
+		return errors.Errorf("no sender waiting on port %d", port)
+	}
+	transfer.ready <- conn
+
+	for _, c := range []net.Conn{transfer.conn, conn} {
+		if err := WritePacket(c, NewPacket(CommandReady)); err != nil {
+			transfer.conn.Close()
+			return errors.Wrap(err, "could not send ready")
+		}
+	}
+
+	logger.Info("starting transfer", "sender", transfer.screenName, "receiver", screenName, "port", port)
+	s.splice(transfer.conn, conn)
+	return nil
+}
+
+// splice passes data both ways between two clients until either side hangs up or goes over the byte limit
+func (s *Server) splice(a, b net.Conn) {
+	activeTransfers.Inc()
+	defer activeTransfers.Dec()
+
+	var limited bool
+	var limitMutex sync.Mutex
+
+	copyLimited := func(dst, src net.Conn) {
+		var r io.Reader = src
+		if s.MaxBytes > 0 {
+			r = io.LimitReader(src, s.MaxBytes+1)
+		}
+
+		n, _ := io.Copy(dst, r)
+		transferBytes.Add(float64(n))
+
+		if s.MaxBytes > 0 && n > s.MaxBytes {
+			limitMutex.Lock()
+			limited = true
+			limitMutex.Unlock()
+		}
+
+		// Either side finishing ends the transfer
+		a.Close()
+		b.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		copyLimited(b, a)
+		close(done)
+	}()
+	copyLimited(a, b)
+	<-done
+
+	if limited {
+		transfersTotal.WithLabelValues("limit_exceeded").Inc()
+	} else {
+		transfersTotal.WithLabelValues("completed").Inc()
+	}
+}
+
+// addPending registers a sending client under a port number that isn't being used yet. Returns false if too many
+// senders are waiting already. There are far fewer of them than port numbers, so a free one turns up quickly.
+func (s *Server) addPending(transfer *pendingTransfer) (uint16, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if len(s.pending) >= maxPending || s.pendingByIP[transfer.ip] >= maxPendingPerIP {
+		return 0, false
+	}
+
+	for {
+		port := uint16(rand.Intn(0xffff) + 1)
+		if _, ok := s.pending[port]; !ok {
+			s.pending[port] = transfer
+			s.pendingByIP[transfer.ip]++
+			return port, true
+		}
+	}
+}
+
+func (s *Server) removePending(port uint16) *pendingTransfer {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	transfer, ok := s.pending[port]
+	if !ok {
+		return nil
+	}
+	delete(s.pending, port)
+
+	s.pendingByIP[transfer.ip]--
+	if s.pendingByIP[transfer.ip] == 0 {
+		delete(s.pendingByIP, transfer.ip)
+	}
+	return transfer
+}
+
+func sendError(conn net.Conn, code uint16) {
+	errPacket := NewPacket(CommandError)
+	errPacket.Data.WriteUint16(code)
+	WritePacket(conn, errPacket)
+}
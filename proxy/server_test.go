@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// testSignOns has everyone but "stranger" signed on from localhost
+type testSignOns struct{}
+
+func (testSignOns) SignedOnFrom(screenName string, ip net.IP) bool {
+	return screenName != "stranger" && ip.IsLoopback()
+}
+
+func startTestServer(t *testing.T, maxBytes int64) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+
+	logger := slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelError}))
+	server := NewServer(net.ParseIP("127.0.0.1"), maxBytes, testSignOns{}, logger)
+	go server.Serve(listener)
+
+	return listener.Addr().String()
+}
+
+func dial(t *testing.T, addr string) net.Conn {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func expectPacket(t *testing.T, conn net.Conn, command uint16) *Packet {
+	packet, err := ReadPacket(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if packet.Header.Command != command {
+		t.Fatalf("expected command 0x%04x, got 0x%04x", command, packet.Header.Command)
+	}
+	return packet
+}
+
+// initSend has a sender ask the proxy for a port
+func initSend(t *testing.T, addr string, screenName string, cookie uint64) net.Conn {
+	sender := dial(t, addr)
+	initSend := NewPacket(CommandInitSend)
+	initSend.Data.WriteLPString(screenName)
+	initSend.Data.WriteUint64(cookie)
+	if err := WritePacket(sender, initSend); err != nil {
+		t.Fatal(err)
+	}
+	return sender
+}
+
+// connectPair has a sender and a receiver meet through the proxy
+func connectPair(t *testing.T, addr string, cookie uint64) (net.Conn, net.Conn) {
+	sender := initSend(t, addr, "sender", cookie)
+	ack := expectPacket(t, sender, CommandAck)
+	port, err := ack.Data.ReadUint16()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ip, err := ack.Data.ReadBytes(4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !net.IP(ip).Equal(net.ParseIP("127.0.0.1")) {
+		t.Fatalf("expected ack to have the proxy IP, got %v", net.IP(ip))
+	}
+
+	receiver := dial(t, addr)
+	initRecv := NewPacket(CommandInitRecv)
+	initRecv.Data.WriteLPString("receiver")
+	initRecv.Data.WriteUint16(port)
+	initRecv.Data.WriteUint64(cookie)
+	if err := WritePacket(receiver, initRecv); err != nil {
+		t.Fatal(err)
+	}
+
+	expectPacket(t, sender, CommandReady)
+	expectPacket(t, receiver, CommandReady)
+
+	return sender, receiver
+}
+
+func TestProxyTransfer(t *testing.T) {
+	addr := startTestServer(t, 0)
+	sender, receiver := connectPair(t, addr, 0xdeadbeef)
+
+	if _, err := sender.Write([]byte("hello")); err != nil {
+		t.Fatal(err)
+	}
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(receiver, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte("hello")) {
+		t.Fatalf("expected receiver to get hello, got %q", got)
+	}
+
+	if _, err := receiver.Write([]byte("hi back")); err != nil {
+		t.Fatal(err)
+	}
+	got = make([]byte, 7)
+	if _, err := io.ReadFull(sender, got); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, []byte("hi back")) {
+		t.Fatalf("expected sender to get hi back, got %q", got)
+	}
+}
+
+func TestProxyByteLimit(t *testing.T) {
+	addr := startTestServer(t, 4)
+	sender, receiver := connectPair(t, addr, 1)
+
+	if _, err := sender.Write([]byte("too much data")); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _ := io.ReadAll(receiver)
+	if len(got) > 5 {
+		t.Fatalf("expected the transfer to be cut off near the limit, receiver got %d bytes", len(got))
+	}
+}
+
+func TestProxyUnknownPort(t *testing.T) {
+	addr := startTestServer(t, 0)
+
+	receiver := dial(t, addr)
+	initRecv := NewPacket(CommandInitRecv)
+	initRecv.Data.WriteLPString("receiver")
+	initRecv.Data.WriteUint16(1234)
+	initRecv.Data.WriteUint64(1)
+	if err := WritePacket(receiver, initRecv); err != nil {
+		t.Fatal(err)
+	}
+
+	errPacket := expectPacket(t, receiver, CommandError)
+	if code, _ := errPacket.Data.ReadUint16(); code != ErrorNotConnected {
+		t.Fatalf("expected not connected error, got 0x%04x", code)
+	}
+}
+
+func TestProxySenderNotSignedOn(t *testing.T) {
+	addr := startTestServer(t, 0)
+
+	sender := initSend(t, addr, "stranger", 1)
+	errPacket := expectPacket(t, sender, CommandError)
+	if code, _ := errPacket.Data.ReadUint16(); code != ErrorNotConnected {
+		t.Fatalf("expected not connected error, got 0x%04x", code)
+	}
+}
+
+func TestProxyPendingLimit(t *testing.T) {
+	addr := startTestServer(t, 0)
+
+	for n := 0; n < maxPendingPerIP; n++ {
+		expectPacket(t, initSend(t, addr, "sender", uint64(n)), CommandAck)
+	}
+
+	sender := initSend(t, addr, "sender", maxPendingPerIP)
+	errPacket := expectPacket(t, sender, CommandError)
+	if code, _ := errPacket.Data.ReadUint16(); code != ErrorBadRequest {
+		t.Fatalf("expected bad request error, got 0x%04x", code)
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"aim-oscar/services"
+	"sync"
+	"time"
+)
+
+// Rooms that nobody is in are removed after a while, so creating rooms that are never joined doesn't pile up
+const emptyRoomTimeout = 5 * time.Minute
+
+// RoomManager keeps track of the chat rooms that are open
+type RoomManager struct {
+	rooms map[string]*services.ChatRoom
+	mutex *sync.RWMutex
+}
+
+func NewRoomManager() *RoomManager {
+	return &RoomManager{
+		rooms: make(map[string]*services.ChatRoom),
+		mutex: &sync.RWMutex{},
+	}
+}
+
+func (rm *RoomManager) FindOrCreateRoom(exchange uint16, name string) *services.ChatRoom {
+	cookie := services.ChatRoomCookie(exchange, name)
+
+	rm.mutex.Lock()
+	defer rm.mutex.Unlock()
+
+	if room, ok := rm.rooms[cookie]; ok {
+		return room
+	}
+
+	rm.removeEmptyRooms(time.Now())
+
+	room := services.NewChatRoom(exchange, name)
+	rm.rooms[cookie] = room
+	return room
+}
+
+func (rm *RoomManager) GetRoom(cookie string) *services.ChatRoom {
+	rm.mutex.RLock()
+	room, ok := rm.rooms[cookie]
+	rm.mutex.RUnlock()
+
+	if ok {
+		return room
+	}
+	return nil
+}
+
+// RemoveRoom forgets a room if nobody is in it. Someone may have joined since the last member left.
+func (rm *RoomManager) RemoveRoom(cookie string) {
+	rm.mutex.Lock()
+	if room, ok := rm.rooms[cookie]; ok && !room.EmptySince().IsZero() {
+		delete(rm.rooms, cookie)
+	}
+	rm.mutex.Unlock()
+}
+
+// removeEmptyRooms forgets rooms that have been empty for longer than emptyRoomTimeout. The caller holds the mutex.
+func (rm *RoomManager) removeEmptyRooms(now time.Time) {
+	for cookie, room := range rm.rooms {
+		if emptySince := room.EmptySince(); !emptySince.IsZero() && now.Sub(emptySince) > emptyRoomTimeout {
+			delete(rm.rooms, cookie)
+		}
+	}
+}
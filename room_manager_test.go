@@ -0,0 +1,57 @@
+package main
+
+import (
+	"aim-oscar/models"
+	"testing"
+	"time"
+)
+
+func TestRoomManagerRemovesEmptyRooms(t *testing.T) {
+	rm := NewRoomManager()
+
+	unused := rm.FindOrCreateRoom(4, "Unused")
+	occupied := rm.FindOrCreateRoom(4, "Occupied")
+	if err := occupied.Join(&models.User{ScreenName: "toof"}, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	rm.mutex.Lock()
+	rm.removeEmptyRooms(time.Now())
+	rm.mutex.Unlock()
+	if rm.GetRoom(unused.Cookie) == nil {
+		t.Error("expected a new room to be kept until it times out")
+	}
+
+	rm.mutex.Lock()
+	rm.removeEmptyRooms(time.Now().Add(emptyRoomTimeout + time.Second))
+	rm.mutex.Unlock()
+	if rm.GetRoom(unused.Cookie) != nil {
+		t.Error("expected a room nobody joined to be removed after the timeout")
+	}
+	if rm.GetRoom(occupied.Cookie) == nil {
+		t.Error("expected an occupied room to be kept")
+	}
+}
+
+func TestRoomManagerRemoveRoom(t *testing.T) {
+	rm := NewRoomManager()
+	room := rm.FindOrCreateRoom(4, "Lobby")
+
+	if rm.FindOrCreateRoom(4, "LOBBY") != room {
+		t.Error("expected room names to be case insensitive")
+	}
+
+	if err := room.Join(&models.User{ScreenName: "toof"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	rm.RemoveRoom(room.Cookie)
+	if rm.GetRoom(room.Cookie) == nil {
+		t.Error("expected a room with somebody in it not to be removed")
+	}
+
+	room.Leave("toof")
+	rm.RemoveRoom(room.Cookie)
+	if rm.GetRoom(room.Cookie) != nil {
+		t.Error("expected an empty room to be removed")
+	}
+}
@@ -17,6 +17,7 @@ import (
 	"time"
 
 	"github.com/google/uuid"
+	"github.com/pkg/errors"
 	"github.com/uptrace/bun"
 	"golang.org/x/exp/slog"
 )
@@ -29,18 +30,47 @@ type Handler struct {
 	db             *bun.DB
 	logger         *slog.Logger
 	sessionManager *SessionManager
+	roomManager    *RoomManager
 	serviceManager *ServiceManager
 	onlineCh       chan *models.User
+	rateClasses    []*oscar.RateClass
+	cookieKey      []byte
+	serviceSignons ServiceSignons
+	loginCookies   *services.LoginCookies
+	bosAddress     string
 }
 
-func NewHandler(conf *config.AppConfig, db *bun.DB, logger *slog.Logger, sm *SessionManager, svm *ServiceManager, onlineCh chan *models.User) *Handler {
+func NewHandler(conf *config.AppConfig, db *bun.DB, logger *slog.Logger, sm *SessionManager, rm *RoomManager, svm *ServiceManager, onlineCh chan *models.User, cookieKey []byte, loginCookies *services.LoginCookies, bosAddress string) *Handler {
 	return &Handler{
-		conf, db, logger, sm, svm, onlineCh,
+		conf, db, logger, sm, rm, svm, onlineCh, rateClassesFromConfig(conf.RateClasses), cookieKey, &dbServiceSignons{db}, loginCookies, bosAddress,
 	}
 }
 
-func (h *Handler) Handle(conn net.Conn, logger *slog.Logger) {
-	connLogger := logger.With("session_id", uuid.New(), "ip", conn.RemoteAddr().String())
+func rateClassesFromConfig(classes []config.RateClassConfig) []*oscar.RateClass {
+	rateClasses := make([]*oscar.RateClass, 0, len(classes))
+	for _, c := range classes {
+		class := &oscar.RateClass{
+			ID:              c.ID,
+			WindowSize:      c.WindowSize,
+			ClearLevel:      c.ClearLevel,
+			AlertLevel:      c.AlertLevel,
+			LimitLevel:      c.LimitLevel,
+			DisconnectLevel: c.DisconnectLevel,
+			MaxLevel:        c.MaxLevel,
+		}
+		for _, snacs := range c.SNACs {
+			for _, subtype := range snacs.Subtypes {
+				class.SNACs = append(class.SNACs, oscar.RateSNAC{Family: snacs.Family, Subtype: subtype})
+			}
+		}
+		rateClasses = append(rateClasses, class)
+	}
+	return rateClasses
+}
+
+// Handle reads FLAPs from a client that connected to a listener until it hangs up
+func (h *Handler) Handle(conn net.Conn, listener *Listener, logger *slog.Logger) {
+	connLogger := logger.With("session_id", uuid.New(), "ip", conn.RemoteAddr().String(), "role", listener.Role)
 	connLogger.Info("New Connection")
 
 	ctx := oscar.NewContextWithSession(context.Background(), conn, connLogger)
@@ -48,6 +78,7 @@ func (h *Handler) Handle(conn net.Conn, logger *slog.Logger) {
 	if err != nil {
 		connLogger.Error("could not create session for context", "err", err)
 	}
+	session.RateLimiter = oscar.NewRateLimiter(h.rateClasses)
 
 	var buf bytes.Buffer
 	for {
@@ -108,12 +139,12 @@ func (h *Handler) Handle(conn net.Conn, logger *slog.Logger) {
 				break
 			}
 
-			ctx = h.handleFn(ctx, flap)
+			ctx = h.handleFn(ctx, listener, flap)
 		}
 	}
 }
 
-func (h *Handler) handleFn(ctx context.Context, flap *oscar.FLAP) context.Context {
+func (h *Handler) handleFn(ctx context.Context, listener *Listener, flap *oscar.FLAP) context.Context {
 	session, err := oscar.SessionFromContext(ctx)
 	if err != nil {
 		// TODO
@@ -148,20 +179,55 @@ func (h *Handler) handleFn(ctx context.Context, flap *oscar.FLAP) context.Contex
 			return ctx
 		}
 
-		user, screenName, err := services.AuthenticateFLAPCookie(ctx, h.db, flap)
+		// Service connections sign on with the cookie they got from the service redirect
+		if serviceCtx, ok := h.handleServiceSignon(ctx, listener, session, flap); ok {
+			return serviceCtx
+		}
+
+		// Password logins go to listeners that log users in, cookies from the authorizer go to BOS
+		roasted := services.IsRoastedLogin(flap)
+		if (roasted && !listener.LogsIn()) || (!roasted && !listener.SignsOn()) {
+			session.Logger.Warn("refusing sign on this listener doesn't handle", "roasted", roasted)
+			session.Disconnect()
+			return ctx
+		}
+
+		user, screenName, err := services.AuthenticateFLAPCookie(ctx, h.db, h.loginCookies, flap)
 		if err != nil {
 			session.Logger.Error("Could not authenticate user cookie", "screen_name", screenName, slog.String("err", err.Error()))
+
+			// Tell the client why they can't log in and hang up, so they can't keep trying on the same connection
+			var refused *services.LoginRefusedError
+			if errors.As(err, &refused) {
+				if err := services.SendLoginRefused(session, screenName, refused.Code); err != nil {
+					session.Logger.Error("Could not refuse login", slog.String("err", err.Error()))
+				}
+			}
+			return ctx
+		}
+
+		// ICQ clients log in to the authorizer on channel 1 and are then sent to BOS with a cookie. So are all
+		// clients that log in to a listener that doesn't serve anything else.
+		if services.IsICQLogin(flap) || !listener.SignsOn() {
+			session.Logger.Info("Authorized user", "screen_name", user.ScreenName, "uin", user.UIN)
+			if err := services.SendBOSRedirect(ctx, h.db, session, h.loginCookies, user, h.bosAddress); err != nil {
+				session.Logger.Error("Could not send user to BOS", slog.String("err", err.Error()))
+			}
 			return ctx
 		}
 
 		session.Logger.Info("Authenticated user", "screen_name", user.ScreenName)
 
 		session.ScreenName = user.ScreenName
+		session.SignonAt = time.Now()
 		ctx = models.NewContextWithUser(ctx, user)
 
-		// Send available services
+		// Send available services. Some services are only available on their own connection.
 		servicesSnac := oscar.NewSNAC(0x1, 0x3)
 		for _, service := range services.ServiceVersions {
+			if services.RedirectedFamilies[service.Family] || !listener.Serves(service.Family) {
+				continue
+			}
 			servicesSnac.Data.WriteUint16(service.Family)
 		}
 
@@ -179,6 +245,36 @@ func (h *Handler) handleFn(ctx context.Context, flap *oscar.FLAP) context.Contex
 			return ctx
 		}
 
+		class, status, changed := session.RateLimiter.Check(snac.Header.Family, snac.Header.Subtype, time.Now())
+		if status == oscar.RateStatusDisconnect {
+			session.Logger.Warn("rate limit disconnect", "screen_name", session.ScreenName, "snac", snac)
+			session.Disconnect()
+			h.handleCloseFn(ctx, session)
+			return ctx
+		}
+
+		if changed {
+			rateSnac := oscar.NewSNAC(0x01, 0x0a)
+			rateSnac.Data.WriteUint16(uint16(status))
+			session.RateLimiter.WriteClass(&rateSnac.Data, class)
+			rateFlap := oscar.NewFLAP(2)
+			rateFlap.Data.WriteBinary(rateSnac)
+			session.Send(rateFlap)
+		}
+
+		// Redirected connections only handle the family they were opened for, and listeners only handle the
+		// families they're set up for
+		if !session.Serves(snac.Header.Family) || !listener.Serves(snac.Header.Family) {
+			session.Logger.Warn("dropping SNAC for a family this connection doesn't serve", "screen_name", session.ScreenName, "snac", snac)
+			return ctx
+		}
+
+		// Drop everything in a rate class that is over its limit
+		if status == oscar.RateStatusLimited {
+			session.Logger.Debug("dropping rate limited SNAC", "screen_name", session.ScreenName, "snac", snac)
+			return ctx
+		}
+
 		if service, ok := h.serviceManager.GetService(snac.Header.Family); ok {
 			newCtx, err := service.HandleSNAC(ctx, h.db, snac)
 			if err != nil {
@@ -203,21 +299,122 @@ func (h *Handler) handleFn(ctx context.Context, flap *oscar.FLAP) context.Contex
 	return ctx
 }
 
+// handleServiceSignon signs on a connection the user was redirected to with 0x01/0x05. Returns false if the
+// FLAP doesn't carry a service cookie, since it's then a regular BOS sign on.
+func (h *Handler) handleServiceSignon(ctx context.Context, listener *Listener, session *oscar.Session, flap *oscar.FLAP) (context.Context, bool) {
+	if len(flap.Data.Bytes()) < 4 {
+		return ctx, false
+	}
+
+	tlvs, err := oscar.UnmarshalTLVs(flap.Data.Bytes()[4:])
+	if err != nil {
+		return ctx, false
+	}
+
+	cookieTLV := oscar.FindTLV(tlvs, 0x6)
+	if cookieTLV == nil {
+		return ctx, false
+	}
+
+	now := time.Now()
+	cookie, err := oscar.VerifyServiceCookie(h.cookieKey, cookieTLV.Data, now)
+	if err != nil {
+		return ctx, false
+	}
+
+	if !listener.Serves(cookie.Family) {
+		session.Logger.Warn("refusing service connection for a family this listener doesn't serve", "family", cookie.Family)
+		session.Disconnect()
+		return ctx, true
+	}
+
+	used, err := h.serviceSignons.UseCookie(ctx, cookie.Nonce, time.Unix(cookie.ExpiresAt, 0), now)
+	if err != nil {
+		session.Logger.Error("could not use service cookie", "screen_name", cookie.ScreenName, "err", err.Error())
+		session.Disconnect()
+		return ctx, true
+	}
+	if !used {
+		session.Logger.Warn("refusing service cookie that was already used", "screen_name", cookie.ScreenName, "family", cookie.Family)
+		session.Disconnect()
+		return ctx, true
+	}
+
+	// Service connections only make sense while the user is signed on
+	user, err := h.serviceSignons.SignedOnUser(ctx, cookie.ScreenName)
+	if err != nil {
+		session.Logger.Error("Could not find user for service cookie", "screen_name", cookie.ScreenName, "err", err.Error())
+		session.Disconnect()
+		return ctx, true
+	}
+	if user == nil {
+		session.Logger.Warn("refusing service connection for a user who isn't signed on", "screen_name", cookie.ScreenName, "family", cookie.Family)
+		session.Disconnect()
+		return ctx, true
+	}
+
+	session.Logger.Info("Authenticated service connection", "screen_name", user.ScreenName, "family", cookie.Family)
+
+	session.ScreenName = user.ScreenName
+	session.Family = cookie.Family
+	ctx = models.NewContextWithUser(ctx, user)
+
+	if cookie.Family == 0x0e {
+		room := h.roomManager.FindOrCreateRoom(cookie.ChatExchange, cookie.ChatRoom)
+		ctx = services.NewContextWithChatRoom(ctx, room)
+		h.sessionManager.SetChatSession(user.ScreenName, room.Cookie, session)
+	} else {
+		h.sessionManager.SetSession(user.ScreenName, session)
+	}
+
+	servicesSnac := oscar.NewSNAC(0x1, 0x3)
+	servicesSnac.Data.WriteUint16(0x01)
+	servicesSnac.Data.WriteUint16(cookie.Family)
+
+	servicesFlap := oscar.NewFLAP(2)
+	servicesFlap.Data.WriteBinary(servicesSnac)
+	session.Send(servicesFlap)
+
+	return ctx, true
+}
+
 func (h *Handler) handleCloseFn(ctx context.Context, session *oscar.Session) {
 	session.Logger.Info("Disconnected")
 
 	user := models.UserFromContext(ctx)
+
+	// Closing a service connection doesn't sign the user off
+	if session.Family != 0 {
+		if room := services.ChatRoomFromContext(ctx); room != nil && user != nil {
+			session.Logger.Info("left chat room", "screen_name", user.ScreenName, "room", room.Name)
+			if services.LeaveChatRoom(room, user) == 0 {
+				h.roomManager.RemoveRoom(room.Cookie)
+			}
+		}
+		if user != nil {
+			h.sessionManager.RemoveSession(user.ScreenName, session)
+		}
+		session.Disconnect()
+		return
+	}
+
 	if user != nil {
-		if err := user.SetAway(ctx, h.db); err != nil {
-			h.logger.Error("Could not set user as away", slog.String("err", err.Error()))
+		if err := user.SetOffline(ctx, h.db); err != nil {
+			h.logger.Error("Could not set user as offline", slog.String("err", err.Error()))
 		}
 
 		h.logger.Info("Disconnecting user", slog.String("screen_name", user.ScreenName))
 
 		h.onlineCh <- user
+		h.serviceManager.SignOff(user.ScreenName)
 		if session, err := oscar.SessionFromContext(ctx); err == nil {
 			session.Disconnect()
-			h.sessionManager.RemoveSession(user.ScreenName)
+			h.sessionManager.RemoveSession(user.ScreenName, session)
+		}
+
+		// The user's service connections go away with their BOS connection
+		for _, serviceSession := range h.sessionManager.GetServiceSessions(user.ScreenName) {
+			serviceSession.Disconnect()
 		}
 	}
 }
@@ -0,0 +1,241 @@
+package main
+
+import (
+	"aim-oscar/config"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/services"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// memoryServiceSignons stands in for the database that every server shares
+type memoryServiceSignons struct {
+	users map[string]*models.User
+	used  map[string]bool
+	mutex sync.Mutex
+}
+
+func (s *memoryServiceSignons) UseCookie(ctx context.Context, nonce string, expiresAt time.Time, now time.Time) (bool, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if s.used[nonce] {
+		return false, nil
+	}
+	s.used[nonce] = true
+	return true, nil
+}
+
+func (s *memoryServiceSignons) SignedOnUser(ctx context.Context, screenName string) (*models.User, error) {
+	user := s.users[screenName]
+	if user == nil || !user.Status.Connected() {
+		return nil, nil
+	}
+	return user, nil
+}
+
+func newTestHandler(key []byte, signons ServiceSignons) *Handler {
+	return &Handler{
+		conf:           &config.AppConfig{},
+		logger:         slog.Default(),
+		sessionManager: NewSessionManager(),
+		roomManager:    NewRoomManager(),
+		serviceManager: NewServiceManager(),
+		cookieKey:      key,
+		serviceSignons: signons,
+	}
+}
+
+// newTestSession is a server side session whose client ignores everything it's sent
+func newTestSession(t *testing.T) (context.Context, *oscar.Session) {
+	server, client := net.Pipe()
+	t.Cleanup(func() { server.Close() })
+	go io.Copy(io.Discard, client)
+
+	ctx := oscar.NewContextWithSession(context.Background(), server, slog.Default())
+	session, _ := oscar.SessionFromContext(ctx)
+	return ctx, session
+}
+
+// readFLAP reads the next FLAP sent to a client
+func readFLAP(conn net.Conn) (*oscar.FLAP, error) {
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+
+	header := make([]byte, 6)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return nil, err
+	}
+	data := make([]byte, 6+int(binary.BigEndian.Uint16(header[4:])))
+	copy(data, header)
+	if _, err := io.ReadFull(conn, data[6:]); err != nil {
+		return nil, err
+	}
+
+	flap := &oscar.FLAP{}
+	return flap, flap.UnmarshalBinary(data)
+}
+
+// signonFLAP is the channel 1 FLAP a client signs on to a service with
+func signonFLAP(cookie []byte) *oscar.FLAP {
+	flap := oscar.NewFLAP(1)
+	flap.Data.WriteUint32(1)
+	flap.Data.WriteBinary(oscar.NewTLV(0x06, cookie))
+	return flap
+}
+
+func TestServiceSignon(t *testing.T) {
+	key := []byte("secret")
+	signons := &memoryServiceSignons{
+		users: map[string]*models.User{
+			"toof": {ScreenName: "toof", Status: models.UserStatusOnline},
+			"mike": {ScreenName: "mike", Status: models.UserStatusOffline},
+		},
+		used: make(map[string]bool),
+	}
+	h := newTestHandler(key, signons)
+	listener := &Listener{Role: config.ListenerRoleAll}
+
+	signon := func(screenName string, nonce string) *oscar.Session {
+		cookie, err := oscar.SignServiceCookie(key, &oscar.ServiceCookie{
+			ScreenName: screenName,
+			Family:     0x10,
+			Nonce:      nonce,
+			ExpiresAt:  time.Now().Add(time.Minute).Unix(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		ctx, session := newTestSession(t)
+		if _, ok := h.handleServiceSignon(ctx, listener, session, signonFLAP(cookie)); !ok {
+			t.Fatal("expected the service cookie to be handled")
+		}
+		return session
+	}
+
+	// Whether the user is signed on comes from the database, not from the sessions this handler has
+	if session := signon("toof", "a"); session.Family != 0x10 {
+		t.Error("expected a signed on user to get a service connection")
+	}
+	if len(h.sessionManager.GetServiceSessions("toof")) != 1 {
+		t.Error("expected the service connection to be tracked")
+	}
+
+	if session := signon("toof", "a"); session.Family != 0 {
+		t.Error("expected a used cookie to be refused")
+	}
+	if session := signon("mike", "b"); session.Family != 0 {
+		t.Error("expected a user who isn't signed on to be refused")
+	}
+}
+
+func TestServiceListenerSignon(t *testing.T) {
+	key := []byte("secret")
+	user := &models.User{ScreenName: "toof", Status: models.UserStatusOnline}
+	signons := &memoryServiceSignons{
+		users: map[string]*models.User{"toof": user},
+		used:  make(map[string]bool),
+	}
+
+	// BOS hands out the cookie for the buddy icon service
+	bosServer, bosClient := net.Pipe()
+	t.Cleanup(func() { bosServer.Close() })
+	ctx := oscar.NewContextWithSession(context.Background(), bosServer, slog.Default())
+	ctx = models.NewContextWithUser(ctx, user)
+	bos := &services.GenericServiceControls{CookieKey: key, ServiceAddresses: map[uint16]string{0x10: "127.0.0.1:5193"}}
+
+	request := oscar.NewSNAC(0x01, 0x04)
+	request.Data.WriteUint16(0x10)
+	go bos.HandleSNAC(ctx, nil, request)
+
+	redirect, err := readFLAP(bosClient)
+	if err != nil {
+		t.Fatal(err)
+	}
+	redirectSnac := &oscar.SNAC{}
+	if err := redirectSnac.UnmarshalBinary(redirect.Data.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	tlvs, err := oscar.UnmarshalTLVs(redirectSnac.Data.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	cookieTLV := oscar.FindTLV(tlvs, 0x06)
+	if cookieTLV == nil {
+		t.Fatal("expected the redirect to carry a cookie")
+	}
+
+	// Service listeners that share the database but none of BOS's sessions
+	serviceListener := &Listener{Role: config.ListenerRoleService, Families: map[uint16]bool{0x10: true}}
+	listen := func() string {
+		netListener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { netListener.Close() })
+
+		h := newTestHandler(key, signons)
+		go func() {
+			for {
+				conn, err := netListener.Accept()
+				if err != nil {
+					return
+				}
+				go h.Handle(conn, serviceListener, slog.Default())
+			}
+		}()
+		return netListener.Addr().String()
+	}
+
+	signon := func(addr string) net.Conn {
+		conn, err := net.Dial("tcp", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+
+		if _, err := readFLAP(conn); err != nil {
+			t.Fatal("expected a hello:", err)
+		}
+		signon := signonFLAP(cookieTLV.Data)
+		signon.Header.SequenceNumber = 1
+		data, err := signon.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := conn.Write(data); err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	conn := signon(listen())
+	reply, err := readFLAP(conn)
+	if err != nil {
+		t.Fatal("expected the service listener to accept the cookie:", err)
+	}
+	servicesSnac := &oscar.SNAC{}
+	if err := servicesSnac.UnmarshalBinary(reply.Data.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	if servicesSnac.Header.Family != 0x01 || servicesSnac.Header.Subtype != 0x03 {
+		t.Fatalf("expected 0x01/0x03, got 0x%02x/0x%02x", servicesSnac.Header.Family, servicesSnac.Header.Subtype)
+	}
+	if !bytes.Equal(servicesSnac.Data.Bytes(), []byte{0x00, 0x01, 0x00, 0x10}) {
+		t.Errorf("expected families 0x01 and 0x10, got %x", servicesSnac.Data.Bytes())
+	}
+
+	// The cookie was used, so another server won't take it either
+	if _, err := readFLAP(signon(listen())); err == nil {
+		t.Error("expected a replayed cookie to be refused")
+	}
+}
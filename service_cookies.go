@@ -0,0 +1,36 @@
+package main
+
+import (
+	"aim-oscar/models"
+	"context"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+// ServiceSignons is what service connections are checked against when they sign on. It's shared by every server,
+// so a user can open a service connection on a different server than the one they signed on to, and each cookie
+// can still only be used once.
+type ServiceSignons interface {
+	// UseCookie marks a service cookie as used. Returns false if it had been used already.
+	UseCookie(ctx context.Context, nonce string, expiresAt time.Time, now time.Time) (bool, error)
+	// SignedOnUser returns the user if they're signed on, or nil if they aren't
+	SignedOnUser(ctx context.Context, screenName string) (*models.User, error)
+}
+
+// dbServiceSignons keeps used cookies in the database and checks users' status there
+type dbServiceSignons struct {
+	db *bun.DB
+}
+
+func (s *dbServiceSignons) UseCookie(ctx context.Context, nonce string, expiresAt time.Time, now time.Time) (bool, error) {
+	return models.UseServiceCookie(ctx, s.db, nonce, expiresAt, now)
+}
+
+func (s *dbServiceSignons) SignedOnUser(ctx context.Context, screenName string) (*models.User, error) {
+	user, err := models.UserByScreenName(ctx, s.db, screenName)
+	if err != nil || user == nil || !user.Status.Connected() {
+		return nil, err
+	}
+	return user, nil
+}
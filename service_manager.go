@@ -16,6 +16,15 @@ func (sm *ServiceManager) RegisterService(family uint16, service services.Servic
 	sm.services[family] = service
 }
 
+// SignOff lets every service that keeps state for signed on users forget about the user
+func (sm *ServiceManager) SignOff(screenName string) {
+	for _, service := range sm.services {
+		if s, ok := service.(services.SignOffService); ok {
+			s.SignOff(screenName)
+		}
+	}
+}
+
 func (sm *ServiceManager) GetService(family uint16) (services.Service, bool) {
 	s, ok := sm.services[family]
 	return s, ok
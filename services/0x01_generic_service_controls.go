@@ -6,7 +6,11 @@ import (
 	"aim-oscar/oscar"
 	"aim-oscar/util"
 	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
 	"fmt"
+	"net"
 	"time"
 
 	"github.com/pkg/errors"
@@ -26,16 +30,42 @@ func init() {
 		{0x02, 1},
 		{0x03, 1},
 		{0x04, 1},
+		{0x09, 1},
+		{0x0d, 1},
+		{0x0e, 1},
 		{0x0f, 1},
-		{0x13, 1},
+		{0x10, 1},
+		{0x13, 4},
+		{0x15, 1},
 		{0x17, 1},
 		{0x18, 1},
 	}
 }
 
+// RedirectedFamilies are only available on a connection of their own, clients have to ask for them with 0x01/0x04
+var RedirectedFamilies = map[uint16]bool{
+	0x0e: true,
+	0x0f: true,
+	0x10: true,
+}
+
+// Clients are expected to connect to a redirected service right away
+const serviceCookieLifetime = 2 * time.Minute
+
 type GenericServiceControls struct {
-	OnlineCh       chan *models.User
-	ServerHostname string
+	OnlineCh   chan *models.User
+	CommCh     chan *models.Message
+	BOSAddress string
+	CookieKey  []byte
+	Rooms      ChatRooms
+	Sessions   SessionFinder
+
+	// ServiceAddresses is where clients are sent for families that are served by listeners of their own. Other
+	// families are served by BOS.
+	ServiceAddresses map[uint16]string
+
+	// Stored messages older than this aren't delivered when the user signs on, 0 means they never expire
+	OfflineMessageExpiry time.Duration
 }
 
 func (g *GenericServiceControls) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
@@ -47,60 +77,167 @@ func (g *GenericServiceControls) HandleSNAC(ctx context.Context, db *bun.DB, sna
 	// Client is ONLINE and READY
 	case 0x02:
 		user := models.UserFromContext(ctx)
-		if user != nil {
-			user.Status = models.UserStatusOnline
-			if err := user.Update(ctx, db, "status"); err != nil {
-				return ctx, errors.Wrap(err, "could not set user as active")
+
+		// Chat connections join their room once they're ready instead of changing the user's status
+		if room := ChatRoomFromContext(ctx); room != nil && user != nil {
+			err := JoinChatRoom(room, user, session)
+			if errors.Is(err, ErrChatRoomFull) {
+				logger.Info("chat room is full", "screen_name", user.ScreenName, "room", room.Name)
+				sendSNACError(session, 0x0e, 0x0d) // error code 0x0d: Request denied
+				return ctx, session.Disconnect()
+			}
+			if err != nil {
+				return ctx, err
+			}
+
+			logger.Info("joined chat room", "screen_name", user.ScreenName, "room", room.Name)
+			return ctx, nil
+		}
+
+		// Only the BOS connection signs the user on. Service connections like BART and directory search say
+		// they're ready too, and going through this again would deliver offline messages twice.
+		if user != nil && session.Family == 0 {
+			// ICQ clients set their status with 0x01/0x1E before they're ready
+			if !user.Status.Connected() {
+				user.Status = models.UserStatusOnline
+				if err := user.Update(ctx, db, "status"); err != nil {
+					return ctx, errors.Wrap(err, "could not set user as active")
+				}
 			}
 
 			g.OnlineCh <- user
 
+			// ICQ clients ask for their offline messages with 0x15/0x02 instead, sending them here too would
+			// deliver them twice
+			if !ICQClientFromContext(ctx) {
+				if err := g.deliverOfflineMessages(ctx, db, user); err != nil {
+					logger.Error("could not deliver offline messages", "screen_name", user.ScreenName, "err", err.Error())
+				}
+			}
+
 			return models.NewContextWithUser(ctx, user), nil
 		}
 
 		return ctx, nil
 
+	// Client wants a connection for another service
 	case 0x04:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
 		family, err := snac.Data.ReadUint16()
 		if err != nil {
 			return ctx, errors.Wrap(err, "could not read family")
 		}
-		logger.Warn(fmt.Sprintf("client wants service for family 0x%02x", family))
-		return ctx, nil
+
+		// Everything else is only available on BOS
+		if !RedirectedFamilies[family] {
+			logger.Warn(fmt.Sprintf("client wants service for unavailable family 0x%02x", family))
+			return ctx, sendSNACError(session, 0x01, 0x05) // error code 0x05: Requested service unavailable
+		}
+
+		nonce := make([]byte, 16)
+		if _, err := rand.Read(nonce); err != nil {
+			return ctx, errors.Wrap(err, "could not generate service cookie nonce")
+		}
+
+		cookie := &oscar.ServiceCookie{
+			ScreenName: user.ScreenName,
+			Family:     family,
+			Nonce:      hex.EncodeToString(nonce),
+			ExpiresAt:  time.Now().Add(serviceCookieLifetime).Unix(),
+		}
+
+		// Chat connections are for the room the client asked for
+		if family == 0x0e {
+			tlvs, err := oscar.UnmarshalTLVs(snac.Data.Bytes())
+			if err != nil {
+				return ctx, errors.Wrap(err, "could not unmarshal service request TLVs")
+			}
+
+			roomTLV := oscar.FindTLV(tlvs, 0x01)
+			if roomTLV == nil {
+				return ctx, errors.New("chat service request missing room TLV 0x1")
+			}
+
+			roomBuf := oscar.Buffer{}
+			roomBuf.Write(roomTLV.Data)
+			_, roomCookie, _, err := ReadChatRoomCookie(&roomBuf)
+			if err != nil {
+				return ctx, err
+			}
+
+			room := g.Rooms.GetRoom(roomCookie)
+			if room == nil {
+				return ctx, sendSNACError(session, 0x01, 0x14) // error code 0x14: No Match
+			}
+			if room.Full() {
+				logger.Info("chat room is full", "screen_name", user.ScreenName, "room", room.Name)
+				return ctx, sendSNACError(session, 0x01, 0x0d) // error code 0x0d: Request denied
+			}
+
+			cookie.ChatExchange = room.Exchange
+			cookie.ChatRoom = room.Name
+		}
+
+		cookieData, err := oscar.SignServiceCookie(g.CookieKey, cookie)
+		if err != nil {
+			return ctx, err
+		}
+
+		logger.Info("redirecting client to service", "screen_name", user.ScreenName, "family", family)
+
+		redirectSnac := oscar.NewSNAC(0x01, 0x05)
+		redirectSnac.Header.RequestID = snac.Header.RequestID
+		redirectSnac.WriteTLV(oscar.NewTLV(0x0d, util.Word(family)))
+		redirectSnac.WriteTLV(oscar.NewTLV(0x05, []byte(g.serviceAddress(family))))
+		redirectSnac.WriteTLV(oscar.NewTLV(0x06, cookieData))
+
+		redirectFlap := oscar.NewFLAP(2)
+		redirectFlap.Data.WriteBinary(redirectSnac)
+		return ctx, session.Send(redirectFlap)
 
 	// Client wants to know the rate limits for all services
 	case 0x06:
+		classes := session.RateLimiter.Classes()
+
 		rateSnac := oscar.NewSNAC(1, 7)
-		rateSnac.Data.WriteUint16(1) // one rate class
-
-		// Define a Rate Class
-		rc := oscar.Buffer{}
-		rc.WriteUint16(1)    // ID
-		rc.WriteUint32(80)   // Window Size
-		rc.WriteUint32(2500) // Clear level
-		rc.WriteUint32(2000) // Alert level
-		rc.WriteUint32(1500) // Limit level
-		rc.WriteUint32(800)  // Disconnect level
-		rc.WriteUint32(3400) // Current level (fake)
-		rc.WriteUint32(6000) // Max level
-		rc.WriteUint32(0)    // Last time ?
-		rc.WriteUint8(0)     // Current state ?
-		rateSnac.Data.Write(rc.Bytes())
-
-		// Define a Rate Group
-		rg := oscar.Buffer{}
-		rg.WriteUint16(1) // ID
-
-		// TODO: make actual rate groups instead of this hack. I can't tell which subtypes are supported so
-		// make it set rate limits for every family and all subtypes under 0x21.
-		rg.WriteUint16(uint16(len(ServiceVersions)) * 0x21) // Number of rate groups
-		for _, service := range ServiceVersions {
-			for subtype := 0; subtype < 0x21; subtype++ {
-				rg.WriteUint16(service.Family)
-				rg.WriteUint16(uint16(subtype))
+		rateSnac.Data.WriteUint16(uint16(len(classes)))
+		for _, class := range classes {
+			session.RateLimiter.WriteClass(&rateSnac.Data, class)
+		}
+
+		// SNACs that aren't assigned to a class fall into the first class. The client can't tell which
+		// subtypes are supported so the first class claims every other subtype under 0x21.
+		assigned := make(map[oscar.RateSNAC]bool)
+		for _, class := range classes {
+			for _, pair := range class.SNACs {
+				assigned[pair] = true
+			}
+		}
+
+		for i, class := range classes {
+			pairs := class.SNACs
+			if i == 0 {
+				for _, service := range ServiceVersions {
+					for subtype := uint16(0); subtype < 0x21; subtype++ {
+						pair := oscar.RateSNAC{Family: service.Family, Subtype: subtype}
+						if !assigned[pair] {
+							pairs = append(pairs, pair)
+						}
+					}
+				}
+			}
+
+			rateSnac.Data.WriteUint16(class.ID)
+			rateSnac.Data.WriteUint16(uint16(len(pairs)))
+			for _, pair := range pairs {
+				rateSnac.Data.WriteUint16(pair.Family)
+				rateSnac.Data.WriteUint16(pair.Subtype)
 			}
 		}
-		rateSnac.Data.Write(rg.Bytes())
 
 		rateFlap := oscar.NewFLAP(2)
 		rateFlap.Data.WriteBinary(rateSnac)
@@ -108,6 +245,13 @@ func (g *GenericServiceControls) HandleSNAC(ctx context.Context, db *bun.DB, sna
 
 	// Client notifying server it accepted rate limits
 	case 0x08:
+		for len(snac.Data.Bytes()) > 0 {
+			classID, err := snac.Data.ReadUint16()
+			if err != nil {
+				return ctx, errors.Wrap(err, "could not read acknowledged rate class")
+			}
+			logger.Debug("client accepted rate class", "rate_class", classID)
+		}
 		return ctx, nil
 
 	// Client wants their own online information
@@ -117,43 +261,88 @@ func (g *GenericServiceControls) HandleSNAC(ctx context.Context, db *bun.DB, sna
 			return ctx, aimerror.NoUserInSession
 		}
 
-		onlineSnac := oscar.NewSNAC(0x1, 0xf)
-		onlineSnac.Data.WriteUint8(uint8(len(user.ScreenName)))
-		onlineSnac.Data.WriteString(user.ScreenName)
-		onlineSnac.Data.WriteUint16(0) // warning level
-
-		user.Status = models.UserStatusOnline
-		if err := user.Update(ctx, db, "status"); err != nil {
-			return ctx, errors.Wrap(err, "could not set user as active")
+		// Other users may have warned this user since they signed on
+		if err := user.Reload(ctx, db, "warning_level", "warned_at", "icon_hash"); err != nil {
+			return ctx, err
 		}
 
-		tlvs := []*oscar.TLV{
-			oscar.NewTLV(0x01, util.Dword(0x0100)),                                            // User Class
-			oscar.NewTLV(0x06, util.Dword(uint32(user.Status))),                               // user status
-			oscar.NewTLV(0x0a, util.Dword(0)),                                                 // External IP of the client?
-			oscar.NewTLV(0x0f, util.Dword(uint32(time.Since(user.LastActivityAt).Seconds()))), // Idle Time
-			oscar.NewTLV(0x03, util.Dword(uint32(time.Now().Unix()))),                         // Client Signon Time
-			oscar.NewTLV(0x1e, util.Dword(0x0)),                                               // Unknown value
-			oscar.NewTLV(0x05, util.Dword(uint32(user.CreatedAt.Unix()))),                     // Member since
+		if !user.Status.Connected() {
+			user.Status = models.UserStatusOnline
+			if err := user.Update(ctx, db, "status"); err != nil {
+				return ctx, errors.Wrap(err, "could not set user as active")
+			}
 		}
 
-		onlineSnac.AppendTLVs(tlvs)
+		return models.NewContextWithUser(ctx, user), g.sendSelfInfo(session, user)
 
-		onlineFlap := oscar.NewFLAP(2)
-		onlineFlap.Data.WriteBinary(onlineSnac)
-		return models.NewContextWithUser(ctx, user), session.Send(onlineFlap)
-
-	// Client tells us the idle time
+	// Client tells us how many seconds the user has been idle, 0 when they're back
 	case 0x11:
-		// TODO: keep track of idle time
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		idleSeconds, err := snac.Data.ReadUint32()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read idle time")
+		}
+
+		// Buddies only hear about it when the user goes idle or comes back, clients count up the idle time
+		if session.SetIdle(time.Duration(idleSeconds)*time.Second, time.Now()) {
+			logger.Info("idle status changed", "screen_name", user.ScreenName, "idle_seconds", idleSeconds)
+			g.OnlineCh <- user
+		}
 		return ctx, nil
 
 	case 0x16:
 		// NOP, client keepalive
 		return ctx, nil
 
+	// Client sets their extended status, ICQ clients use this for Away/NA/DND/Occupied/Free4Chat/Invisible
+	case 0x1e:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		tlvs, err := oscar.UnmarshalTLVs(snac.Data.Bytes())
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not unmarshal extended status tlvs")
+		}
+
+		// The high word of TLV 0x06 has flags like web aware that we don't track
+		if statusTLV := oscar.FindTLV(tlvs, 0x06); statusTLV != nil {
+			if len(statusTLV.Data) != 4 {
+				return ctx, errors.New("status TLV 0x06 should be 4 bytes")
+			}
+
+			user.Status = models.UserStatusFromFlags(binary.BigEndian.Uint16(statusTLV.Data[2:]))
+			if err := user.Update(ctx, db, "status"); err != nil {
+				return ctx, errors.Wrap(err, "could not set extended status")
+			}
+
+			logger.Info("set extended status", "screen_name", user.ScreenName, "status", user.Status.String())
+			g.OnlineCh <- user
+		}
+
+		return models.NewContextWithUser(ctx, user), g.sendSelfInfo(session, user)
+
 	// Client wants to know the ServiceVersions of all of the services offered
 	case 0x17:
+		// The client lists the families it knows, which is how ICQ clients can be told apart from AIM clients
+		for {
+			family, err := snac.Data.ReadUint16()
+			if err != nil {
+				break
+			}
+			if _, err := snac.Data.ReadUint16(); err != nil {
+				break
+			}
+			if family == 0x15 {
+				ctx = NewContextWithICQClient(ctx)
+			}
+		}
+
 		versionsSnac := oscar.NewSNAC(0x1, 0x18)
 		for _, service := range ServiceVersions {
 			versionsSnac.Data.WriteUint16(service.Family)
@@ -166,3 +355,56 @@ func (g *GenericServiceControls) HandleSNAC(ctx context.Context, db *bun.DB, sna
 
 	return ctx, nil
 }
+
+// serviceAddress is where clients connect to for a family
+func (g *GenericServiceControls) serviceAddress(family uint16) string {
+	if address, ok := g.ServiceAddresses[family]; ok {
+		return address
+	}
+	return g.BOSAddress
+}
+
+// sendSelfInfo tells the user how other users see them, along with the IP address the server sees them
+// connecting from
+func (g *GenericServiceControls) sendSelfInfo(session *oscar.Session, user *models.User) error {
+	// Service connections ask too, but only the BOS session knows the user's sign on and idle time
+	bosSession := g.Sessions.GetSession(user.ScreenName)
+	if bosSession == nil {
+		bosSession = session
+	}
+
+	tlvs := UserInfoTLVs(user, bosSession)
+	if tcpAddr, ok := session.RemoteAddr().(*net.TCPAddr); ok && tcpAddr.IP.To4() != nil {
+		tlvs = append(tlvs, oscar.NewTLV(0x0a, tcpAddr.IP.To4())) // External IP
+	}
+
+	onlineSnac := oscar.NewSNAC(0x1, 0xf)
+	onlineSnac.Data.WriteLPString(user.ScreenName)
+	onlineSnac.Data.WriteUint16(user.CurrentWarningLevel())
+	onlineSnac.AppendTLVs(tlvs)
+
+	onlineFlap := oscar.NewFLAP(2)
+	onlineFlap.Data.WriteBinary(onlineSnac)
+	return session.Send(onlineFlap)
+}
+
+// deliverOfflineMessages sends the user the messages that were stored while they were offline, oldest first
+func (g *GenericServiceControls) deliverOfflineMessages(ctx context.Context, db *bun.DB, user *models.User) error {
+	if g.OfflineMessageExpiry > 0 {
+		if _, err := models.DeleteExpiredMessages(ctx, db, user.ScreenName, time.Now().Add(-g.OfflineMessageExpiry)); err != nil {
+			return err
+		}
+	}
+
+	messages, err := models.UndeliveredMessages(ctx, db, user.ScreenName)
+	if err != nil {
+		return err
+	}
+
+	for _, message := range messages {
+		message.Offline = true
+		g.CommCh <- message
+	}
+
+	return nil
+}
@@ -0,0 +1,82 @@
+package services
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"context"
+	"testing"
+
+	"golang.org/x/exp/slog"
+)
+
+func TestClientReadyOnServiceConnection(t *testing.T) {
+	onlineCh := make(chan *models.User, 1)
+	g := &GenericServiceControls{OnlineCh: onlineCh}
+
+	// A BART connection saying it's ready mustn't sign the user on again or touch their offline messages. There's
+	// no DB, so delivering them would fail the test.
+	ctx := oscar.NewContextWithSession(context.Background(), nil, slog.Default())
+	session, _ := oscar.SessionFromContext(ctx)
+	session.Family = 0x10
+
+	user := &models.User{ScreenName: "toof", Status: models.UserStatusOnline}
+	ctx = models.NewContextWithUser(ctx, user)
+
+	if _, err := g.HandleSNAC(ctx, nil, oscar.NewSNAC(0x01, 0x02)); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-onlineCh:
+		t.Fatal("expected a service connection not to announce the user again")
+	default:
+	}
+}
+
+func TestClientReadyOnICQClient(t *testing.T) {
+	onlineCh := make(chan *models.User, 1)
+	commCh := make(chan *models.Message, 1)
+	g := &GenericServiceControls{OnlineCh: onlineCh, CommCh: commCh}
+
+	versions := func(c *testClient, families ...uint16) context.Context {
+		snac := oscar.NewSNAC(0x01, 0x17)
+		for _, family := range families {
+			snac.Data.WriteUint16(family)
+			snac.Data.WriteUint16(1)
+		}
+		ctx, err := g.HandleSNAC(c.ctx, nil, snac)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ctx
+	}
+
+	aim := newTestClient(t, "toof")
+	if ICQClientFromContext(versions(aim, 0x01, 0x04, 0x13)) {
+		t.Error("expected a client without family 0x15 not to be an ICQ client")
+	}
+
+	// ICQ clients get their offline messages from 0x15/0x02. There's no DB, so delivering them here too would
+	// fail the test.
+	icq := newTestClient(t, "100001")
+	icq.session.Family = 0
+	icq.user.Status = models.UserStatusOnline
+	ctx := versions(icq, 0x01, 0x04, 0x13, 0x15)
+	if !ICQClientFromContext(ctx) {
+		t.Fatal("expected a client with family 0x15 to be an ICQ client")
+	}
+
+	if _, err := g.HandleSNAC(ctx, nil, oscar.NewSNAC(0x01, 0x02)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-onlineCh:
+	default:
+		t.Error("expected the ICQ client to be signed on")
+	}
+	select {
+	case message := <-commCh:
+		t.Errorf("expected offline messages to be left for 0x15/0x02, got %s", message)
+	default:
+	}
+}
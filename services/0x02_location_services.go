@@ -6,14 +6,23 @@ import (
 	"aim-oscar/oscar"
 	"aim-oscar/util"
 	"context"
-	"time"
+	"encoding/binary"
 
 	"github.com/pkg/errors"
 	"github.com/uptrace/bun"
 )
 
+// Flags newer clients send in 0x02/0x15 for the parts of a user's info they want
+const (
+	UserInfoFlagProfile      = 0x00000001
+	UserInfoFlagAwayMessage  = 0x00000002
+	UserInfoFlagCapabilities = 0x00000004
+	UserInfoFlagCertificates = 0x00000008
+)
+
 type LocationServices struct {
 	OnlineCh chan *models.User
+	Sessions SessionFinder
 }
 
 func (s *LocationServices) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
@@ -62,6 +71,16 @@ func (s *LocationServices) HandleSNAC(ctx context.Context, db *bun.DB, snac *osc
 			user.AwayMessageEncoding = string(awayMessageMimeTLV.Data)
 		}
 
+		// The client lists the features it supports, other users see them in the user's info
+		if capabilitiesTLV := oscar.FindTLV(tlvs, 0x5); capabilitiesTLV != nil {
+			capabilities, err := oscar.ParseCapabilities(capabilitiesTLV.Data)
+			if err != nil {
+				return ctx, err
+			}
+			session.SetCapabilities(capabilities)
+			session.Logger.Debug("set capabilities", "screen_name", user.ScreenName, "capabilities", capabilities)
+		}
+
 		profileTLV := oscar.FindTLV(tlvs, 0x2)
 		if profileTLV != nil {
 			profileMimeTLV := oscar.FindTLV(tlvs, 0x1)
@@ -72,13 +91,15 @@ func (s *LocationServices) HandleSNAC(ctx context.Context, db *bun.DB, snac *osc
 			user.ProfileEncoding = string(profileMimeTLV.Data)
 		}
 
-		if user.AwayMessage == "" {
-			user.Status = models.UserStatusOnline
-		} else {
+		// Setting an away message only changes the status between Online and Away, so it doesn't undo an
+		// extended status set with 0x01/0x1E
+		if user.AwayMessage != "" && user.Status == models.UserStatusOnline {
 			user.Status = models.UserStatusAway
+		} else if user.AwayMessage == "" && user.Status == models.UserStatusAway {
+			user.Status = models.UserStatusOnline
 		}
 
-		if err := user.Update(ctx, db, "away_message", "away_message_encoding", "profile", "profile_encoding"); err != nil {
+		if err := user.Update(ctx, db, "status", "away_message", "away_message_encoding", "profile", "profile_encoding"); err != nil {
 			return ctx, errors.Wrap(err, "could not set away message")
 		}
 
@@ -88,6 +109,11 @@ func (s *LocationServices) HandleSNAC(ctx context.Context, db *bun.DB, snac *osc
 
 	// Client is asking for user information like profile, away message, online state
 	case 0x5:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
 		requestType, err := snac.Data.ReadUint16()
 		if err != nil {
 			return ctx, errors.Wrap(err, "missing request type")
@@ -100,70 +126,242 @@ func (s *LocationServices) HandleSNAC(ctx context.Context, db *bun.DB, snac *osc
 
 		session.Logger.Debug("requesting profile", "requested_screen_name", requestedScreenName, "requestType", requestType)
 
-		requestedUser, err := models.UserByScreenName(ctx, db, requestedScreenName)
+		// Each legacy request type asks for one part of the user's info, Request Type 2 = online status only
+		var flags uint32
+		switch requestType {
+		case 1:
+			flags = UserInfoFlagProfile
+		case 3:
+			flags = UserInfoFlagAwayMessage
+		case 4:
+			flags = UserInfoFlagCapabilities
+		}
+
+		return ctx, s.sendUserInfo(ctx, db, session, snac.Header.RequestID, user, requestedScreenName, flags)
+
+	// Client wants to set their directory info
+	case 0x09:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		tlvs, err := oscar.UnmarshalTLVs(snac.Data.Bytes())
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not unmarshal directory info tlvs")
+		}
+
+		info, err := s.directoryInfo(ctx, db, user)
 		if err != nil {
-			return ctx, aimerror.FetchingUser(err, requestedScreenName)
+			return ctx, err
+		}
+		for _, field := range directoryFields(info) {
+			if tlv := oscar.FindTLV(tlvs, field.tlvType); tlv != nil {
+				*field.value = string(tlv.Data)
+			}
+		}
+
+		// TLV 0x1A is whether the user can be found in directory searches
+		if searchableTLV := oscar.FindTLV(tlvs, 0x1a); searchableTLV != nil && len(searchableTLV.Data) == 2 {
+			info.Searchable = binary.BigEndian.Uint16(searchableTLV.Data) != 0
 		}
 
-		if requestedUser == nil {
-			noMatchSnac := oscar.NewSNAC(0x2, 1)
-			noMatchSnac.Data.WriteUint16(0x14) // error code 0x14: No Match
-			noMatchFlap := oscar.NewFLAP(2)
-			noMatchFlap.Data.WriteBinary(noMatchSnac)
-			session.Send(noMatchFlap)
-			return ctx, nil
+		if err := info.Save(ctx, db); err != nil {
+			return ctx, err
 		}
 
-		respSnac := oscar.NewSNAC(2, 6)
-		respSnac.Data.WriteLPString(requestedUser.ScreenName)
-		respSnac.Data.WriteUint16(0) // TODO: warning level
+		replySnac := oscar.NewSNAC(0x02, 0x0a)
+		replySnac.Header.RequestID = snac.Header.RequestID
+		replySnac.Data.WriteUint16(1) // Success
+		return ctx, sendSNAC(session, replySnac)
 
-		tlvs := []*oscar.TLV{
-			oscar.NewTLV(1, util.Dword(0)),                                                             // user class
-			oscar.NewTLV(6, util.Dword(uint32(requestedUser.Status))),                                  // user status
-			oscar.NewTLV(0x0a, util.Dword(0)),                                                          // user external IP
-			oscar.NewTLV(0x0f, util.Dword(uint32(time.Since(requestedUser.LastActivityAt).Seconds()))), // idle time
-			oscar.NewTLV(0x03, util.Dword(uint32(time.Now().Unix()))),                                  // TODO: signon time
-			oscar.NewTLV(0x05, util.Dword(uint32(requestedUser.CreatedAt.Unix()))),                     // member since
+	// Client wants a user's directory info
+	case 0x0b:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
 		}
 
-		// General info (Profile)
-		if requestType == 1 {
-			tlvs = append(tlvs, oscar.NewTLV(1, util.LPUint16String(requestedUser.ProfileEncoding)))
-			tlvs = append(tlvs, oscar.NewTLV(2, util.LPUint16String(requestedUser.Profile)))
+		screenName, err := snac.Data.ReadLPString()
+		if err != nil {
+			return ctx, errors.Wrap(err, "missing requested screen_name")
 		}
 
-		// Request Type 2 = online status, no TLVs
+		replySnac := oscar.NewSNAC(0x02, 0x0c)
+		replySnac.Header.RequestID = snac.Header.RequestID
+		replySnac.Data.WriteUint16(1)
 
-		// Away message
-		if requestType == 3 {
-			tlvs = append(tlvs, oscar.NewTLV(3, util.LPUint16String(requestedUser.AwayMessageEncoding)))
-			tlvs = append(tlvs, oscar.NewTLV(4, util.LPUint16String(requestedUser.AwayMessage)))
+		// Users who don't exist, haven't filled out their info or are hiding from the user have an empty entry
+		var tlvs []*oscar.TLV
+		requestedUser, err := models.UserByScreenName(ctx, db, screenName)
+		if err != nil {
+			return ctx, aimerror.FetchingUser(err, screenName)
 		}
+		if requestedUser != nil {
+			canSee, err := CanSee(ctx, db, requestedUser, user)
+			if err != nil {
+				return ctx, err
+			}
 
-		// TODO: Request Type 4 - User capabilities
+			info, err := models.DirectoryInfoForUser(ctx, db, requestedUser.UIN)
+			if err != nil {
+				return ctx, err
+			}
 
-		respSnac.AppendTLVs(tlvs)
+			if canSee && info != nil {
+				tlvs = DirectoryInfoTLVs(info)
+			}
+		}
+
+		replySnac.AppendTLVs(tlvs)
+		return ctx, sendSNAC(session, replySnac)
+
+	// Client wants to set their interests, each one is a TLV 0x0B
+	case 0x0f:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		tlvs, err := oscar.UnmarshalTLVs(snac.Data.Bytes())
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not unmarshal interest tlvs")
+		}
 
-		respFlap := oscar.NewFLAP(2)
-		respFlap.Data.WriteBinary(respSnac)
+		info, err := s.directoryInfo(ctx, db, user)
+		if err != nil {
+			return ctx, err
+		}
+		info.Interests = []string{}
+		for _, tlv := range tlvs {
+			if tlv.Type == 0x0b && len(tlv.Data) > 0 {
+				info.Interests = append(info.Interests, string(tlv.Data))
+			}
+		}
+		if err := info.Save(ctx, db); err != nil {
+			return ctx, err
+		}
 
-		return ctx, session.Send(respFlap)
+		replySnac := oscar.NewSNAC(0x02, 0x10)
+		replySnac.Header.RequestID = snac.Header.RequestID
+		replySnac.Data.WriteUint16(1) // Success
+		return ctx, sendSNAC(session, replySnac)
 
-	case 0xb:
-		/* Nobody seems to know what this client request is for
-		- http://iserverd.khstu.ru/oscar/snac_02_0b.html
-		- https://bugs.bitlbee.org/browser/protocols/oscar/info.c?rev=b7d3cc34f68dab7b8f7d0777711317b334fc2219#L572
+	// Newer clients ask for the parts of a user's info they want with flags
+	case 0x15:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		flags, err := snac.Data.ReadUint32()
+		if err != nil {
+			return ctx, errors.Wrap(err, "missing user info flags")
+		}
+
+		requestedScreenName, err := snac.Data.ReadLPString()
+		if err != nil {
+			return ctx, errors.Wrap(err, "missing requested screen_name")
+		}
+
+		session.Logger.Debug("requesting user info", "requested_screen_name", requestedScreenName, "flags", flags)
+
+		return ctx, s.sendUserInfo(ctx, db, session, snac.Header.RequestID, user, requestedScreenName, flags)
 
-		But the one dump that exists looks like a TLV 0x1 with empty data
-		*/
-		unknownSnac := oscar.NewSNAC(2, 0xc)
-		unknownSnac.Data.WriteUint16(1)
-		unknownSnac.Data.WriteUint16(0)
-		unknownFlap := oscar.NewFLAP(2)
-		unknownFlap.Data.WriteBinary(unknownSnac)
-		return ctx, session.Send(unknownFlap)
 	}
 
 	return ctx, nil
 }
+
+// sendUserInfo answers a request for a user's info with the parts asked for in flags
+func (s *LocationServices) sendUserInfo(ctx context.Context, db *bun.DB, session *oscar.Session, requestID uint32, user *models.User, requestedScreenName string, flags uint32) error {
+	requestedUser, err := models.UserByScreenName(ctx, db, requestedScreenName)
+	if err != nil {
+		return aimerror.FetchingUser(err, requestedScreenName)
+	}
+
+	if requestedUser == nil {
+		return sendSNACError(session, 0x2, 0x14) // error code 0x14: No Match
+	}
+
+	// Users who are blocked by the requested user's permit/deny settings or who they're invisible to can't
+	// look them up
+	canSee, err := IsVisibleTo(ctx, db, requestedUser, user)
+	if err != nil {
+		return err
+	}
+	if !canSee {
+		return sendSNACError(session, 0x2, 0x04) // error code 0x04: Recipient not logged in
+	}
+
+	requestedSession := s.Sessions.GetSession(requestedUser.ScreenName)
+
+	respSnac := oscar.NewSNAC(2, 6)
+	respSnac.Header.RequestID = requestID
+	WriteUserInfo(&respSnac.Data, requestedUser, requestedSession)
+
+	// General info (Profile)
+	if flags&UserInfoFlagProfile != 0 {
+		respSnac.Data.WriteBinary(oscar.NewTLV(1, util.LPUint16String(requestedUser.ProfileEncoding)))
+		respSnac.Data.WriteBinary(oscar.NewTLV(2, util.LPUint16String(requestedUser.Profile)))
+	}
+
+	// Away message
+	if flags&UserInfoFlagAwayMessage != 0 {
+		respSnac.Data.WriteBinary(oscar.NewTLV(3, util.LPUint16String(requestedUser.AwayMessageEncoding)))
+		respSnac.Data.WriteBinary(oscar.NewTLV(4, util.LPUint16String(requestedUser.AwayMessage)))
+	}
+
+	// User capabilities
+	if flags&UserInfoFlagCapabilities != 0 && requestedSession != nil {
+		respSnac.Data.WriteBinary(oscar.NewTLV(5, oscar.MarshalCapabilities(requestedSession.Capabilities())))
+	}
+
+	// Nobody has certificates, UserInfoFlagCertificates gets nothing extra
+
+	return sendSNAC(session, respSnac)
+}
+
+// directoryInfo returns the user's directory info so parts of it can be changed
+func (s *LocationServices) directoryInfo(ctx context.Context, db *bun.DB, user *models.User) (*models.DirectoryInfo, error) {
+	info, err := models.DirectoryInfoForUser(ctx, db, user.UIN)
+	if err != nil {
+		return nil, err
+	}
+	if info == nil {
+		info = models.NewDirectoryInfo(user)
+	}
+	return info, nil
+}
+
+type directoryField struct {
+	tlvType uint16
+	value   *string
+}
+
+// directoryFields pairs the TLVs clients use for directory info with where they're kept
+func directoryFields(info *models.DirectoryInfo) []directoryField {
+	return []directoryField{
+		{0x01, &info.FirstName},
+		{0x02, &info.LastName},
+		{0x03, &info.MiddleName},
+		{0x04, &info.MaidenName},
+		{0x06, &info.Country},
+		{0x07, &info.State},
+		{0x08, &info.City},
+		{0x0c, &info.Nickname},
+		{0x0d, &info.Zip},
+		{0x21, &info.Street},
+	}
+}
+
+// DirectoryInfoTLVs are the TLVs for the parts of a user's directory info they filled out
+func DirectoryInfoTLVs(info *models.DirectoryInfo) []*oscar.TLV {
+	var tlvs []*oscar.TLV
+	for _, field := range directoryFields(info) {
+		if *field.value != "" {
+			tlvs = append(tlvs, oscar.NewTLV(field.tlvType, []byte(*field.value)))
+		}
+	}
+	return tlvs
+}
@@ -8,15 +8,49 @@ import (
 	"context"
 	"encoding/binary"
 	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/pkg/errors"
 	"github.com/uptrace/bun"
 )
 
 type ICBM struct {
-	CommCh chan *models.Message
+	CommCh   chan *models.Message
+	OnlineCh chan *models.User
+	Sessions SessionFinder
+
+	// MaxOfflineMessages is how many stored messages can be waiting for an offline user, 0 means no limit
+	MaxOfflineMessages int
+
+	// ICBM parameters each signed on user's client asked for, which matter when delivering things to them
+	channels map[string]*channel
+	// When each sender can next message each recipient, for the recipient's minimum message interval
+	nextMessages map[string]time.Time
+	// When each away user can next auto-respond to each sender, so two away users don't keep answering each other
+	nextAutoResponses map[string]time.Time
+	// Until when each recipient can warn each sender who messaged them
+	warnableUntil map[string]time.Time
+	lastPrune     time.Time
+	mutex         sync.RWMutex
 }
 
+// autoResponseInterval is how long an away user waits before auto-responding to the same sender again
+const autoResponseInterval = 5 * time.Minute
+
+// warnWindow is how long a user can warn someone after getting a message from them. Users can't warn people who
+// never messaged them.
+const warnWindow = 10 * time.Minute
+
+// pruneInterval is how often sender/recipient pairs that have waited long enough are forgotten
+const pruneInterval = time.Minute
+
+// maxMessageSnacSize is the biggest message SNAC the protocol allows. Messages for offline users are checked
+// against it, since there's no client whose limit applies.
+const maxMessageSnacSize = 8000
+
 type icbmKey string
 
 func (s icbmKey) String() string {
@@ -39,6 +73,13 @@ func ChannelFromContext(ctx context.Context) *channel {
 	return s.(*channel)
 }
 
+// ICBM parameter message flags
+const (
+	ChannelFlagChannelMessages     = 0x00000001
+	ChannelFlagMissedCalls         = 0x00000002
+	ChannelFlagTypingNotifications = 0x00000008
+)
+
 type channel struct {
 	MaxSlots                uint16
 	MessageFlags            uint32
@@ -48,6 +89,16 @@ type channel struct {
 	MinimumMessageInterval  uint32
 }
 
+// defaultChannel are the ICBM parameters of clients that never set their own
+var defaultChannel = channel{
+	MaxSlots:                100,
+	MessageFlags:            3,
+	MaxMessageSnacSize:      512,
+	MaxSenderWarningLevel:   999,
+	MaxReceiverWarningLevel: 999,
+	MinimumMessageInterval:  0,
+}
+
 func (icbm *ICBM) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
 	session, _ := oscar.SessionFromContext(ctx)
 	logger := session.Logger.With("service", "icbm")
@@ -73,25 +124,22 @@ func (icbm *ICBM) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC)
 
 		logger.Debug("got channel", "channel", channel)
 
+		if user := models.UserFromContext(ctx); user != nil {
+			icbm.setChannel(user.ScreenName, channel)
+		}
+
 		newCtx := NewContextWithChannel(ctx, channel)
 		return newCtx, nil
 
 	// Client asks about the ICBM capabilities we set for them
 	case 0x04:
-		// c := ChannelFromContext(ctx)
-		// if c == nil {
-		c := &channel{
-			MaxSlots:                100,
-			MessageFlags:            3,
-			MaxMessageSnacSize:      512,
-			MaxSenderWarningLevel:   999,
-			MaxReceiverWarningLevel: 999,
-			MinimumMessageInterval:  0,
-		}
-		// }
+		c := ChannelFromContext(ctx)
+		if c == nil {
+			c = &defaultChannel
+		}
 
 		channelSnac := oscar.NewSNAC(0x4, 0x5)
-		channelSnac.Data.WriteUint16(100)
+		channelSnac.Data.WriteUint16(c.MaxSlots)
 		channelSnac.Data.WriteUint32(c.MessageFlags)
 		channelSnac.Data.WriteUint16(c.MaxMessageSnacSize)
 		channelSnac.Data.WriteUint16(c.MaxSenderWarningLevel)
@@ -115,16 +163,21 @@ func (icbm *ICBM) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC)
 		msgChannel, _ := snac.Data.ReadUint16()
 		to, _ := snac.Data.ReadLPString()
 
-		if msgChannel != 1 {
-			logger.Warn(fmt.Sprintf("Message for unsupported channel %d", msgChannel))
-			return ctx, nil
-		}
-
 		tlvs, err := oscar.UnmarshalTLVs(snac.Data.Bytes())
 		if err != nil {
 			return ctx, errors.Wrap(err, "could not unmarshal message tlvs")
 		}
 
+		// Channel 2 is rendezvous: file transfers, direct IM and chat invites
+		if msgChannel == 2 {
+			return ctx, icbm.relayRendezvous(ctx, db, session, user, msgID, to, tlvs)
+		}
+
+		if msgChannel != 1 {
+			logger.Warn(fmt.Sprintf("Message for unsupported channel %d", msgChannel))
+			return ctx, nil
+		}
+
 		messageTLV := oscar.FindTLV(tlvs, 0x2)
 		if messageTLV == nil {
 			return ctx, errors.New("missing messageTLV 0x2")
@@ -188,38 +241,215 @@ func (icbm *ICBM) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC)
 			return ctx, errors.New("read insufficient data from message fragment")
 		}
 
+		// Recipients who have blocked the sender look like they're offline
+		recipient, err := models.UserByScreenName(ctx, db, to)
+		if err != nil {
+			return ctx, aimerror.FetchingUser(err, to)
+		}
+		if recipient != nil {
+			canSee, err := CanSee(ctx, db, recipient, user)
+			if err != nil {
+				return ctx, err
+			}
+			if !canSee {
+				logger.Info("recipient blocked message", "screen_name", user.ScreenName, "to", to)
+				return ctx, sendSNACError(session, 0x04, 0x04) // error code 0x04: Recipient not logged in
+			}
+		}
+
+		online := icbm.Sessions.GetSession(to) != nil
+		if code := icbm.checkMessage(ctx, user, recipient, to, online, len(messageTLV.Data), time.Now()); code != 0 {
+			logger.Info("message not allowed by ICBM parameters", "screen_name", user.ScreenName, "to", to, "error_code", code)
+			return ctx, sendSNACError(session, 0x04, code)
+		}
+
+		// TLV 0x4 marks an away client's automatic reply. The server may have already sent one for the user.
+		autoResponse := oscar.FindTLV(tlvs, 4) != nil
+		if autoResponse && !icbm.AllowAutoResponse(user.ScreenName, to, time.Now()) {
+			logger.Debug("dropping auto-response", "screen_name", user.ScreenName, "to", to)
+			return ctx, ackMessage(session, tlvs, msgID, user.ScreenName)
+		}
+
+		// The recipient can now warn the sender for the message, but not for an away message
+		if recipient != nil && online && !autoResponse {
+			icbm.allowWarn(recipient.ScreenName, user.ScreenName, time.Now())
+		}
+
 		var message *models.Message
 
 		// TLV 0x6 is the client telling the server to store the message if the recipient is offline
 		saveofflineTLV := oscar.FindTLV(tlvs, 6)
-		if saveofflineTLV != nil {
+		if saveofflineTLV != nil && !autoResponse {
+			// Once an offline user has too many messages waiting, the sender is told they're offline instead
+			if icbm.MaxOfflineMessages > 0 && !online {
+				waiting, err := models.CountUndeliveredMessages(ctx, db, to)
+				if err != nil {
+					return ctx, err
+				}
+				if waiting >= icbm.MaxOfflineMessages {
+					logger.Info("recipient has too many stored messages", "screen_name", user.ScreenName, "to", to, "waiting", waiting)
+					return ctx, sendSNACError(session, 0x04, 0x04) // error code 0x04: Recipient not logged in
+				}
+			}
+
 			message, err = models.InsertMessage(ctx, db, msgID, user.ScreenName, to, string(messageContents))
 			if err != nil {
 				return ctx, errors.Wrap(err, "could not insert message")
 			}
 		} else {
 			message = &models.Message{
-				Cookie:   msgID,
-				From:     user.ScreenName,
-				To:       to,
-				Contents: string(messageContents),
+				Cookie:       msgID,
+				From:         user.ScreenName,
+				To:           to,
+				Contents:     string(messageContents),
+				AutoResponse: autoResponse,
 			}
 		}
 
 		// Fire the message off into the communication channel to get delivered
 		icbm.CommCh <- message
 
-		// The Client usually wants a response that the server got the message. It checks that the message
-		// back has the same message ID that was sent and the user it was sent to.
-		ackTLV := oscar.FindTLV(tlvs, 3)
-		if ackTLV != nil {
-			ackSnac := oscar.NewSNAC(4, 0xc)
-			ackSnac.Data.WriteUint64(msgID)
-			ackSnac.Data.WriteUint16(2)
-			ackSnac.Data.WriteLPString(user.ScreenName)
-			ackFlap := oscar.NewFLAP(2)
-			ackFlap.Data.WriteBinary(ackSnac)
-			return ctx, session.Send(ackFlap)
+		return ctx, ackMessage(session, tlvs, msgID, user.ScreenName)
+
+	// Client wants to warn (evil) another user
+	case 0x08:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		flags, err := snac.Data.ReadUint16()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read warning flags")
+		}
+		anonymous := flags&0x0001 == 0x0001
+
+		screenName, err := snac.Data.ReadLPString()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read screen name to warn")
+		}
+
+		if screenName == user.ScreenName {
+			return ctx, sendSNACError(session, 0x04, 0x0d) // error code 0x0d: Request denied
+		}
+
+		target, err := models.UserByScreenName(ctx, db, screenName)
+		if err != nil {
+			return ctx, aimerror.FetchingUser(err, screenName)
+		}
+
+		// Only users who are signed on and can see the warner can be warned
+		targetSession := icbm.Sessions.GetSession(screenName)
+		if target == nil || targetSession == nil {
+			return ctx, sendSNACError(session, 0x04, 0x04) // error code 0x04: Recipient not logged in
+		}
+
+		canSee, err := IsVisibleTo(ctx, db, target, user)
+		if err != nil {
+			return ctx, err
+		}
+		if !canSee {
+			return ctx, sendSNACError(session, 0x04, 0x04)
+		}
+
+		// Each message the user got from the target lets them warn the target once
+		if !icbm.useWarn(user.ScreenName, target.ScreenName, time.Now()) {
+			logger.Info("refusing warn without a recent message from the warned user", "screen_name", user.ScreenName, "warned", target.ScreenName)
+			return ctx, sendSNACError(session, 0x04, 0x0d) // error code 0x0d: Request denied
+		}
+
+		delta, err := target.Warn(ctx, db, anonymous)
+		if err != nil {
+			return ctx, err
+		}
+
+		logger.Info("warned user", "screen_name", user.ScreenName, "warned", target.ScreenName, "anonymous", anonymous, "warning_level", target.WarningLevel)
+
+		// Tell the warned user about their new warning level, and who warned them unless it was anonymous
+		warnedSnac := oscar.NewSNAC(0x01, 0x10)
+		warnedSnac.Data.WriteUint16(target.WarningLevel)
+		if !anonymous {
+			WriteUserInfo(&warnedSnac.Data, user, session)
+		}
+		warnedFlap := oscar.NewFLAP(2)
+		warnedFlap.Data.WriteBinary(warnedSnac)
+		if err := targetSession.Send(warnedFlap); err != nil {
+			logger.Error("could not tell user they were warned", "warned", target.ScreenName, "err", err.Error())
+		}
+
+		// Let the target's buddies know about the new warning level
+		icbm.OnlineCh <- target
+
+		warnSnac := oscar.NewSNAC(0x04, 0x09)
+		warnSnac.Header.RequestID = snac.Header.RequestID
+		warnSnac.Data.WriteUint16(delta)
+		warnSnac.Data.WriteUint16(target.WarningLevel)
+		warnFlap := oscar.NewFLAP(2)
+		warnFlap.Data.WriteBinary(warnSnac)
+		return ctx, session.Send(warnFlap)
+
+	// Client tells someone they're typing
+	case 0x14:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		cookie, err := snac.Data.ReadUint64()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read typing cookie")
+		}
+
+		msgChannel, err := snac.Data.ReadUint16()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read typing channel")
+		}
+
+		to, err := snac.Data.ReadLPString()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read typing recipient")
+		}
+
+		// 0 when the user stopped typing, 1 when they typed and paused, 2 when they're typing
+		event, err := snac.Data.ReadUint16()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read typing event")
+		}
+
+		// Only clients that asked for typing notifications get them
+		c := icbm.channelFor(to)
+		if c == nil || c.MessageFlags&ChannelFlagTypingNotifications == 0 {
+			return ctx, nil
+		}
+
+		recipientSession := icbm.Sessions.GetSessionForFamily(to, 0x04)
+		if recipientSession == nil {
+			return ctx, nil
+		}
+
+		// Typing doesn't show through the recipient's privacy settings
+		recipient, err := models.UserByScreenName(ctx, db, to)
+		if err != nil {
+			return ctx, aimerror.FetchingUser(err, to)
+		}
+		if recipient == nil {
+			return ctx, nil
+		}
+		canSee, err := CanSee(ctx, db, recipient, user)
+		if err != nil {
+			return ctx, err
+		}
+		if !canSee {
+			return ctx, nil
+		}
+
+		typingSnac := oscar.NewSNAC(0x04, 0x14)
+		typingSnac.Data.WriteUint64(cookie)
+		typingSnac.Data.WriteUint16(msgChannel)
+		typingSnac.Data.WriteLPString(user.ScreenName)
+		typingSnac.Data.WriteUint16(event)
+		if err := sendSNAC(recipientSession, typingSnac); err != nil {
+			logger.Error("could not send typing notification", "screen_name", user.ScreenName, "to", to, "err", err.Error())
 		}
 
 		return ctx, nil
@@ -227,3 +457,263 @@ func (icbm *ICBM) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC)
 
 	return ctx, nil
 }
+
+// ackMessage sends the client a response that the server got their message if they asked for one with TLV
+// 0x3. It checks that the message back has the same message ID that was sent and the user it was sent to.
+func ackMessage(session *oscar.Session, tlvs []*oscar.TLV, msgID uint64, screen_name string) error {
+	if oscar.FindTLV(tlvs, 3) == nil {
+		return nil
+	}
+
+	ackSnac := oscar.NewSNAC(4, 0xc)
+	ackSnac.Data.WriteUint64(msgID)
+	ackSnac.Data.WriteUint16(2)
+	ackSnac.Data.WriteLPString(screen_name)
+	return sendSNAC(session, ackSnac)
+}
+
+// relayRendezvous passes a channel 2 ICBM on to the recipient. Rendezvous messages aren't stored, the
+// recipient has to be signed on for the peers to connect to each other.
+func (icbm *ICBM) relayRendezvous(ctx context.Context, db *bun.DB, session *oscar.Session, user *models.User, msgID uint64, to string, tlvs []*oscar.TLV) error {
+	rendezvousTLV := oscar.FindTLV(tlvs, 0x05)
+	if rendezvousTLV == nil {
+		return errors.New("missing rendezvous TLV 0x5")
+	}
+
+	recipient, err := models.UserByScreenName(ctx, db, to)
+	if err != nil {
+		return aimerror.FetchingUser(err, to)
+	}
+	if recipient == nil || icbm.Sessions.GetSessionForFamily(to, 0x04) == nil {
+		return sendSNACError(session, 0x04, 0x04) // error code 0x04: Recipient not logged in
+	}
+
+	canSee, err := CanSee(ctx, db, recipient, user)
+	if err != nil {
+		return err
+	}
+	if !canSee {
+		return sendSNACError(session, 0x04, 0x04)
+	}
+
+	// Don't propose a kind of rendezvous the recipient's client can't handle
+	capability, err := rendezvousCapability(rendezvousTLV.Data)
+	if err != nil {
+		return err
+	}
+	if !Supports(icbm.Sessions, to, capability) {
+		return sendSNACError(session, 0x04, 0x09) // error code 0x09: Not supported by client
+	}
+
+	data, err := rewriteRendezvous(rendezvousTLV.Data, session.RemoteAddr())
+	if err != nil {
+		return err
+	}
+
+	icbm.CommCh <- &models.Message{
+		Cookie:  msgID,
+		From:    user.ScreenName,
+		To:      to,
+		Channel: 2,
+		Data:    data,
+	}
+
+	return ackMessage(session, tlvs, msgID, user.ScreenName)
+}
+
+// rendezvousCapability returns the capability for the kind of rendezvous in a rendezvous block, which comes
+// after its type and cookie
+func rendezvousCapability(data []byte) (oscar.Capability, error) {
+	var c oscar.Capability
+	if len(data) < 2+8+16 {
+		return c, errors.New("rendezvous block is too short for its capability")
+	}
+	copy(c[:], data[2+8:])
+	return c, nil
+}
+
+// rewriteRendezvous sets the verified IP (TLV 0x4) in a rendezvous block to the address the server sees the
+// sender connecting from. Peers behind NAT only know their internal address (TLV 0x3).
+func rewriteRendezvous(data []byte, addr net.Addr) ([]byte, error) {
+	buf := oscar.Buffer{}
+	buf.Write(data)
+
+	// Rendezvous type (propose, cancel, accept), cookie and the capability for the kind of rendezvous
+	header, err := buf.ReadBytes(2 + 8 + 16)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read rendezvous header")
+	}
+
+	tlvs, err := oscar.UnmarshalTLVs(buf.Bytes())
+	if err != nil {
+		return nil, errors.Wrap(err, "could not unmarshal rendezvous tlvs")
+	}
+
+	var ip net.IP
+	if tcpAddr, ok := addr.(*net.TCPAddr); ok {
+		ip = tcpAddr.IP.To4()
+	}
+
+	rewritten := oscar.Buffer{}
+	rewritten.Write(header)
+	for _, tlv := range tlvs {
+		if tlv.Type == 0x04 {
+			continue
+		}
+		rewritten.WriteBinary(tlv)
+	}
+	if ip != nil {
+		rewritten.WriteBinary(oscar.NewTLV(0x04, ip))
+	}
+
+	return rewritten.Bytes(), nil
+}
+
+// checkMessage makes sure a message fits both the sender's and the recipient's ICBM parameters. Returns the
+// ICBM error code to send back, or 0 if the message can be sent.
+func (icbm *ICBM) checkMessage(ctx context.Context, sender *models.User, recipient *models.User, to string, online bool, size int, now time.Time) uint16 {
+	senderChannel := ChannelFromContext(ctx)
+	if senderChannel == nil {
+		senderChannel = &defaultChannel
+	}
+
+	recipientChannel := icbm.channelFor(to)
+	if recipientChannel == nil {
+		c := defaultChannel
+		if !online {
+			c.MaxMessageSnacSize = maxMessageSnacSize
+		}
+		recipientChannel = &c
+	}
+
+	if recipientChannel.MaxMessageSnacSize > 0 && size > int(recipientChannel.MaxMessageSnacSize) {
+		return 0x0e // error code 0x0e: Incorrect SNAC format
+	}
+
+	if sender.CurrentWarningLevel() > recipientChannel.MaxSenderWarningLevel {
+		return 0x11 // error code 0x11: Sender too evil
+	}
+
+	if recipient != nil && recipient.CurrentWarningLevel() > senderChannel.MaxReceiverWarningLevel {
+		return 0x12 // error code 0x12: Receiver too evil
+	}
+
+	icbm.mutex.Lock()
+	defer icbm.mutex.Unlock()
+	icbm.prune(now)
+
+	if icbm.nextMessages == nil {
+		icbm.nextMessages = make(map[string]time.Time)
+	}
+
+	pair := sender.ScreenName + ":" + to
+	if next, ok := icbm.nextMessages[pair]; ok && now.Before(next) {
+		return 0x03 // error code 0x03: Client rate limit exceeded
+	}
+	if interval := time.Duration(recipientChannel.MinimumMessageInterval) * time.Millisecond; interval > 0 {
+		icbm.nextMessages[pair] = now.Add(interval)
+	}
+
+	return 0
+}
+
+// AcceptsMessageFrom returns false if the recipient's client doesn't want messages from users with the
+// sender's warning level
+func (icbm *ICBM) AcceptsMessageFrom(to string, sender *models.User) bool {
+	c := icbm.channelFor(to)
+	if c == nil {
+		return true
+	}
+	return sender.CurrentWarningLevel() <= c.MaxSenderWarningLevel
+}
+
+// AllowAutoResponse returns true if the away user hasn't auto-responded to the sender recently, and records
+// that they are now
+func (icbm *ICBM) AllowAutoResponse(from, to string, now time.Time) bool {
+	icbm.mutex.Lock()
+	defer icbm.mutex.Unlock()
+	icbm.prune(now)
+
+	if icbm.nextAutoResponses == nil {
+		icbm.nextAutoResponses = make(map[string]time.Time)
+	}
+
+	pair := from + ":" + to
+	if next, ok := icbm.nextAutoResponses[pair]; ok && now.Before(next) {
+		return false
+	}
+	icbm.nextAutoResponses[pair] = now.Add(autoResponseInterval)
+	return true
+}
+
+// allowWarn lets the recipient of a message warn its sender until warnWindow has passed
+func (icbm *ICBM) allowWarn(recipient, sender string, now time.Time) {
+	icbm.mutex.Lock()
+	defer icbm.mutex.Unlock()
+	icbm.prune(now)
+
+	if icbm.warnableUntil == nil {
+		icbm.warnableUntil = make(map[string]time.Time)
+	}
+	icbm.warnableUntil[recipient+":"+sender] = now.Add(warnWindow)
+}
+
+// useWarn returns true if the warner got a message from the target recently, and uses it up
+func (icbm *ICBM) useWarn(warner, target string, now time.Time) bool {
+	icbm.mutex.Lock()
+	defer icbm.mutex.Unlock()
+
+	pair := warner + ":" + target
+	until, ok := icbm.warnableUntil[pair]
+	delete(icbm.warnableUntil, pair)
+	return ok && now.Before(until)
+}
+
+// SignOff forgets the user's ICBM parameters and every sender/recipient pair they're part of, so nothing carries
+// over into their next session
+func (icbm *ICBM) SignOff(screenName string) {
+	icbm.mutex.Lock()
+	defer icbm.mutex.Unlock()
+
+	delete(icbm.channels, screenName)
+	for _, pairs := range []map[string]time.Time{icbm.nextMessages, icbm.nextAutoResponses, icbm.warnableUntil} {
+		for pair := range pairs {
+			if from, to, _ := strings.Cut(pair, ":"); from == screenName || to == screenName {
+				delete(pairs, pair)
+			}
+		}
+	}
+}
+
+// prune forgets the sender/recipient pairs that have waited long enough, at most once every pruneInterval. The
+// caller holds the mutex.
+func (icbm *ICBM) prune(now time.Time) {
+	if now.Sub(icbm.lastPrune) < pruneInterval {
+		return
+	}
+	icbm.lastPrune = now
+
+	for _, pairs := range []map[string]time.Time{icbm.nextMessages, icbm.nextAutoResponses, icbm.warnableUntil} {
+		for pair, next := range pairs {
+			if !now.Before(next) {
+				delete(pairs, pair)
+			}
+		}
+	}
+}
+
+func (icbm *ICBM) setChannel(screen_name string, c *channel) {
+	icbm.mutex.Lock()
+	if icbm.channels == nil {
+		icbm.channels = make(map[string]*channel)
+	}
+	icbm.channels[screen_name] = c
+	icbm.mutex.Unlock()
+}
+
+// channelFor returns the ICBM parameters a user's client asked for, or nil if it never set any
+func (icbm *ICBM) channelFor(screen_name string) *channel {
+	icbm.mutex.RLock()
+	defer icbm.mutex.RUnlock()
+	return icbm.channels[screen_name]
+}
@@ -0,0 +1,178 @@
+package services
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/util"
+	"bytes"
+	"context"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestCheckMessage(t *testing.T) {
+	icbm := &ICBM{}
+	icbm.setChannel("recipient", &channel{
+		MaxMessageSnacSize:      100,
+		MaxSenderWarningLevel:   500,
+		MaxReceiverWarningLevel: 999,
+		MinimumMessageInterval:  1000,
+	})
+
+	sender := &models.User{ScreenName: "sender"}
+	recipient := &models.User{ScreenName: "recipient"}
+	ctx := context.Background()
+	now := time.Now()
+
+	if code := icbm.checkMessage(ctx, sender, recipient, "recipient", true, 200, now); code != 0x0e {
+		t.Errorf("expected oversized message to be rejected with 0x0e, got 0x%02x", code)
+	}
+
+	if code := icbm.checkMessage(ctx, sender, recipient, "recipient", true, 50, now); code != 0 {
+		t.Errorf("expected message to be allowed, got 0x%02x", code)
+	}
+
+	if code := icbm.checkMessage(ctx, sender, recipient, "recipient", true, 50, now.Add(500*time.Millisecond)); code != 0x03 {
+		t.Errorf("expected message inside the minimum interval to be rejected with 0x03, got 0x%02x", code)
+	}
+
+	sender.WarningLevel = 600
+	sender.WarnedAt = now
+	if code := icbm.checkMessage(ctx, sender, recipient, "recipient", true, 50, now.Add(2*time.Second)); code != 0x11 {
+		t.Errorf("expected evil sender to be rejected with 0x11, got 0x%02x", code)
+	}
+	if icbm.AcceptsMessageFrom("recipient", sender) {
+		t.Error("expected recipient not to accept messages from an evil sender")
+	}
+
+	ctx = NewContextWithChannel(ctx, &channel{MaxReceiverWarningLevel: 100})
+	evil := &models.User{ScreenName: "evil", WarningLevel: 200, WarnedAt: now}
+	if code := icbm.checkMessage(ctx, recipient, evil, "evil", true, 50, now); code != 0x12 {
+		t.Errorf("expected evil recipient to be rejected with 0x12, got 0x%02x", code)
+	}
+}
+
+func TestRewriteRendezvous(t *testing.T) {
+	block := oscar.Buffer{}
+	block.WriteUint16(0)                  // propose
+	block.WriteUint64(0x1122334455667788) // cookie
+	block.Write(make([]byte, 16))         // capability
+	block.WriteBinary(oscar.NewTLV(0x03, []byte{192, 168, 1, 5}))
+	block.WriteBinary(oscar.NewTLV(0x04, []byte{10, 0, 0, 1}))
+	block.WriteBinary(oscar.NewTLV(0x05, util.Word(5190)))
+
+	addr := &net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 40000}
+	data, err := rewriteRendezvous(block.Bytes(), addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data[:26], block.Bytes()[:26]) {
+		t.Fatal("expected rendezvous header to be unchanged")
+	}
+
+	tlvs, err := oscar.UnmarshalTLVs(data[26:])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if ip := oscar.FindTLV(tlvs, 0x03); ip == nil || !bytes.Equal(ip.Data, []byte{192, 168, 1, 5}) {
+		t.Errorf("expected internal IP to be kept, got %v", ip)
+	}
+	if ip := oscar.FindTLV(tlvs, 0x04); ip == nil || !bytes.Equal(ip.Data, []byte{203, 0, 113, 7}) {
+		t.Errorf("expected verified IP to be the observed address, got %v", ip)
+	}
+	if port := oscar.FindTLV(tlvs, 0x05); port == nil {
+		t.Error("expected port to be kept")
+	}
+}
+
+func TestAllowAutoResponse(t *testing.T) {
+	icbm := &ICBM{}
+	now := time.Now()
+
+	if !icbm.AllowAutoResponse("away", "sender", now) {
+		t.Errorf("expected the first auto-response to be allowed")
+	}
+	if icbm.AllowAutoResponse("away", "sender", now.Add(time.Minute)) {
+		t.Errorf("expected a second auto-response to the same sender to be held back")
+	}
+	if !icbm.AllowAutoResponse("sender", "away", now.Add(time.Minute)) {
+		t.Errorf("expected the other direction to be limited separately")
+	}
+	if !icbm.AllowAutoResponse("away", "sender", now.Add(autoResponseInterval)) {
+		t.Errorf("expected an auto-response to be allowed again after the interval")
+	}
+}
+
+func TestICBMSignOff(t *testing.T) {
+	icbm := &ICBM{}
+	icbm.setChannel("recipient", &channel{MaxMessageSnacSize: 100, MaxSenderWarningLevel: 999, MinimumMessageInterval: 1000})
+
+	sender := &models.User{ScreenName: "sender"}
+	ctx := context.Background()
+	now := time.Now()
+
+	if code := icbm.checkMessage(ctx, sender, nil, "recipient", true, 50, now); code != 0 {
+		t.Fatalf("expected message to be allowed, got 0x%02x", code)
+	}
+	icbm.AllowAutoResponse("recipient", "sender", now)
+
+	icbm.SignOff("recipient")
+
+	if icbm.channelFor("recipient") != nil {
+		t.Error("expected the recipient's ICBM parameters to be forgotten")
+	}
+	if len(icbm.nextMessages) != 0 || len(icbm.nextAutoResponses) != 0 {
+		t.Error("expected the recipient's pairs to be forgotten")
+	}
+
+	// Offline users aren't held to the default parameters of a client that isn't there
+	if code := icbm.checkMessage(ctx, sender, nil, "recipient", false, 1000, now); code != 0 {
+		t.Errorf("expected a long message for an offline user to be allowed, got 0x%02x", code)
+	}
+	if code := icbm.checkMessage(ctx, sender, nil, "recipient", true, 1000, now); code != 0x0e {
+		t.Errorf("expected a long message for a client without parameters to be rejected, got 0x%02x", code)
+	}
+}
+
+func TestICBMPrune(t *testing.T) {
+	icbm := &ICBM{}
+	now := time.Now()
+
+	icbm.AllowAutoResponse("away", "sender", now)
+	icbm.AllowAutoResponse("away", "other", now.Add(autoResponseInterval+pruneInterval))
+
+	if _, ok := icbm.nextAutoResponses["away:sender"]; ok {
+		t.Error("expected an expired pair to be pruned")
+	}
+	if _, ok := icbm.nextAutoResponses["away:other"]; !ok {
+		t.Error("expected the new pair to be kept")
+	}
+}
+
+func TestICBMWarnNeedsMessage(t *testing.T) {
+	icbm := &ICBM{}
+	now := time.Now()
+
+	if icbm.useWarn("recipient", "sender", now) {
+		t.Error("expected a user who was never messaged not to be able to warn")
+	}
+
+	icbm.allowWarn("recipient", "sender", now)
+	if icbm.useWarn("sender", "recipient", now) {
+		t.Error("expected the sender not to be able to warn the recipient")
+	}
+	if !icbm.useWarn("recipient", "sender", now) {
+		t.Error("expected the recipient to be able to warn the sender")
+	}
+	if icbm.useWarn("recipient", "sender", now) {
+		t.Error("expected a message to allow only one warn")
+	}
+
+	icbm.allowWarn("recipient", "sender", now)
+	if icbm.useWarn("recipient", "sender", now.Add(warnWindow)) {
+		t.Error("expected a message to stop allowing a warn after the window")
+	}
+}
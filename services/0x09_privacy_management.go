@@ -0,0 +1,205 @@
+package services
+
+import (
+	"aim-oscar/aimerror"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/util"
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+// Permit and deny entries are stored as feedbag items so that clients using family 0x09 and clients
+// using server-stored lists see the same privacy settings.
+const privacyGroupID = 0
+
+const (
+	maxPermitListSize = 200
+	maxDenyListSize   = 200
+)
+
+type PrivacyManagement struct {
+	OnlineCh chan *models.User
+}
+
+// CanSee checks if viewer is allowed to see the user's presence and contact them according to the
+// user's permit/deny mode
+func CanSee(ctx context.Context, db *bun.DB, user *models.User, viewer *models.User) (bool, error) {
+	switch user.PDMode {
+	case models.PDModeBlockAll:
+		return false, nil
+
+	case models.PDModePermitSome:
+		return models.FeedbagHasName(ctx, db, user.ScreenName, FeedbagItemTypePermit, viewer.ScreenName)
+
+	case models.PDModeDenySome:
+		denied, err := models.FeedbagHasName(ctx, db, user.ScreenName, FeedbagItemTypeDeny, viewer.ScreenName)
+		return !denied, err
+
+	case models.PDModeAllowBuddies:
+		isBuddy, err := db.NewSelect().Model((*models.Buddy)(nil)).Where("source_uin = ?", user.UIN).Where("with_uin = ?", viewer.UIN).Exists(ctx)
+		if err != nil {
+			return false, errors.Wrap(err, "could not look up buddy")
+		}
+		return isBuddy, nil
+	}
+
+	return true, nil
+}
+
+// IsVisibleTo checks if viewer should see the user's presence. On top of the permit/deny mode, invisible
+// users only show up for the people on their visible (permit) list.
+func IsVisibleTo(ctx context.Context, db *bun.DB, user *models.User, viewer *models.User) (bool, error) {
+	canSee, err := CanSee(ctx, db, user, viewer)
+	if err != nil || !canSee {
+		return false, err
+	}
+
+	if user.Status == models.UserStatusInvisible {
+		return models.FeedbagHasName(ctx, db, user.ScreenName, FeedbagItemTypePermit, viewer.ScreenName)
+	}
+
+	return true, nil
+}
+
+func (p *PrivacyManagement) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
+	session, _ := oscar.SessionFromContext(ctx)
+	logger := session.Logger.With("service", "privacy management")
+
+	switch snac.Header.Subtype {
+
+	// Client wants to know the permit/deny list limits
+	case 0x02:
+		rightsSnac := oscar.NewSNAC(0x09, 0x03)
+		rightsSnac.Data.WriteBinary(oscar.NewTLV(0x01, util.Word(maxPermitListSize))) // Max visible list size
+		rightsSnac.Data.WriteBinary(oscar.NewTLV(0x02, util.Word(maxDenyListSize)))   // Max invisible list size
+
+		rightsFlap := oscar.NewFLAP(2)
+		rightsFlap.Data.WriteBinary(rightsSnac)
+		return ctx, session.Send(rightsFlap)
+
+	// Add to / remove from the visible (permit) list. Older clients switch into permit-some mode by adding to it.
+	case 0x05, 0x06:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		add := snac.Header.Subtype == 0x05
+		if err := p.updateList(ctx, db, user, &snac.Data, FeedbagItemTypePermit, add); err != nil {
+			return ctx, err
+		}
+
+		// Removing an entry leaves the mode alone
+		mode := user.PDMode
+		if add {
+			mode = models.PDModePermitSome
+		}
+		if err := p.setMode(ctx, db, user, mode); err != nil {
+			return ctx, err
+		}
+
+		logger.Info("updated permit list", "screen_name", user.ScreenName)
+		return models.NewContextWithUser(ctx, user), nil
+
+	// Add to / remove from the invisible (deny) list. Older clients switch into deny-some mode by adding to it.
+	case 0x07, 0x08:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		add := snac.Header.Subtype == 0x07
+		if err := p.updateList(ctx, db, user, &snac.Data, FeedbagItemTypeDeny, add); err != nil {
+			return ctx, err
+		}
+
+		// Removing an entry leaves the mode alone
+		mode := user.PDMode
+		if add {
+			mode = models.PDModeDenySome
+		}
+		if err := p.setMode(ctx, db, user, mode); err != nil {
+			return ctx, err
+		}
+
+		logger.Info("updated deny list", "screen_name", user.ScreenName)
+		return models.NewContextWithUser(ctx, user), nil
+	}
+
+	logger.Error(fmt.Sprintf("Unknown privacy management family/subtype: 0x09, 0x%02x", snac.Header.Subtype))
+
+	return ctx, nil
+}
+
+// updateList adds or removes every screen name in the request from one of the user's privacy lists. Clients that
+// loaded their feedbag are told about the items that changed.
+func (p *PrivacyManagement) updateList(ctx context.Context, db *bun.DB, user *models.User, data *oscar.Buffer, classID int, add bool) error {
+	var changed []*models.Feedbag
+	for len(data.Bytes()) > 0 {
+		screenName, err := data.ReadLPString()
+		if err != nil {
+			return errors.Wrap(err, "expecting more screen names in list")
+		}
+
+		existing, err := models.FeedbagItemByName(ctx, db, user.ScreenName, classID, screenName)
+		if err != nil {
+			return err
+		}
+
+		if add && existing == nil {
+			itemID, err := models.NextFeedbagItemID(ctx, db, user.ScreenName, privacyGroupID)
+			if err != nil {
+				return err
+			}
+
+			item := &models.Feedbag{
+				ScreenName: user.ScreenName,
+				GroupId:    privacyGroupID,
+				ItemId:     itemID,
+				ClassId:    classID,
+				Name:       screenName,
+			}
+			if err := item.Insert(ctx, db); err != nil {
+				return err
+			}
+			changed = append(changed, item)
+		} else if !add && existing != nil {
+			if err := existing.Delete(ctx, db); err != nil {
+				return err
+			}
+			changed = append(changed, existing)
+		}
+	}
+
+	if !FeedbagLoadedFromContext(ctx) {
+		return nil
+	}
+
+	session, err := oscar.SessionFromContext(ctx)
+	if err != nil {
+		return err
+	}
+
+	var subtype uint16 = 0x08 // Items added
+	if !add {
+		subtype = 0x0a // Items deleted
+	}
+	return sendFeedbagChanges(session, subtype, changed)
+}
+
+// setMode saves the user's new permit/deny mode and re-sends their presence so it gets re-checked against it
+func (p *PrivacyManagement) setMode(ctx context.Context, db *bun.DB, user *models.User, mode models.PDMode) error {
+	if user.PDMode != mode {
+		user.PDMode = mode
+		if err := user.Update(ctx, db, "pd_mode"); err != nil {
+			return errors.Wrap(err, "could not set permit/deny mode")
+		}
+	}
+
+	p.OnlineCh <- user
+	return nil
+}
@@ -0,0 +1,136 @@
+package services
+
+import (
+	"aim-oscar/oscar"
+	"aim-oscar/util"
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+const chatMaxConcurrentRooms = 10
+
+type ChatNavigationService struct {
+	Rooms ChatRooms
+}
+
+func writeExchangeInfo(buf *oscar.Buffer, exchange uint16) {
+	tlvs := []*oscar.TLV{
+		oscar.NewTLV(0x02, util.Word(0x0010)),          // Class permissions
+		oscar.NewTLV(0xc9, util.Word(0x0003)),          // Flags
+		oscar.NewTLV(0xd3, []byte("default exchange")), // Exchange name
+		oscar.NewTLV(0xd5, []byte{2}),                  // Creation permissions
+		oscar.NewTLV(0xd1, util.Word(chatMaxMessageLength)),
+		oscar.NewTLV(0xd6, []byte("us-ascii")), // Charset
+		oscar.NewTLV(0xd7, []byte("en")),       // Language
+	}
+
+	info := oscar.Buffer{}
+	info.WriteUint16(exchange)
+	info.WriteUint16(uint16(len(tlvs)))
+	for _, tlv := range tlvs {
+		info.WriteBinary(tlv)
+	}
+
+	buf.WriteBinary(oscar.NewTLV(0x03, info.Bytes()))
+}
+
+func (c *ChatNavigationService) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
+	session, _ := oscar.SessionFromContext(ctx)
+	logger := session.Logger.With("service", "chat navigation")
+
+	switch snac.Header.Subtype {
+
+	// Client wants to know chat limits and which exchanges exist
+	case 0x02:
+		rightsSnac := oscar.NewSNAC(0x0d, 0x09)
+		rightsSnac.Header.RequestID = snac.Header.RequestID
+		rightsSnac.WriteTLV(oscar.NewTLV(0x02, []byte{chatMaxConcurrentRooms}))
+		writeExchangeInfo(&rightsSnac.Data, ChatExchange)
+		return ctx, sendSNAC(session, rightsSnac)
+
+	// Client wants info about an exchange
+	case 0x03:
+		exchange, err := snac.Data.ReadUint16()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read exchange")
+		}
+
+		if exchange != ChatExchange {
+			return ctx, sendSNACError(session, 0x0d, 0x14) // error code 0x14: No Match
+		}
+
+		exchangeSnac := oscar.NewSNAC(0x0d, 0x09)
+		exchangeSnac.Header.RequestID = snac.Header.RequestID
+		writeExchangeInfo(&exchangeSnac.Data, exchange)
+		return ctx, sendSNAC(session, exchangeSnac)
+
+	// Client wants info about a room
+	case 0x04:
+		_, cookie, _, err := ReadChatRoomCookie(&snac.Data)
+		if err != nil {
+			return ctx, err
+		}
+
+		room := c.Rooms.GetRoom(cookie)
+		if room == nil {
+			return ctx, sendSNACError(session, 0x0d, 0x14) // error code 0x14: No Match
+		}
+
+		roomInfo := oscar.Buffer{}
+		room.WriteInfo(&roomInfo)
+
+		roomSnac := oscar.NewSNAC(0x0d, 0x09)
+		roomSnac.Header.RequestID = snac.Header.RequestID
+		roomSnac.WriteTLV(oscar.NewTLV(0x04, roomInfo.Bytes()))
+		return ctx, sendSNAC(session, roomSnac)
+
+	// Client wants to create (or join, if it already exists) a room
+	case 0x08:
+		exchange, _, _, err := ReadChatRoomCookie(&snac.Data)
+		if err != nil {
+			return ctx, err
+		}
+
+		// Skip the detail level
+		if _, err := snac.Data.ReadUint8(); err != nil {
+			return ctx, errors.Wrap(err, "could not read detail level")
+		}
+
+		// Skip the TLV count, the TLVs follow
+		if _, err := snac.Data.ReadUint16(); err != nil {
+			return ctx, errors.Wrap(err, "could not read room TLV count")
+		}
+
+		tlvs, err := oscar.UnmarshalTLVs(snac.Data.Bytes())
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not unmarshal room TLVs")
+		}
+
+		nameTLV := oscar.FindTLV(tlvs, 0xd3)
+		if nameTLV == nil || len(nameTLV.Data) == 0 {
+			return ctx, errors.New("missing room name TLV 0xd3")
+		}
+
+		if exchange != ChatExchange {
+			return ctx, sendSNACError(session, 0x0d, 0x0d) // error code 0x0d: Request denied
+		}
+
+		room := c.Rooms.FindOrCreateRoom(exchange, string(nameTLV.Data))
+		logger.Info("created chat room", "screen_name", session.ScreenName, "room", room.Name)
+
+		roomInfo := oscar.Buffer{}
+		room.WriteInfo(&roomInfo)
+
+		roomSnac := oscar.NewSNAC(0x0d, 0x09)
+		roomSnac.Header.RequestID = snac.Header.RequestID
+		roomSnac.WriteTLV(oscar.NewTLV(0x04, roomInfo.Bytes()))
+		return ctx, sendSNAC(session, roomSnac)
+	}
+
+	logger.Error(fmt.Sprintf("Unknown chat navigation family/subtype: 0x0d, 0x%02x", snac.Header.Subtype))
+
+	return ctx, nil
+}
@@ -0,0 +1,348 @@
+package services
+
+import (
+	"aim-oscar/aimerror"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/util"
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+const (
+	// Rooms created by users all live in exchange 4
+	ChatExchange = 4
+
+	chatMaxMessageLength = 1024
+	chatMaxOccupancy     = 100
+)
+
+var ErrChatRoomFull = errors.New("chat room is full")
+
+// ChatRooms keeps track of every chat room
+type ChatRooms interface {
+	FindOrCreateRoom(exchange uint16, name string) *ChatRoom
+	GetRoom(cookie string) *ChatRoom
+	// RemoveRoom forgets a room if nobody is in it
+	RemoveRoom(cookie string)
+}
+
+type ChatMember struct {
+	User    *models.User
+	Session *oscar.Session
+}
+
+type ChatRoom struct {
+	Cookie    string
+	Exchange  uint16
+	Instance  uint16
+	Name      string
+	CreatedAt time.Time
+	members   map[string]*ChatMember
+	// When the last member left, or when the room was created if nobody has joined yet
+	emptySince time.Time
+	mutex      *sync.RWMutex
+}
+
+func NewChatRoom(exchange uint16, name string) *ChatRoom {
+	now := time.Now()
+	return &ChatRoom{
+		Cookie:     ChatRoomCookie(exchange, name),
+		Exchange:   exchange,
+		Instance:   0,
+		Name:       name,
+		CreatedAt:  now,
+		members:    make(map[string]*ChatMember),
+		emptySince: now,
+		mutex:      &sync.RWMutex{},
+	}
+}
+
+// ChatRoomCookie is the opaque identifier clients use to refer to a room. Room names are case insensitive.
+func ChatRoomCookie(exchange uint16, name string) string {
+	return fmt.Sprintf("%d-0-%s", exchange, strings.ToLower(name))
+}
+
+// Join adds a member to the room, or returns ErrChatRoomFull if the room is at its max occupancy
+func (r *ChatRoom) Join(user *models.User, session *oscar.Session) error {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.members[user.ScreenName]; !ok && len(r.members) >= chatMaxOccupancy {
+		return ErrChatRoomFull
+	}
+
+	r.members[user.ScreenName] = &ChatMember{User: user, Session: session}
+	r.emptySince = time.Time{}
+	return nil
+}
+
+// Leave removes a member from the room and returns how many members are left
+func (r *ChatRoom) Leave(screen_name string) int {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	if _, ok := r.members[screen_name]; ok {
+		delete(r.members, screen_name)
+		if len(r.members) == 0 {
+			r.emptySince = time.Now()
+		}
+	}
+	return len(r.members)
+}
+
+// Full is true if nobody else can join the room
+func (r *ChatRoom) Full() bool {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return len(r.members) >= chatMaxOccupancy
+}
+
+// EmptySince returns when the room was last left empty, or zero if there's somebody in it
+func (r *ChatRoom) EmptySince() time.Time {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	return r.emptySince
+}
+
+func (r *ChatRoom) Members() []*ChatMember {
+	r.mutex.RLock()
+	members := make([]*ChatMember, 0, len(r.members))
+	for _, member := range r.members {
+		members = append(members, member)
+	}
+	r.mutex.RUnlock()
+	return members
+}
+
+// WriteCookie writes the exchange, cookie and instance that identify the room
+func (r *ChatRoom) WriteCookie(buf *oscar.Buffer) {
+	buf.WriteUint16(r.Exchange)
+	buf.WriteLPString(r.Cookie)
+	buf.WriteUint16(r.Instance)
+}
+
+// WriteInfo writes the room's full info block, used by chat navigation and chat room info updates
+func (r *ChatRoom) WriteInfo(buf *oscar.Buffer) {
+	r.WriteCookie(buf)
+	buf.WriteUint8(2) // Detail level
+
+	tlvs := []*oscar.TLV{
+		oscar.NewTLV(0x6a, []byte(r.Name)),                         // Fully qualified name
+		oscar.NewTLV(0xc9, util.Word(0x0003)),                      // Flags
+		oscar.NewTLV(0xca, util.Dword(uint32(r.CreatedAt.Unix()))), // Creation time
+		oscar.NewTLV(0xd1, util.Word(chatMaxMessageLength)),        // Max message length
+		oscar.NewTLV(0xd2, util.Word(chatMaxOccupancy)),            // Max occupancy
+		oscar.NewTLV(0xd3, []byte(r.Name)),                         // Room name
+		oscar.NewTLV(0xd5, []byte{2}),                              // Creation permissions
+		oscar.NewTLV(0x6f, util.Word(uint16(len(r.Members())))),    // Number of occupants
+		oscar.NewTLV(0xd6, []byte("us-ascii")),                     // Charset
+		oscar.NewTLV(0xd7, []byte("en")),                           // Language
+	}
+
+	buf.WriteUint16(uint16(len(tlvs)))
+	for _, tlv := range tlvs {
+		buf.WriteBinary(tlv)
+	}
+}
+
+// sendRoomInfo sends the room's info to everyone in it, so their occupant count stays up to date
+func sendRoomInfo(room *ChatRoom) {
+	infoSnac := oscar.NewSNAC(0x0e, 0x02)
+	room.WriteInfo(&infoSnac.Data)
+
+	for _, member := range room.Members() {
+		if err := sendSNAC(member.Session, infoSnac); err != nil {
+			member.Session.Logger.Error("could not send room info", "member", member.User.ScreenName, "err", err.Error())
+		}
+	}
+}
+
+// chatMessageLength returns the length of the text in a chat message's info TLV 0x5
+func chatMessageLength(info []byte) (int, error) {
+	tlvs, err := oscar.UnmarshalTLVs(info)
+	if err != nil {
+		return 0, errors.Wrap(err, "could not unmarshal chat message info TLVs")
+	}
+
+	messageTLV := oscar.FindTLV(tlvs, 0x01)
+	if messageTLV == nil {
+		return 0, nil
+	}
+	return len(messageTLV.Data), nil
+}
+
+// ReadChatRoomCookie reads the exchange, cookie and instance that identify a room
+func ReadChatRoomCookie(buf *oscar.Buffer) (uint16, string, uint16, error) {
+	exchange, err := buf.ReadUint16()
+	if err != nil {
+		return 0, "", 0, errors.Wrap(err, "could not read exchange")
+	}
+
+	cookie, err := buf.ReadLPString()
+	if err != nil {
+		return 0, "", 0, errors.Wrap(err, "could not read room cookie")
+	}
+
+	instance, err := buf.ReadUint16()
+	if err != nil {
+		return 0, "", 0, errors.Wrap(err, "could not read room instance")
+	}
+
+	return exchange, cookie, instance, nil
+}
+
+type chatKey string
+
+func (s chatKey) String() string {
+	return "chat-" + string(s)
+}
+
+var (
+	chatRoomKey = chatKey("room")
+)
+
+// NewContextWithChatRoom marks a connection as a chat connection for a room
+func NewContextWithChatRoom(ctx context.Context, room *ChatRoom) context.Context {
+	return context.WithValue(ctx, chatRoomKey, room)
+}
+
+func ChatRoomFromContext(ctx context.Context) *ChatRoom {
+	r := ctx.Value(chatRoomKey)
+	if r == nil {
+		return nil
+	}
+	return r.(*ChatRoom)
+}
+
+// JoinChatRoom adds a user to a room once their chat connection is ready. The user gets the room info and
+// everyone already in the room, and everyone else is told that the user joined. Returns ErrChatRoomFull if the
+// room is at its max occupancy.
+func JoinChatRoom(room *ChatRoom, user *models.User, session *oscar.Session) error {
+	if err := room.Join(user, session); err != nil {
+		return err
+	}
+
+	// Everyone gets the new occupant count, the user gets the room info for the first time
+	sendRoomInfo(room)
+
+	membersSnac := oscar.NewSNAC(0x0e, 0x03)
+	joinedSnac := oscar.NewSNAC(0x0e, 0x03)
+	WriteUserInfo(&joinedSnac.Data, user, nil)
+
+	for _, member := range room.Members() {
+		WriteUserInfo(&membersSnac.Data, member.User, nil)
+
+		if member.User.ScreenName == user.ScreenName {
+			continue
+		}
+		if err := sendSNAC(member.Session, joinedSnac); err != nil {
+			session.Logger.Error("could not tell chat member about new member", "member", member.User.ScreenName, "err", err.Error())
+		}
+	}
+
+	return sendSNAC(session, membersSnac)
+}
+
+// LeaveChatRoom removes a user from a room and tells everyone left. Returns how many members are left.
+func LeaveChatRoom(room *ChatRoom, user *models.User) int {
+	remaining := room.Leave(user.ScreenName)
+
+	leftSnac := oscar.NewSNAC(0x0e, 0x04)
+	WriteUserInfo(&leftSnac.Data, user, nil)
+	for _, member := range room.Members() {
+		if err := sendSNAC(member.Session, leftSnac); err != nil {
+			member.Session.Logger.Error("could not tell chat member that a member left", "member", member.User.ScreenName, "err", err.Error())
+		}
+	}
+	sendRoomInfo(room)
+
+	return remaining
+}
+
+type ChatService struct{}
+
+func (c *ChatService) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
+	session, _ := oscar.SessionFromContext(ctx)
+	logger := session.Logger.With("service", "chat")
+
+	room := ChatRoomFromContext(ctx)
+	if room == nil {
+		return ctx, errors.New("chat SNAC on a connection that isn't in a chat room")
+	}
+
+	switch snac.Header.Subtype {
+
+	// Client sends a message to the room
+	case 0x05:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		cookie, err := snac.Data.ReadUint64()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read message cookie")
+		}
+
+		msgChannel, err := snac.Data.ReadUint16()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read message channel")
+		}
+
+		tlvs, err := oscar.UnmarshalTLVs(snac.Data.Bytes())
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not unmarshal chat message tlvs")
+		}
+
+		messageInfoTLV := oscar.FindTLV(tlvs, 0x05)
+		if messageInfoTLV == nil {
+			return ctx, errors.New("missing chat message info TLV 0x5")
+		}
+
+		length, err := chatMessageLength(messageInfoTLV.Data)
+		if err != nil {
+			return ctx, err
+		}
+		if length > chatMaxMessageLength {
+			logger.Info("refusing chat message over the max length", "screen_name", user.ScreenName, "room", room.Name, "length", length)
+			return ctx, sendSNACError(session, 0x0e, 0x0d) // error code 0x0d: Request denied
+		}
+
+		senderInfo := oscar.Buffer{}
+		WriteUserInfo(&senderInfo, user, nil)
+
+		messageSnac := oscar.NewSNAC(0x0e, 0x06)
+		messageSnac.Data.WriteUint64(cookie)
+		messageSnac.Data.WriteUint16(msgChannel)
+		messageSnac.WriteTLV(oscar.NewTLV(0x03, senderInfo.Bytes()))
+		if publicTLV := oscar.FindTLV(tlvs, 0x01); publicTLV != nil {
+			messageSnac.WriteTLV(publicTLV)
+		}
+		messageSnac.WriteTLV(messageInfoTLV)
+
+		// TLV 0x6 asks the server to reflect the message back to the sender
+		reflect := oscar.FindTLV(tlvs, 0x06) != nil
+
+		for _, member := range room.Members() {
+			if member.User.ScreenName == user.ScreenName && !reflect {
+				continue
+			}
+			if err := sendSNAC(member.Session, messageSnac); err != nil {
+				logger.Error("could not relay chat message", "member", member.User.ScreenName, "err", err.Error())
+			}
+		}
+
+		return ctx, nil
+	}
+
+	logger.Error(fmt.Sprintf("Unknown chat family/subtype: 0x0e, 0x%02x", snac.Header.Subtype))
+
+	return ctx, nil
+}
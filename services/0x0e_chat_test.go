@@ -0,0 +1,181 @@
+package services
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/exp/slog"
+)
+
+// testClient is a connection whose client side collects the SNACs it's sent
+type testClient struct {
+	ctx     context.Context
+	user    *models.User
+	session *oscar.Session
+	snacs   chan *oscar.SNAC
+}
+
+func newTestClient(t *testing.T, screenName string) *testClient {
+	server, client := net.Pipe()
+	t.Cleanup(func() { server.Close() })
+
+	ctx := oscar.NewContextWithSession(context.Background(), server, slog.Default())
+	session, _ := oscar.SessionFromContext(ctx)
+	session.Family = 0x0e
+
+	user := &models.User{ScreenName: screenName}
+	c := &testClient{
+		ctx:     models.NewContextWithUser(ctx, user),
+		user:    user,
+		session: session,
+		snacs:   make(chan *oscar.SNAC, 32),
+	}
+
+	go func() {
+		header := make([]byte, 6)
+		for {
+			if _, err := io.ReadFull(client, header); err != nil {
+				return
+			}
+			data := make([]byte, binary.BigEndian.Uint16(header[4:]))
+			if _, err := io.ReadFull(client, data); err != nil {
+				return
+			}
+			snac := &oscar.SNAC{}
+			if err := snac.UnmarshalBinary(data); err == nil {
+				c.snacs <- snac
+			}
+		}
+	}()
+
+	return c
+}
+
+// next returns the next SNAC the client was sent, or nil if nothing arrives
+func (c *testClient) next() *oscar.SNAC {
+	select {
+	case snac := <-c.snacs:
+		return snac
+	case <-time.After(100 * time.Millisecond):
+		return nil
+	}
+}
+
+// drain throws away everything the client has been sent so far
+func (c *testClient) drain() {
+	for c.next() != nil {
+	}
+}
+
+func chatMessageSNAC(message string) *oscar.SNAC {
+	info := oscar.Buffer{}
+	info.WriteBinary(oscar.NewTLV(0x01, []byte(message)))
+
+	snac := oscar.NewSNAC(0x0e, 0x05)
+	snac.Data.WriteUint64(1)
+	snac.Data.WriteUint16(3)
+	snac.WriteTLV(oscar.NewTLV(0x01, nil))
+	snac.WriteTLV(oscar.NewTLV(0x05, info.Bytes()))
+	return snac
+}
+
+func TestChatRoomMaxOccupancy(t *testing.T) {
+	room := NewChatRoom(ChatExchange, "Lobby")
+
+	for i := 0; i < chatMaxOccupancy; i++ {
+		if err := room.Join(&models.User{ScreenName: fmt.Sprintf("user%d", i)}, nil); err != nil {
+			t.Fatalf("expected member %d to join, got %v", i, err)
+		}
+	}
+
+	if !room.Full() {
+		t.Error("expected the room to be full")
+	}
+	if err := room.Join(&models.User{ScreenName: "toof"}, nil); err != ErrChatRoomFull {
+		t.Errorf("expected joining a full room to fail with ErrChatRoomFull, got %v", err)
+	}
+	if err := room.Join(&models.User{ScreenName: "user0"}, nil); err != nil {
+		t.Errorf("expected a member to be able to rejoin a full room, got %v", err)
+	}
+
+	room.Leave("user0")
+	if err := room.Join(&models.User{ScreenName: "toof"}, nil); err != nil {
+		t.Errorf("expected to join once someone left, got %v", err)
+	}
+}
+
+func TestJoinChatRoomUpdatesOccupants(t *testing.T) {
+	room := NewChatRoom(ChatExchange, "Lobby")
+	first := newTestClient(t, "toof")
+	second := newTestClient(t, "mike")
+
+	if err := JoinChatRoom(room, first.user, first.session); err != nil {
+		t.Fatal(err)
+	}
+	first.drain()
+
+	if err := JoinChatRoom(room, second.user, second.session); err != nil {
+		t.Fatal(err)
+	}
+
+	// The member who was already there hears about the new occupant count
+	var gotInfo bool
+	for snac := first.next(); snac != nil; snac = first.next() {
+		gotInfo = gotInfo || snac.Header.Subtype == 0x02
+	}
+	if !gotInfo {
+		t.Error("expected the room info to be sent again when somebody joins")
+	}
+	second.drain()
+
+	LeaveChatRoom(room, second.user)
+	gotInfo = false
+	for snac := first.next(); snac != nil; snac = first.next() {
+		gotInfo = gotInfo || snac.Header.Subtype == 0x02
+	}
+	if !gotInfo {
+		t.Error("expected the room info to be sent again when somebody leaves")
+	}
+}
+
+func TestChatMessageMaxLength(t *testing.T) {
+	room := NewChatRoom(ChatExchange, "Lobby")
+	sender := newTestClient(t, "toof")
+	recipient := newTestClient(t, "mike")
+
+	for _, c := range []*testClient{sender, recipient} {
+		if err := JoinChatRoom(room, c.user, c.session); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sender.drain()
+	recipient.drain()
+
+	ctx := NewContextWithChatRoom(sender.ctx, room)
+
+	chat := &ChatService{}
+	if _, err := chat.HandleSNAC(ctx, nil, chatMessageSNAC(strings.Repeat("a", chatMaxMessageLength+1))); err != nil {
+		t.Fatal(err)
+	}
+	if snac := sender.next(); snac == nil || snac.Header.Subtype != 0x01 {
+		t.Errorf("expected the sender to get an error for a message over the max length, got %v", snac)
+	}
+	if snac := recipient.next(); snac != nil {
+		t.Errorf("expected a message over the max length not to be relayed, got %v", snac)
+	}
+
+	if _, err := chat.HandleSNAC(ctx, nil, chatMessageSNAC("hello")); err != nil {
+		t.Fatal(err)
+	}
+	if snac := recipient.next(); snac == nil || snac.Header.Subtype != 0x06 {
+		t.Errorf("expected the message to be relayed, got %v", snac)
+	}
+}
@@ -1,14 +1,84 @@
 package services
 
 import (
+	"aim-oscar/aimerror"
+	"aim-oscar/models"
 	"aim-oscar/oscar"
 	"context"
+	"fmt"
 
+	"github.com/pkg/errors"
 	"github.com/uptrace/bun"
 )
 
-type DirectorySearchService struct{}
+type DirectorySearchService struct {
+	// MaxResults is the most users a search returns
+	MaxResults int
+}
 
 func (d *DirectorySearchService) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
+	session, _ := oscar.SessionFromContext(ctx)
+	logger := session.Logger.With("service", "directory search")
+
+	switch snac.Header.Subtype {
+
+	// Client searches the directory by email address, by directory info or by an interest
+	case 0x02:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		tlvs, err := oscar.UnmarshalTLVs(snac.Data.Bytes())
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not unmarshal search tlvs")
+		}
+
+		var results []*models.DirectoryInfo
+		if emailTLV := oscar.FindTLV(tlvs, 0x05); emailTLV != nil {
+			results, err = models.SearchDirectoryByEmail(ctx, db, string(emailTLV.Data))
+		} else if interestTLV := oscar.FindTLV(tlvs, 0x0b); interestTLV != nil {
+			results, err = models.SearchDirectoryByInterest(ctx, db, string(interestTLV.Data), d.MaxResults)
+		} else {
+			query := &models.DirectoryInfo{}
+			for _, field := range directoryFields(query) {
+				if tlv := oscar.FindTLV(tlvs, field.tlvType); tlv != nil {
+					*field.value = string(tlv.Data)
+				}
+			}
+			results, err = models.SearchDirectory(ctx, db, query, d.MaxResults)
+		}
+		if err != nil {
+			return ctx, err
+		}
+
+		// Users who are hiding from the searcher aren't found
+		var found []*models.DirectoryInfo
+		for _, result := range results {
+			canSee, err := CanSee(ctx, db, result.User, user)
+			if err != nil {
+				return ctx, err
+			}
+			if canSee {
+				found = append(found, result)
+			}
+		}
+
+		logger.Info("directory search", "screen_name", user.ScreenName, "results", len(found))
+
+		replySnac := oscar.NewSNAC(0x0f, 0x03)
+		replySnac.Header.RequestID = snac.Header.RequestID
+		replySnac.Data.WriteUint16(0x0005) // Status: search succeeded
+		replySnac.Data.WriteUint16(0)
+		replySnac.Data.WriteUint16(uint16(len(found)))
+		for _, result := range found {
+			resultTLVs := append([]*oscar.TLV{oscar.NewTLV(0x09, []byte(result.User.ScreenName))}, DirectoryInfoTLVs(result)...)
+			replySnac.AppendTLVs(resultTLVs)
+		}
+		return ctx, sendSNAC(session, replySnac)
+	}
+
+	logger.Error(fmt.Sprintf("Unknown directory search family/subtype: 0x0f, 0x%02x", snac.Header.Subtype))
+
 	return ctx, nil
 }
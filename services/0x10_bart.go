@@ -0,0 +1,236 @@
+package services
+
+import (
+	"aim-oscar/aimerror"
+	"aim-oscar/bart"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"context"
+	"fmt"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+const (
+	BARTTypeBuddyIcon = 0x0001
+
+	// The largest icon the official clients would upload
+	bartMaxIconSize = 7168
+)
+
+// BART upload reply codes
+const (
+	BARTUploadOK        = 0x00
+	BARTUploadInvalid   = 0x01
+	BARTUploadTooBig    = 0x03
+	BARTUploadNotStored = 0x04
+)
+
+// BART download reply codes
+const (
+	BARTDownloadOK       = 0x00
+	BARTDownloadNotFound = 0x04
+)
+
+// BARTID identifies a BART item by its type and hash
+type BARTID struct {
+	Type  uint16
+	Flags uint8
+	Hash  []byte
+}
+
+func (b *BARTID) Write(buf *oscar.Buffer) {
+	buf.WriteUint16(b.Type)
+	buf.WriteUint8(b.Flags)
+	buf.WriteUint8(uint8(len(b.Hash)))
+	buf.Write(b.Hash)
+}
+
+func ReadBARTID(buf *oscar.Buffer) (*BARTID, error) {
+	itemType, err := buf.ReadUint16()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read BART type")
+	}
+
+	flags, err := buf.ReadUint8()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read BART flags")
+	}
+
+	hashLen, err := buf.ReadUint8()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read BART hash length")
+	}
+
+	hash, err := buf.ReadBytes(int(hashLen))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read BART hash")
+	}
+
+	return &BARTID{Type: itemType, Flags: flags, Hash: hash}, nil
+}
+
+// BuddyIconTLV is the user info TLV 0x1D that tells clients which buddy icon a user has, or nil if they
+// don't have one
+func BuddyIconTLV(user *models.User) *oscar.TLV {
+	if len(user.IconHash) == 0 {
+		return nil
+	}
+
+	id := &BARTID{Type: BARTTypeBuddyIcon, Hash: user.IconHash}
+	buf := oscar.Buffer{}
+	id.Write(&buf)
+	return oscar.NewTLV(0x1d, buf.Bytes())
+}
+
+type BARTService struct {
+	OnlineCh chan *models.User
+	Store    bart.Store
+}
+
+func (b *BARTService) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
+	session, _ := oscar.SessionFromContext(ctx)
+	logger := session.Logger.With("service", "bart")
+
+	switch snac.Header.Subtype {
+
+	// Client uploads an item
+	case 0x02:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		itemType, err := snac.Data.ReadUint16()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read BART type")
+		}
+
+		size, err := snac.Data.ReadUint16()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read BART item length")
+		}
+
+		data, err := snac.Data.ReadBytes(int(size))
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read BART item")
+		}
+
+		id := &BARTID{Type: itemType}
+		code := uint8(BARTUploadOK)
+
+		switch {
+		case itemType != BARTTypeBuddyIcon || size == 0:
+			code = BARTUploadInvalid
+		case size > bartMaxIconSize:
+			code = BARTUploadTooBig
+		default:
+			hash, err := b.Store.Put(data)
+			if err != nil {
+				logger.Error("could not store BART item", "err", err.Error())
+				code = BARTUploadNotStored
+				break
+			}
+			id.Hash = hash
+
+			if err := b.setIcon(ctx, db, user, hash); err != nil {
+				return ctx, err
+			}
+			logger.Info("uploaded buddy icon", "screen_name", user.ScreenName, "hash", fmt.Sprintf("%x", hash))
+		}
+
+		uploadSnac := oscar.NewSNAC(0x10, 0x03)
+		uploadSnac.Header.RequestID = snac.Header.RequestID
+		uploadSnac.Data.WriteUint8(code)
+		id.Write(&uploadSnac.Data)
+		return ctx, sendSNAC(session, uploadSnac)
+
+	// Client wants a single item for a user
+	case 0x04:
+		screenName, err := snac.Data.ReadLPString()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read screen name")
+		}
+
+		// Always 1
+		if _, err := snac.Data.ReadUint8(); err != nil {
+			return ctx, errors.Wrap(err, "could not read BART command")
+		}
+
+		id, err := ReadBARTID(&snac.Data)
+		if err != nil {
+			return ctx, err
+		}
+
+		data, err := b.Store.Get(id.Hash)
+		if err != nil {
+			return ctx, err
+		}
+
+		downloadSnac := oscar.NewSNAC(0x10, 0x05)
+		downloadSnac.Header.RequestID = snac.Header.RequestID
+		downloadSnac.Data.WriteLPString(screenName)
+		id.Write(&downloadSnac.Data)
+		downloadSnac.Data.WriteUint16(uint16(len(data)))
+		downloadSnac.Data.Write(data)
+		return ctx, sendSNAC(session, downloadSnac)
+
+	// Client wants several items for a user
+	case 0x06:
+		screenName, err := snac.Data.ReadLPString()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read screen name")
+		}
+
+		count, err := snac.Data.ReadUint8()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read BART item count")
+		}
+
+		for i := 0; i < int(count); i++ {
+			id, err := ReadBARTID(&snac.Data)
+			if err != nil {
+				return ctx, err
+			}
+
+			data, err := b.Store.Get(id.Hash)
+			if err != nil {
+				return ctx, err
+			}
+
+			code := uint8(BARTDownloadOK)
+			if data == nil {
+				code = BARTDownloadNotFound
+			}
+
+			downloadSnac := oscar.NewSNAC(0x10, 0x07)
+			downloadSnac.Header.RequestID = snac.Header.RequestID
+			downloadSnac.Data.WriteLPString(screenName)
+			id.Write(&downloadSnac.Data)
+			downloadSnac.Data.WriteUint8(code)
+			downloadSnac.Data.WriteUint16(uint16(len(data)))
+			downloadSnac.Data.Write(data)
+			if err := sendSNAC(session, downloadSnac); err != nil {
+				return ctx, err
+			}
+		}
+
+		return ctx, nil
+	}
+
+	logger.Error(fmt.Sprintf("Unknown BART family/subtype: 0x10, 0x%02x", snac.Header.Subtype))
+
+	return ctx, nil
+}
+
+// setIcon changes the user's buddy icon and lets their watchers know about it
+func (b *BARTService) setIcon(ctx context.Context, db *bun.DB, user *models.User, hash []byte) error {
+	user.IconHash = hash
+	if err := user.Update(ctx, db, "icon_hash"); err != nil {
+		return errors.Wrap(err, "could not set buddy icon")
+	}
+
+	b.OnlineCh <- user
+	return nil
+}
@@ -1,20 +1,26 @@
 package services
 
 import (
+	"aim-oscar/aimerror"
+	"aim-oscar/models"
 	"aim-oscar/oscar"
 	"aim-oscar/util"
 	"bytes"
 	"context"
+	"database/sql"
 	"fmt"
 
+	"github.com/pkg/errors"
 	"github.com/uptrace/bun"
 )
 
-type FeedbagService struct{}
+type FeedbagService struct {
+	OnlineCh chan *models.User
+}
 
 type FeedbagItemType uint16
 
-var (
+const (
 	FeedbagItemTypeUser             FeedbagItemType = 0x0000
 	FeedbagItemTypeGroup                            = 0x0001
 	FeedbagItemTypePermit                           = 0x0002
@@ -27,6 +33,13 @@ var (
 	FeedbagItemTypeIconInfo                         = 0x0014 // avatar id
 )
 
+// Result codes sent back in 0x13/0x0E for each item in an add/update/delete request
+const (
+	FeedbagStatusOK            = 0x0000
+	FeedbagStatusNotFound      = 0x0002
+	FeedbagStatusAlreadyExists = 0x0003
+)
+
 type FeedbagItem struct {
 	Name           string
 	GroupID        uint16
@@ -42,18 +55,135 @@ func (f *FeedbagItem) Bytes() []byte {
 	buf.Write(util.Word(f.GroupID))
 	buf.Write(util.Word(f.ItemID))
 	buf.Write(util.Word(uint16(f.ItemType)))
-	buf.Write(util.Word(uint16(len(f.AdditionalData))))
 
-	if len(f.AdditionalData) > 0 {
-		for _, tlv := range f.AdditionalData {
-			b, _ := tlv.MarshalBinary()
-			buf.Write(b)
-		}
-	}
+	// The additional data length is the length of all the TLVs in bytes, not the number of TLVs
+	attributes := f.attributes()
+	buf.Write(util.Word(uint16(len(attributes))))
+	buf.Write(attributes)
 
 	return buf.Bytes()
 }
 
+func (f *FeedbagItem) attributes() []byte {
+	buf := bytes.Buffer{}
+	for _, tlv := range f.AdditionalData {
+		b, _ := tlv.MarshalBinary()
+		buf.Write(b)
+	}
+	return buf.Bytes()
+}
+
+// Model converts the item into a row that can be stored in the feedbag table
+func (f *FeedbagItem) Model(screen_name string) *models.Feedbag {
+	return &models.Feedbag{
+		ScreenName: screen_name,
+		GroupId:    int(f.GroupID),
+		ItemId:     int(f.ItemID),
+		ClassId:    int(f.ItemType),
+		Name:       f.Name,
+		Attributes: f.attributes(),
+	}
+}
+
+func FeedbagItemFromModel(f *models.Feedbag) (*FeedbagItem, error) {
+	tlvs, err := oscar.UnmarshalTLVs(f.Attributes)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not unmarshal feedbag item attributes")
+	}
+
+	return &FeedbagItem{
+		Name:           f.Name,
+		GroupID:        uint16(f.GroupId),
+		ItemID:         uint16(f.ItemId),
+		ItemType:       FeedbagItemType(f.ClassId),
+		AdditionalData: tlvs,
+	}, nil
+}
+
+// ReadFeedbagItem reads a single item in the wire format used by the add/update/delete requests
+func ReadFeedbagItem(buf *oscar.Buffer) (*FeedbagItem, error) {
+	name, err := buf.ReadLPUint16String()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read item name")
+	}
+
+	groupID, err := buf.ReadUint16()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read group id")
+	}
+
+	itemID, err := buf.ReadUint16()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read item id")
+	}
+
+	itemType, err := buf.ReadUint16()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read item type")
+	}
+
+	attributesLength, err := buf.ReadUint16()
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read additional data length")
+	}
+
+	attributes, err := buf.ReadBytes(int(attributesLength))
+	if err != nil {
+		return nil, errors.Wrap(err, "could not read additional data")
+	}
+
+	tlvs, err := oscar.UnmarshalTLVs(attributes)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not unmarshal additional data")
+	}
+
+	return &FeedbagItem{
+		Name:           name,
+		GroupID:        groupID,
+		ItemID:         itemID,
+		ItemType:       FeedbagItemType(itemType),
+		AdditionalData: tlvs,
+	}, nil
+}
+
+type feedbagKey string
+
+func (s feedbagKey) String() string {
+	return "feedbag-" + string(s)
+}
+
+var (
+	feedbagLoadedKey = feedbagKey("loaded")
+)
+
+// NewContextWithFeedbagLoaded marks a connection whose client has a copy of its feedbag to keep in sync
+func NewContextWithFeedbagLoaded(ctx context.Context) context.Context {
+	return context.WithValue(ctx, feedbagLoadedKey, true)
+}
+
+func FeedbagLoadedFromContext(ctx context.Context) bool {
+	loaded, _ := ctx.Value(feedbagLoadedKey).(bool)
+	return loaded
+}
+
+// sendFeedbagChanges tells the client about items the server added (0x13/0x08) or deleted (0x13/0x0a) from its
+// feedbag, like privacy list entries added with family 0x09, so the client's copy stays in sync
+func sendFeedbagChanges(session *oscar.Session, subtype uint16, items []*models.Feedbag) error {
+	if len(items) == 0 {
+		return nil
+	}
+
+	changeSnac := oscar.NewSNAC(0x13, subtype)
+	for _, item := range items {
+		feedbagItem, err := FeedbagItemFromModel(item)
+		if err != nil {
+			return err
+		}
+		changeSnac.Data.Write(feedbagItem.Bytes())
+	}
+	return sendSNAC(session, changeSnac)
+}
+
 func (f *FeedbagService) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
 	session, _ := oscar.SessionFromContext(ctx)
 	logger := session.Logger.With("service", "feedbag")
@@ -104,22 +234,327 @@ func (f *FeedbagService) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar
 
 		return ctx, session.Send(respFlap)
 
+	// Client wants their whole feedbag
 	case 0x04:
-		respSnac := oscar.NewSNAC(0x13, 0x6)
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
 
-		respSnac.Data.WriteUint8(0) // SSI Version
-		items := []FeedbagItem{}
+		return NewContextWithFeedbagLoaded(ctx), f.sendFeedbag(ctx, db, session, user)
 
-		respSnac.Data.WriteUint16(uint16(len(items)))
-		respSnac.Data.WriteUint32(0) // SSI last change time // TODO: add SSI change time
+	// Client wants their feedbag, but only if it changed since the time and item count they have cached
+	case 0x05:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
 
-		respFlap := oscar.NewFLAP(2)
-		respFlap.Data.WriteBinary(respSnac)
+		clientModified, err := snac.Data.ReadUint32()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read feedbag modification time")
+		}
 
-		return ctx, session.Send(respFlap)
+		clientCount, err := snac.Data.ReadUint16()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read feedbag item count")
+		}
+
+		lastModified, count, err := models.FeedbagLastModified(ctx, db, user.ScreenName)
+		if err != nil {
+			return ctx, err
+		}
+
+		ctx = NewContextWithFeedbagLoaded(ctx)
+		if uint32(lastModified.Unix()) != clientModified || uint16(count) != clientCount {
+			return ctx, f.sendFeedbag(ctx, db, session, user)
+		}
+
+		notModifiedSnac := oscar.NewSNAC(0x13, 0x0f)
+		notModifiedSnac.Data.WriteUint32(uint32(lastModified.Unix()))
+		notModifiedSnac.Data.WriteUint16(uint16(count))
+
+		notModifiedFlap := oscar.NewFLAP(2)
+		notModifiedFlap.Data.WriteBinary(notModifiedSnac)
+		return ctx, session.Send(notModifiedFlap)
+
+	// Client is done reading their feedbag and wants the server to start using it
+	case 0x07:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		items, err := models.FeedbagItems(ctx, db, user.ScreenName)
+		if err != nil {
+			return ctx, err
+		}
+
+		// Make sure every buddy in the feedbag is watched the same way as buddies added through 0x03/0x04
+		for _, item := range items {
+			if FeedbagItemType(item.ClassId) != FeedbagItemTypeUser {
+				continue
+			}
+
+			if _, err := f.addBuddy(ctx, db, user, item.Name); err != nil {
+				return ctx, err
+			}
+		}
+
+		logger.Debug("activated feedbag", "screen_name", user.ScreenName, "items", len(items))
+		return ctx, nil
+
+	// Client is adding, updating or deleting items
+	case 0x08, 0x09, 0x0a:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		statusSnac := oscar.NewSNAC(0x13, 0x0e)
+		statusSnac.Header.RequestID = snac.Header.RequestID
+
+		for len(snac.Data.Bytes()) > 0 {
+			item, err := ReadFeedbagItem(&snac.Data)
+			if err != nil {
+				return ctx, errors.Wrap(err, "could not read feedbag item")
+			}
+
+			var status uint16
+			switch snac.Header.Subtype {
+			case 0x08:
+				status, err = f.insertItem(ctx, db, user, item)
+			case 0x09:
+				status, err = f.updateItem(ctx, db, user, item)
+			case 0x0a:
+				status, err = f.deleteItem(ctx, db, user, item)
+			}
+			if err != nil {
+				return ctx, err
+			}
+
+			statusSnac.Data.WriteUint16(status)
+		}
+
+		statusFlap := oscar.NewFLAP(2)
+		statusFlap.Data.WriteBinary(statusSnac)
+		return ctx, session.Send(statusFlap)
+
+	// Client is starting or ending a batch of feedbag changes. Every change is applied as it comes in
+	// so there is nothing to do here.
+	case 0x11, 0x12:
+		return ctx, nil
 	}
 
 	logger.Error(fmt.Sprintf("Unknown feedbag family/subtype: 0x13, 0x%02x", snac.Header.Subtype))
 
 	return ctx, nil
 }
+
+func (f *FeedbagService) sendFeedbag(ctx context.Context, db *bun.DB, session *oscar.Session, user *models.User) error {
+	items, err := models.FeedbagItems(ctx, db, user.ScreenName)
+	if err != nil {
+		return err
+	}
+
+	lastModified, _, err := models.FeedbagLastModified(ctx, db, user.ScreenName)
+	if err != nil {
+		return err
+	}
+
+	respSnac := oscar.NewSNAC(0x13, 0x6)
+	respSnac.Data.WriteUint8(0) // SSI Version
+	respSnac.Data.WriteUint16(uint16(len(items)))
+	for _, item := range items {
+		feedbagItem, err := FeedbagItemFromModel(item)
+		if err != nil {
+			return err
+		}
+		respSnac.Data.Write(feedbagItem.Bytes())
+	}
+	respSnac.Data.WriteUint32(uint32(lastModified.Unix())) // SSI last change time
+
+	respFlap := oscar.NewFLAP(2)
+	respFlap.Data.WriteBinary(respSnac)
+	return session.Send(respFlap)
+}
+
+func (f *FeedbagService) insertItem(ctx context.Context, db *bun.DB, user *models.User, item *FeedbagItem) (uint16, error) {
+	existing, err := models.FeedbagItem(ctx, db, user.ScreenName, int(item.GroupID), int(item.ItemID))
+	if err != nil {
+		return 0, err
+	}
+	if existing != nil {
+		return FeedbagStatusAlreadyExists, nil
+	}
+
+	if err := item.Model(user.ScreenName).Insert(ctx, db); err != nil {
+		return 0, err
+	}
+
+	if item.ItemType == FeedbagItemTypeUser {
+		buddy, err := f.addBuddy(ctx, db, user, item.Name)
+		if err != nil {
+			return 0, err
+		}
+
+		// Buddies that don't have an account are still stored, there's just no one to watch
+		if buddy != nil {
+			f.OnlineCh <- buddy
+		}
+	}
+
+	if err := f.applySettings(ctx, db, user, item.ItemType, item.AdditionalData, false); err != nil {
+		return 0, err
+	}
+
+	return FeedbagStatusOK, nil
+}
+
+func (f *FeedbagService) updateItem(ctx context.Context, db *bun.DB, user *models.User, item *FeedbagItem) (uint16, error) {
+	existing, err := models.FeedbagItem(ctx, db, user.ScreenName, int(item.GroupID), int(item.ItemID))
+	if err != nil {
+		return 0, err
+	}
+	if existing == nil {
+		return FeedbagStatusNotFound, nil
+	}
+
+	if err := item.Model(user.ScreenName).Update(ctx, db); err != nil {
+		return 0, err
+	}
+
+	if err := f.applySettings(ctx, db, user, item.ItemType, item.AdditionalData, false); err != nil {
+		return 0, err
+	}
+
+	return FeedbagStatusOK, nil
+}
+
+func (f *FeedbagService) deleteItem(ctx context.Context, db *bun.DB, user *models.User, item *FeedbagItem) (uint16, error) {
+	existing, err := models.FeedbagItem(ctx, db, user.ScreenName, int(item.GroupID), int(item.ItemID))
+	if err != nil {
+		return 0, err
+	}
+	if existing == nil {
+		return FeedbagStatusNotFound, nil
+	}
+
+	if err := existing.Delete(ctx, db); err != nil {
+		return 0, err
+	}
+
+	if FeedbagItemType(existing.ClassId) == FeedbagItemTypeUser {
+		if err := f.removeBuddy(ctx, db, user, existing.Name); err != nil {
+			return 0, err
+		}
+	}
+
+	if err := f.applySettings(ctx, db, user, FeedbagItemType(existing.ClassId), nil, true); err != nil {
+		return 0, err
+	}
+
+	return FeedbagStatusOK, nil
+}
+
+// applySettings keeps the user's permit/deny mode and buddy icon in sync with the items in their feedbag, and
+// re-sends their presence whenever they change so watchers get re-checked and see the new icon
+func (f *FeedbagService) applySettings(ctx context.Context, db *bun.DB, user *models.User, itemType FeedbagItemType, attributes []*oscar.TLV, deleted bool) error {
+	switch itemType {
+	case FeedbagItemTypePDSetting:
+		mode := models.PDModeAllowAll
+		if modeTLV := oscar.FindTLV(attributes, 0xca); !deleted && modeTLV != nil && len(modeTLV.Data) > 0 {
+			mode = models.PDMode(modeTLV.Data[0])
+		}
+
+		if user.PDMode != mode {
+			user.PDMode = mode
+			if err := user.Update(ctx, db, "pd_mode"); err != nil {
+				return errors.Wrap(err, "could not set permit/deny mode")
+			}
+		}
+
+	case FeedbagItemTypePermit, FeedbagItemTypeDeny:
+
+	// The icon hash is in TLV 0xD5 as flags, hash length and hash
+	case FeedbagItemTypeIconInfo:
+		var hash []byte
+		if iconTLV := oscar.FindTLV(attributes, 0xd5); !deleted && iconTLV != nil && len(iconTLV.Data) > 2 {
+			hash = iconTLV.Data[2:]
+		}
+
+		if bytes.Equal(user.IconHash, hash) {
+			return nil
+		}
+
+		user.IconHash = hash
+		if err := user.Update(ctx, db, "icon_hash"); err != nil {
+			return errors.Wrap(err, "could not set buddy icon")
+		}
+
+	default:
+		return nil
+	}
+
+	f.OnlineCh <- user
+	return nil
+}
+
+// addBuddy makes sure there is a buddy relationship for a feedbag buddy so that presence notifications work.
+// Returns nil if there is no user with that screen name.
+func (f *FeedbagService) addBuddy(ctx context.Context, db *bun.DB, user *models.User, screen_name string) (*models.User, error) {
+	buddy, err := models.UserByScreenName(ctx, db, screen_name)
+	if err != nil {
+		return nil, errors.Wrap(err, "error looking for User")
+	}
+	if buddy == nil {
+		return nil, nil
+	}
+
+	count, err := db.NewSelect().Model((*models.Buddy)(nil)).Where("source_uin = ?", user.UIN).Where("with_uin = ?", buddy.UIN).Count(ctx)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	// Already buddies
+	if count > 0 {
+		return buddy, nil
+	}
+
+	rel := &models.Buddy{
+		SourceUIN: user.UIN,
+		WithUIN:   buddy.UIN,
+	}
+	if _, err = db.NewInsert().Model(rel).Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	return buddy, nil
+}
+
+// removeBuddy removes the buddy relationship once the buddy isn't in any of the user's groups anymore
+func (f *FeedbagService) removeBuddy(ctx context.Context, db *bun.DB, user *models.User, screen_name string) error {
+	remaining, err := db.NewSelect().
+		Model((*models.Feedbag)(nil)).
+		Where("screen_name = ?", user.ScreenName).
+		Where("class_id = ?", FeedbagItemTypeUser).
+		Where("name = ?", screen_name).
+		Count(ctx)
+	if err != nil {
+		return errors.Wrap(err, "could not count remaining feedbag buddies")
+	}
+	if remaining > 0 {
+		return nil
+	}
+
+	buddy, err := models.UserByScreenName(ctx, db, screen_name)
+	if err != nil {
+		return errors.Wrap(err, "error looking for User")
+	}
+	if buddy == nil {
+		return nil
+	}
+
+	_, err = db.NewDelete().Model((*models.Buddy)(nil)).Where("source_uin = ?", user.UIN).Where("with_uin = ?", buddy.UIN).Exec(ctx)
+	return err
+}
@@ -0,0 +1,36 @@
+package services
+
+import (
+	"aim-oscar/models"
+	"testing"
+)
+
+func TestSendFeedbagChanges(t *testing.T) {
+	c := newTestClient(t, "toof")
+
+	if err := sendFeedbagChanges(c.session, 0x08, nil); err != nil {
+		t.Fatal(err)
+	}
+	if snac := c.next(); snac != nil {
+		t.Errorf("expected nothing to be sent without changes, got %v", snac)
+	}
+
+	items := []*models.Feedbag{
+		{ScreenName: "toof", GroupId: privacyGroupID, ItemId: 1, ClassId: FeedbagItemTypeDeny, Name: "mike"},
+	}
+	if err := sendFeedbagChanges(c.session, 0x0a, items); err != nil {
+		t.Fatal(err)
+	}
+
+	snac := c.next()
+	if snac == nil || snac.Header.Family != 0x13 || snac.Header.Subtype != 0x0a {
+		t.Fatalf("expected a feedbag delete notification, got %v", snac)
+	}
+	item, err := ReadFeedbagItem(&snac.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if item.Name != "mike" || item.ItemType != FeedbagItemTypeDeny || item.ItemID != 1 {
+		t.Errorf("expected the deleted deny item, got %+v", item)
+	}
+}
@@ -0,0 +1,474 @@
+package services
+
+import (
+	"aim-oscar/aimerror"
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"strconv"
+
+	"github.com/pkg/errors"
+	"github.com/uptrace/bun"
+)
+
+// ICQ meta request types
+const (
+	ICQRequestOfflineMessages       = 0x003c
+	ICQRequestDeleteOfflineMessages = 0x003e
+	ICQRequestMeta                  = 0x07d0
+)
+
+// ICQ meta response types
+const (
+	ICQResponseOfflineMessage     = 0x0041
+	ICQResponseEndOfflineMessages = 0x0042
+	ICQResponseMeta               = 0x07da
+)
+
+// ICQ meta request subtypes
+const (
+	ICQMetaSetBasicInfo  = 0x03ea
+	ICQMetaSetMoreInfo   = 0x03fd
+	ICQMetaSetNotes      = 0x0406
+	ICQMetaFullInfo      = 0x04b2
+	ICQMetaShortInfo     = 0x04ba
+	ICQMetaFullInfoOwner = 0x04d0
+)
+
+// ICQ meta response subtypes
+const (
+	ICQMetaAckBasicInfo  = 0x0064
+	ICQMetaAckMoreInfo   = 0x0078
+	ICQMetaAckNotes      = 0x0082
+	ICQMetaBasicInfo     = 0x00c8
+	ICQMetaMoreInfo      = 0x00dc
+	ICQMetaNotes         = 0x00e6
+	ICQMetaShortInfoResp = 0x0104
+)
+
+const (
+	icqSuccess = 0x0a
+	icqFailure = 0x32
+)
+
+// icqReader reads the little endian values that ICQ packs inside its SNACs
+type icqReader struct {
+	r *bytes.Reader
+}
+
+func (r *icqReader) uint8() (uint8, error) {
+	return r.r.ReadByte()
+}
+
+func (r *icqReader) uint16() (uint16, error) {
+	var x uint16
+	err := binary.Read(r.r, binary.LittleEndian, &x)
+	return x, err
+}
+
+func (r *icqReader) uint32() (uint32, error) {
+	var x uint32
+	err := binary.Read(r.r, binary.LittleEndian, &x)
+	return x, err
+}
+
+// string reads a length prefixed, null terminated string
+func (r *icqReader) string() (string, error) {
+	length, err := r.uint16()
+	if err != nil {
+		return "", err
+	}
+
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r.r, b); err != nil {
+		return "", err
+	}
+	return string(bytes.TrimRight(b, "\x00")), nil
+}
+
+// icqWriter writes the little endian values that ICQ packs inside its SNACs
+type icqWriter struct {
+	bytes.Buffer
+}
+
+func (w *icqWriter) uint8(x uint8) {
+	w.WriteByte(x)
+}
+
+func (w *icqWriter) uint16(x uint16) {
+	binary.Write(w, binary.LittleEndian, x)
+}
+
+func (w *icqWriter) uint32(x uint32) {
+	binary.Write(w, binary.LittleEndian, x)
+}
+
+func (w *icqWriter) string(x string) {
+	w.uint16(uint16(len(x) + 1))
+	w.WriteString(x)
+	w.WriteByte(0)
+}
+
+type icqKey string
+
+func (s icqKey) String() string {
+	return "icq-" + string(s)
+}
+
+var (
+	icqClientKey = icqKey("client")
+)
+
+// NewContextWithICQClient marks a connection whose client speaks the ICQ family 0x15
+func NewContextWithICQClient(ctx context.Context) context.Context {
+	return context.WithValue(ctx, icqClientKey, true)
+}
+
+func ICQClientFromContext(ctx context.Context) bool {
+	icq, _ := ctx.Value(icqClientKey).(bool)
+	return icq
+}
+
+type ICQService struct{}
+
+func (i *ICQService) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
+	session, _ := oscar.SessionFromContext(ctx)
+	logger := session.Logger.With("service", "icq")
+
+	switch snac.Header.Subtype {
+
+	// Client sends a meta request wrapped in TLV 0x1
+	case 0x02:
+		user := models.UserFromContext(ctx)
+		if user == nil {
+			return ctx, aimerror.NoUserInSession
+		}
+
+		tlvs, err := oscar.UnmarshalTLVs(snac.Data.Bytes())
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not unmarshal ICQ request tlvs")
+		}
+
+		requestTLV := oscar.FindTLV(tlvs, 0x01)
+		if requestTLV == nil {
+			return ctx, errors.New("missing ICQ request TLV 0x1")
+		}
+
+		r := &icqReader{bytes.NewReader(requestTLV.Data)}
+		if _, err := r.uint16(); err != nil {
+			return ctx, errors.Wrap(err, "could not read ICQ request length")
+		}
+		if _, err := r.uint32(); err != nil {
+			return ctx, errors.Wrap(err, "could not read ICQ request owner")
+		}
+		requestType, err := r.uint16()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read ICQ request type")
+		}
+		seq, err := r.uint16()
+		if err != nil {
+			return ctx, errors.Wrap(err, "could not read ICQ request sequence")
+		}
+
+		reply := &icqReply{session: session, requestID: snac.Header.RequestID, uin: uint32(user.UIN), seq: seq}
+
+		switch requestType {
+		case ICQRequestOfflineMessages:
+			return ctx, i.sendOfflineMessages(ctx, db, reply, user)
+
+		case ICQRequestDeleteOfflineMessages:
+			messages, err := models.UndeliveredMessages(ctx, db, user.ScreenName)
+			if err != nil {
+				return ctx, err
+			}
+			for _, message := range messages {
+				if err := message.MarkDelivered(ctx, db); err != nil {
+					return ctx, err
+				}
+			}
+			return ctx, nil
+
+		case ICQRequestMeta:
+			subtype, err := r.uint16()
+			if err != nil {
+				return ctx, errors.Wrap(err, "could not read ICQ meta subtype")
+			}
+			return ctx, i.handleMeta(ctx, db, reply, user, subtype, r)
+		}
+
+		logger.Warn(fmt.Sprintf("Unknown ICQ request type 0x%04x", requestType))
+		return ctx, nil
+	}
+
+	logger.Error(fmt.Sprintf("Unknown ICQ family/subtype: 0x15, 0x%02x", snac.Header.Subtype))
+
+	return ctx, nil
+}
+
+// icqReply sends the responses to a single meta request
+type icqReply struct {
+	session   *oscar.Session
+	requestID uint32
+	uin       uint32
+	seq       uint16
+}
+
+func (r *icqReply) send(responseType uint16, payload []byte) error {
+	data := icqWriter{}
+	data.uint16(uint16(8 + len(payload)))
+	data.uint32(r.uin)
+	data.uint16(responseType)
+	data.uint16(r.seq)
+	data.Write(payload)
+
+	responseSnac := oscar.NewSNAC(0x15, 0x03)
+	responseSnac.Header.RequestID = r.requestID
+	responseSnac.WriteTLV(oscar.NewTLV(0x01, data.Bytes()))
+	return sendSNAC(r.session, responseSnac)
+}
+
+// sendMeta sends a meta response, which starts with its subtype and status
+func (r *icqReply) sendMeta(subtype uint16, status uint8, payload []byte) error {
+	data := icqWriter{}
+	data.uint16(subtype)
+	data.uint8(status)
+	data.Write(payload)
+	return r.send(ICQResponseMeta, data.Bytes())
+}
+
+// sendOfflineMessages sends every stored message waiting for the user followed by the end marker. The client
+// asks for them to be deleted once it has them all.
+func (i *ICQService) sendOfflineMessages(ctx context.Context, db *bun.DB, reply *icqReply, user *models.User) error {
+	messages, err := models.UndeliveredMessages(ctx, db, user.ScreenName)
+	if err != nil {
+		return err
+	}
+
+	for _, message := range messages {
+		sender, err := models.UserByScreenName(ctx, db, message.From)
+		if err != nil {
+			return aimerror.FetchingUser(err, message.From)
+		}
+		if sender == nil {
+			continue
+		}
+
+		sent := message.CreatedAt.UTC()
+		data := icqWriter{}
+		data.uint32(uint32(sender.UIN))
+		data.uint16(uint16(sent.Year()))
+		data.uint8(uint8(sent.Month()))
+		data.uint8(uint8(sent.Day()))
+		data.uint8(uint8(sent.Hour()))
+		data.uint8(uint8(sent.Minute()))
+		data.uint8(0x01) // Plain text message
+		data.uint8(0x00) // Flags
+		data.string(message.Contents)
+		if err := reply.send(ICQResponseOfflineMessage, data.Bytes()); err != nil {
+			return err
+		}
+	}
+
+	return reply.send(ICQResponseEndOfflineMessages, []byte{0})
+}
+
+func (i *ICQService) handleMeta(ctx context.Context, db *bun.DB, reply *icqReply, user *models.User, subtype uint16, r *icqReader) error {
+	switch subtype {
+	case ICQMetaFullInfo, ICQMetaFullInfoOwner, ICQMetaShortInfo:
+		uin, err := r.uint32()
+		if err != nil {
+			return errors.Wrap(err, "could not read ICQ info target")
+		}
+
+		target, err := models.UserByUIN(ctx, db, int64(uin))
+		if err != nil {
+			return aimerror.FetchingUser(err, strconv.FormatUint(uint64(uin), 10))
+		}
+
+		canSee := false
+		if target != nil {
+			if canSee, err = CanSee(ctx, db, target, user); err != nil {
+				return err
+			}
+		}
+
+		if subtype == ICQMetaShortInfo {
+			if !canSee {
+				return reply.sendMeta(ICQMetaShortInfoResp, icqFailure, nil)
+			}
+			return reply.sendMeta(ICQMetaShortInfoResp, icqSuccess, icqShortInfo(target, user))
+		}
+
+		if !canSee {
+			return reply.sendMeta(ICQMetaBasicInfo, icqFailure, nil)
+		}
+		if err := reply.sendMeta(ICQMetaBasicInfo, icqSuccess, icqBasicInfo(target, user)); err != nil {
+			return err
+		}
+		if err := reply.sendMeta(ICQMetaMoreInfo, icqSuccess, icqMoreInfo(target)); err != nil {
+			return err
+		}
+		notes := icqWriter{}
+		notes.string(target.ICQAbout)
+		return reply.sendMeta(ICQMetaNotes, icqSuccess, notes.Bytes())
+
+	case ICQMetaSetBasicInfo:
+		fields := []*string{&user.ICQNickname, &user.ICQFirstName, &user.ICQLastName}
+		for _, field := range fields {
+			value, err := r.string()
+			if err != nil {
+				return errors.Wrap(err, "could not read ICQ basic info")
+			}
+			*field = value
+		}
+
+		// The email is the account's email address, which can't be changed from the client
+		if _, err := r.string(); err != nil {
+			return errors.Wrap(err, "could not read ICQ email")
+		}
+
+		for _, field := range []*string{&user.ICQCity, &user.ICQState, &user.ICQPhone} {
+			value, err := r.string()
+			if err != nil {
+				return errors.Wrap(err, "could not read ICQ basic info")
+			}
+			*field = value
+		}
+
+		// Fax, street and cellular aren't kept
+		for n := 0; n < 3; n++ {
+			if _, err := r.string(); err != nil {
+				return errors.Wrap(err, "could not read ICQ basic info")
+			}
+		}
+
+		zip, err := r.string()
+		if err != nil {
+			return errors.Wrap(err, "could not read ICQ zip")
+		}
+		country, err := r.uint16()
+		if err != nil {
+			return errors.Wrap(err, "could not read ICQ country")
+		}
+		user.ICQZip = zip
+		user.ICQCountry = country
+
+		// The GMT offset isn't kept. Clients that end the request before the publish email flag leave it as it was.
+		if _, err := r.uint8(); err == nil {
+			if publish, err := r.uint8(); err == nil {
+				user.ICQPublishEmail = publish == 1
+			}
+		}
+
+		if err := user.Update(ctx, db, "icq_nickname", "icq_first_name", "icq_last_name", "icq_city", "icq_state", "icq_phone", "icq_zip", "icq_country", "icq_publish_email"); err != nil {
+			return err
+		}
+		return reply.sendMeta(ICQMetaAckBasicInfo, icqSuccess, nil)
+
+	case ICQMetaSetMoreInfo:
+		age, err := r.uint16()
+		if err != nil {
+			return errors.Wrap(err, "could not read ICQ age")
+		}
+		gender, err := r.uint8()
+		if err != nil {
+			return errors.Wrap(err, "could not read ICQ gender")
+		}
+		homepage, err := r.string()
+		if err != nil {
+			return errors.Wrap(err, "could not read ICQ homepage")
+		}
+
+		user.ICQAge = age
+		user.ICQGender = gender
+		user.ICQHomepage = homepage
+		if err := user.Update(ctx, db, "icq_age", "icq_gender", "icq_homepage"); err != nil {
+			return err
+		}
+		return reply.sendMeta(ICQMetaAckMoreInfo, icqSuccess, nil)
+
+	case ICQMetaSetNotes:
+		about, err := r.string()
+		if err != nil {
+			return errors.Wrap(err, "could not read ICQ notes")
+		}
+
+		user.ICQAbout = about
+		if err := user.Update(ctx, db, "icq_about"); err != nil {
+			return err
+		}
+		return reply.sendMeta(ICQMetaAckNotes, icqSuccess, nil)
+	}
+
+	reply.session.Logger.Warn(fmt.Sprintf("Unknown ICQ meta request subtype 0x%04x", subtype))
+	return nil
+}
+
+// icqEmail is the email shown to a viewer of the user's info. The email is the one the account signs up and
+// verifies with, so it's only shown to the user themselves or when an ICQ user chose to publish it.
+func icqEmail(user *models.User, viewer *models.User) string {
+	if !user.RegisteredWithICQ() {
+		return ""
+	}
+	if user.ICQPublishEmail || user.UIN == viewer.UIN {
+		return user.Email
+	}
+	return ""
+}
+
+func icqShortInfo(user *models.User, viewer *models.User) []byte {
+	w := icqWriter{}
+	w.string(user.ICQNickname)
+	w.string(user.ICQFirstName)
+	w.string(user.ICQLastName)
+	w.string(icqEmail(user, viewer))
+	w.uint8(0) // Authorization isn't required
+	w.uint8(0) // Unknown
+	w.uint8(user.ICQGender)
+	return w.Bytes()
+}
+
+func icqBasicInfo(user *models.User, viewer *models.User) []byte {
+	publishEmail := uint8(0)
+	if user.ICQPublishEmail {
+		publishEmail = 1
+	}
+
+	w := icqWriter{}
+	w.string(user.ICQNickname)
+	w.string(user.ICQFirstName)
+	w.string(user.ICQLastName)
+	w.string(icqEmail(user, viewer))
+	w.string(user.ICQCity)
+	w.string(user.ICQState)
+	w.string(user.ICQPhone)
+	w.string("") // Fax
+	w.string("") // Street
+	w.string("") // Cellular
+	w.string(user.ICQZip)
+	w.uint16(user.ICQCountry)
+	w.uint8(0) // GMT offset
+	w.uint8(0) // Authorization isn't required
+	w.uint8(0) // Web aware
+	w.uint8(0) // Direct connection permissions
+	w.uint8(publishEmail)
+	return w.Bytes()
+}
+
+func icqMoreInfo(user *models.User) []byte {
+	w := icqWriter{}
+	w.uint16(user.ICQAge)
+	w.uint8(user.ICQGender)
+	w.string(user.ICQHomepage)
+	w.uint16(0) // Birth year
+	w.uint8(0)  // Birth month
+	w.uint8(0)  // Birth day
+	w.uint8(0)  // Languages
+	w.uint8(0)
+	w.uint8(0)
+	return w.Bytes()
+}
@@ -0,0 +1,39 @@
+package services
+
+import (
+	"aim-oscar/models"
+	"testing"
+)
+
+func TestICQEmail(t *testing.T) {
+	icqUser := &models.User{UIN: 100001, ScreenName: "100001", Email: "toof@example.com"}
+	published := &models.User{UIN: 100002, ScreenName: "100002", Email: "mike@example.com", ICQPublishEmail: true}
+	aimUser := &models.User{UIN: 3, ScreenName: "toof", Email: "aim@example.com", ICQPublishEmail: true}
+	viewer := &models.User{UIN: 100003, ScreenName: "100003"}
+
+	tests := []struct {
+		name     string
+		user     *models.User
+		viewer   *models.User
+		expected string
+	}{
+		{"unpublished", icqUser, viewer, ""},
+		{"published", published, viewer, "mike@example.com"},
+		{"own info", icqUser, icqUser, "toof@example.com"},
+		{"aim account", aimUser, viewer, ""},
+		{"own aim account", aimUser, aimUser, ""},
+	}
+
+	for _, test := range tests {
+		if email := icqEmail(test.user, test.viewer); email != test.expected {
+			t.Errorf("%s: expected %q, got %q", test.name, test.expected, email)
+		}
+	}
+
+	if info := icqBasicInfo(published, viewer); info[len(info)-1] != 1 {
+		t.Error("expected basic info to say the email is published")
+	}
+	if info := icqBasicInfo(icqUser, viewer); info[len(info)-1] != 0 {
+		t.Error("expected basic info to say the email isn't published")
+	}
+}
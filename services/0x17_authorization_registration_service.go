@@ -1,45 +1,157 @@
 package services
 
 import (
-	"bytes"
 	"context"
-	"crypto/md5"
 	"crypto/rand"
 	"encoding/base32"
-	"encoding/json"
 	"fmt"
-	"io"
+	"net"
+	"time"
 
 	"aim-oscar/models"
 	"aim-oscar/oscar"
+	"aim-oscar/util"
 
 	"github.com/pkg/errors"
 	"github.com/uptrace/bun"
 )
 
 const CIPHER_LENGTH = 64
-const AIM_MD5_STRING = "AOL Instant Messenger (SM)"
 
 var ROAST = [16]byte{0xF3, 0x26, 0x81, 0xC4, 0x39, 0x86, 0xDB, 0x92, 0x71, 0xA3, 0xB9, 0xE6, 0x53, 0x7A, 0x95, 0x7C}
 
+// roast XORs a password with the ROAST key. Roasting is its own inverse, so this also recovers a roasted password.
 func roast(password string) []byte {
-	ret := make([]byte, 0)
-	for i, letter := range password {
-		ret = append(ret, byte(letter)^ROAST[i%16])
+	ret := make([]byte, 0, len(password))
+	for i := 0; i < len(password); i++ {
+		ret = append(ret, password[i]^ROAST[i%16])
 	}
 	return ret
 }
 
-type AuthorizationCookie struct {
-	UIN int64
-	X   string
+// Clients are sent to BOS as soon as they log in, so the cookie doesn't need to last long
+const loginCookieLifetime = 2 * time.Minute
+
+// LoginCookies issues and redeems the cookies that take users from the authorizer to BOS. The authorizer and BOS
+// need the same Key when they run as separate servers.
+type LoginCookies struct {
+	Key []byte
+	// BindIP only lets the cookie be used from the IP address the user logged in from
+	BindIP bool
+}
+
+// Issue makes a cookie for the user, who has just logged in and been given a new cipher by newLoginNonce
+func (c *LoginCookies) Issue(session *oscar.Session, user *models.User, now time.Time) ([]byte, error) {
+	cookie := &oscar.LoginCookie{
+		UIN:       user.UIN,
+		Nonce:     user.Cipher,
+		ExpiresAt: now.Add(loginCookieLifetime).Unix(),
+	}
+	if c.BindIP {
+		cookie.IP = sessionIP(session)
+	}
+
+	return oscar.SignLoginCookie(c.Key, cookie)
+}
+
+// Redeem checks a cookie made by Issue and finds the user it was made for. Each cookie can only be used once.
+func (c *LoginCookies) Redeem(ctx context.Context, db *bun.DB, session *oscar.Session, data []byte, now time.Time) (*models.User, error) {
+	cookie, err := oscar.VerifyLoginCookie(c.Key, data, now)
+	if err != nil {
+		return nil, err
+	}
+
+	if cookie.IP != "" && cookie.IP != sessionIP(session) {
+		return nil, errors.New("login cookie used from another IP address")
+	}
+
+	user, err := models.UserByUIN(ctx, db, cookie.UIN)
+	if err != nil {
+		return nil, errors.Wrap(err, "could not get User by UIN")
+	}
+	if user == nil {
+		return nil, errors.New("no such user")
+	}
+
+	consumed, err := user.ConsumeCipher(ctx, db, cookie.Nonce)
+	if err != nil {
+		return nil, err
+	}
+	if !consumed {
+		return user, errors.New("login cookie already used")
+	}
+
+	return user, nil
+}
+
+// sessionIP is the IP address a session is connected from
+func sessionIP(session *oscar.Session) string {
+	host, _, err := net.SplitHostPort(session.RemoteAddr().String())
+	if err != nil {
+		return session.RemoteAddr().String()
+	}
+	return host
+}
+
+type authKey string
+
+func (s authKey) String() string {
+	return "auth-" + string(s)
+}
+
+var (
+	challengeKey = authKey("challenge")
+)
+
+// newContextWithChallenge keeps the MD5 challenge a connection was sent, which its login is hashed with. It's kept
+// with the connection rather than the user so that asking for a challenge can't interrupt anyone else's login.
+func newContextWithChallenge(ctx context.Context, challenge string) context.Context {
+	return context.WithValue(ctx, challengeKey, challenge)
+}
+
+func challengeFromContext(ctx context.Context) string {
+	challenge, _ := ctx.Value(challengeKey).(string)
+	return challenge
+}
+
+// newLoginNonce gives a user who just logged in a new cipher, which their login cookie is good for until they sign
+// on to BOS with it
+func newLoginNonce(ctx context.Context, db *bun.DB, user *models.User) error {
+	cipher, err := generateCipher()
+	if err != nil {
+		return err
+	}
+	user.Cipher = cipher
+	return user.Update(ctx, db, "cipher")
 }
 
 type AuthorizationRegistrationService struct {
 	BOSAddress string
+	Cookies    *LoginCookies
+}
+
+// LoginRefusedError is a login that failed in a way the client should be told about, with the error code for it
+type LoginRefusedError struct {
+	Code   uint16
+	Reason string
+}
+
+func (e *LoginRefusedError) Error() string {
+	return fmt.Sprintf("login refused with code 0x%02x: %s", e.Code, e.Reason)
+}
+
+// SendLoginRefused tells a client that logged in on channel 1 that their login failed, then hangs up
+func SendLoginRefused(session *oscar.Session, screenName string, code uint16) error {
+	errFlap := oscar.NewFLAP(4)
+	errFlap.Data.WriteBinary(oscar.NewTLV(0x01, []byte(screenName)))
+	errFlap.Data.WriteBinary(oscar.NewTLV(0x08, util.Word(code)))
+	if err := session.Send(errFlap); err != nil {
+		return err
+	}
+	return session.Disconnect()
 }
 
-func AuthenticateFLAPCookie(ctx context.Context, db *bun.DB, flap *oscar.FLAP) (*models.User, string, error) {
+func AuthenticateFLAPCookie(ctx context.Context, db *bun.DB, cookies *LoginCookies, flap *oscar.FLAP) (*models.User, string, error) {
 	// Otherwise this is a protocol negotiation from the client. They're likely trying to connect
 	// and sending a cookie to verify who they are.
 	tlvs, err := oscar.UnmarshalTLVs(flap.Data.Bytes()[4:])
@@ -47,6 +159,11 @@ func AuthenticateFLAPCookie(ctx context.Context, db *bun.DB, flap *oscar.FLAP) (
 		return nil, "", errors.Wrap(err, "authentication request missing TLVs")
 	}
 
+	session, err := oscar.SessionFromContext(ctx)
+	if err != nil {
+		return nil, "", errors.Wrap(err, "could not extract session from context")
+	}
+
 	/*
 		There are 2 ways that clients authenticate: channel 1 auth w/ roasted password, or via MD5 hash. The
 		former is used by the 1.0 client, whereas the second is used by 3.5 and up (I believe).
@@ -60,51 +177,165 @@ func AuthenticateFLAPCookie(ctx context.Context, db *bun.DB, flap *oscar.FLAP) (
 	// This is a roasted password auth
 	if screenNameTLV != nil && roastedPWTLV != nil {
 		screenName := string(screenNameTLV.Data)
-		user, err := models.UserByScreenName(ctx, db, screenName)
+		if err := models.ValidateLogin(screenName); err != nil {
+			return nil, screenName, &LoginRefusedError{Code: 0x01, Reason: err.Error()} // error code 0x01: Invalid nick or password
+		}
+
+		user, err := models.UserByLogin(ctx, db, screenName)
 		if err != nil {
 			return nil, screenName, errors.Wrap(err, "could not get User by Screen Name")
 		}
 
-		if !bytes.Equal(roastedPWTLV.Data, roast(user.Password)) {
-			return nil, screenName, errors.New("invalid password")
+		now := time.Now()
+		ip := sessionIP(session)
+		code, err := loginLockout(ctx, db, screenName, user, ip, now)
+		if err != nil {
+			return nil, screenName, err
+		}
+		if code != 0 {
+			return nil, screenName, &LoginRefusedError{Code: code, Reason: "locked out"}
+		}
+
+		// Users that don't exist are told the same thing as users with a bad password
+		if user == nil {
+			if err := models.RecordLoginAttempt(ctx, db, screenName, nil, ip, models.LoginResultNoSuchUser, now); err != nil {
+				return nil, screenName, err
+			}
+			return nil, screenName, &LoginRefusedError{Code: 0x04, Reason: "no such user"} // error code 0x04: Incorrect nick or password
+		}
+
+		if !user.CheckPassword(string(roast(string(roastedPWTLV.Data)))) {
+			if err := models.RecordLoginAttempt(ctx, db, screenName, user, ip, models.LoginResultBadPassword, now); err != nil {
+				return nil, screenName, err
+			}
+			return nil, screenName, &LoginRefusedError{Code: 0x04, Reason: "invalid password"} // error code 0x04: Incorrect nick or password
+		}
+
+		if err := models.RecordLoginAttempt(ctx, db, screenName, user, ip, models.LoginResultSuccess, now); err != nil {
+			return nil, screenName, err
 		}
 
 		return user, screenName, nil
 	}
 
-	// This is MD5 hash auth
+	// This is the cookie the authorizer handed out after an MD5 hash auth
 	cookieTLV := oscar.FindTLV(tlvs, 0x6)
 	if cookieTLV == nil {
 		return nil, screenName, errors.New("authentication request missing Cookie TLV 0x6")
 	}
 
-	auth := AuthorizationCookie{}
-	if err := json.Unmarshal(cookieTLV.Data, &auth); err != nil {
-		return nil, screenName, errors.Wrap(err, "could not unmarshal cookie")
+	user, err := cookies.Redeem(ctx, db, session, cookieTLV.Data, time.Now())
+	if user != nil {
+		screenName = user.ScreenName
+	}
+	if err != nil {
+		return nil, screenName, err
+	}
+
+	return user, screenName, nil
+}
+
+// sendAuthError tells the client their sign on failed with an error code
+func sendAuthError(session *oscar.Session, screenNameTLV *oscar.TLV, code uint16) error {
+	errSnac := oscar.NewSNAC(0x17, 0x03)
+	errSnac.Data.WriteBinary(screenNameTLV)
+	errSnac.Data.WriteBinary(oscar.NewTLV(0x08, util.Word(code)))
+	return sendSNAC(session, errSnac)
+}
+
+// refuseLogin tells the client their sign on failed with an error code and asks them to leave
+func refuseLogin(session *oscar.Session, screenNameTLV *oscar.TLV, code uint16) error {
+	if err := sendAuthError(session, screenNameTLV, code); err != nil {
+		return err
+	}
+	return session.Send(oscar.NewFLAP(4))
+}
+
+// loginLockout checks if a login is locked out after too many failed logins for the account or from the address.
+// It records the refused attempt and returns the error code to refuse it with, or 0 if the login can go ahead.
+// Logins that don't match any user are locked out the same way, so a lockout doesn't give away that an account
+// exists.
+func loginLockout(ctx context.Context, db *bun.DB, login string, user *models.User, ip string, now time.Time) (uint16, error) {
+	ipLockedUntil, err := models.IPLockedUntil(ctx, db, ip, now)
+	if err != nil {
+		return 0, err
+	}
+	if now.Before(ipLockedUntil) {
+		return 0x18, models.RecordLoginAttempt(ctx, db, login, user, ip, models.LoginResultRateLimited, now) // error code 0x18: Rate limit exceeded
 	}
 
-	user, err := models.UserByUIN(ctx, db, auth.UIN)
+	accountLockedUntil, err := models.AccountLockedUntil(ctx, db, login, now)
 	if err != nil {
-		return nil, screenName, errors.Wrap(err, "could not get User by UIN")
+		return 0, err
+	}
+	if now.Before(accountLockedUntil) {
+		return 0x11, models.RecordLoginAttempt(ctx, db, login, user, ip, models.LoginResultLocked, now) // error code 0x11: Suspended account
 	}
 
-	screenName = user.ScreenName
+	return 0, nil
+}
 
-	h := md5.New()
-	io.WriteString(h, user.Cipher)
-	io.WriteString(h, user.Password)
-	io.WriteString(h, AIM_MD5_STRING)
-	expectedPasswordHash := fmt.Sprintf("%x", h.Sum(nil))
+// roastedLogin returns the login TLV of a channel 1 sign on with a roasted password, or nil if it's some other kind
+// of sign on
+func roastedLogin(flap *oscar.FLAP) *oscar.TLV {
+	if len(flap.Data.Bytes()) < 4 {
+		return nil
+	}
 
-	// Make sure the hash passed in matches the one from the DB
-	if expectedPasswordHash != auth.X {
-		return nil, screenName, errors.New("unexpected cookie hash")
+	tlvs, err := oscar.UnmarshalTLVs(flap.Data.Bytes()[4:])
+	if err != nil {
+		return nil
 	}
 
-	return user, screenName, nil
+	loginTLV := oscar.FindTLV(tlvs, 0x1)
+	if loginTLV == nil || oscar.FindTLV(tlvs, 0x2) == nil {
+		return nil
+	}
+	return loginTLV
 }
 
-func (a *AuthorizationRegistrationService) GenerateCipher() (string, error) {
+// IsRoastedLogin returns true if a channel 1 sign on is a client logging in with its roasted password rather than
+// a cookie
+func IsRoastedLogin(flap *oscar.FLAP) bool {
+	return roastedLogin(flap) != nil
+}
+
+// IsICQLogin returns true if a channel 1 sign on is an ICQ client logging in to the authorizer with its UIN
+// and roasted password
+func IsICQLogin(flap *oscar.FLAP) bool {
+	uinTLV := roastedLogin(flap)
+	return uinTLV != nil && models.IsUIN(string(uinTLV.Data))
+}
+
+// SendBOSRedirect answers a channel 1 login with the BOS address and a cookie, then hangs up. The client signs on
+// to BOS with the cookie. ICQ clients always log in this way, AIM clients do when the authorizer has a listener of
+// its own.
+func SendBOSRedirect(ctx context.Context, db *bun.DB, session *oscar.Session, cookies *LoginCookies, user *models.User, bosAddress string) error {
+	if !user.Verified || user.DeletedAt != nil {
+		return SendLoginRefused(session, user.ScreenName, 0x07) // error code 0x07: Invalid account
+	}
+
+	if err := newLoginNonce(ctx, db, user); err != nil {
+		return err
+	}
+
+	cookie, err := cookies.Issue(session, user, time.Now())
+	if err != nil {
+		return err
+	}
+
+	redirectFlap := oscar.NewFLAP(4)
+	redirectFlap.Data.WriteBinary(oscar.NewTLV(0x01, []byte(user.ScreenName)))
+	redirectFlap.Data.WriteBinary(oscar.NewTLV(0x05, []byte(bosAddress)))
+	redirectFlap.Data.WriteBinary(oscar.NewTLV(0x06, cookie))
+	if err := session.Send(redirectFlap); err != nil {
+		return err
+	}
+
+	return session.Disconnect()
+}
+
+func generateCipher() (string, error) {
 	randomBytes := make([]byte, 64)
 	_, err := rand.Read(randomBytes)
 	if err != nil {
@@ -113,6 +344,10 @@ func (a *AuthorizationRegistrationService) GenerateCipher() (string, error) {
 	return base32.StdEncoding.EncodeToString(randomBytes)[:CIPHER_LENGTH], nil
 }
 
+func (a *AuthorizationRegistrationService) GenerateCipher() (string, error) {
+	return generateCipher()
+}
+
 func (a *AuthorizationRegistrationService) HandleSNAC(ctx context.Context, db *bun.DB, snac *oscar.SNAC) (context.Context, error) {
 	session, err := oscar.SessionFromContext(ctx)
 	logger := session.Logger.With("service", "authorization/registration")
@@ -133,36 +368,25 @@ func (a *AuthorizationRegistrationService) HandleSNAC(ctx context.Context, db *b
 			return ctx, errors.New("missing screen_name TLV")
 		}
 
-		// Fetch the user
-		user, err := models.UserByScreenName(ctx, db, string(screenNameTLV.Data))
-		if err != nil {
-			return ctx, err
-		}
-		if user == nil {
-			snac := oscar.NewSNAC(0x17, 0x03)
-			snac.Data.WriteBinary(screenNameTLV)
-			snac.Data.WriteBinary(oscar.NewTLV(0x08, []byte{0, 4}))
-			resp := oscar.NewFLAP(2)
-			resp.Data.WriteBinary(snac)
-			return ctx, session.Send(resp)
+		// Logins that break the screen name rules could never have been registered
+		if err := models.ValidateLogin(string(screenNameTLV.Data)); err != nil {
+			return ctx, sendAuthError(session, screenNameTLV, 0x01) // error code 0x01: Invalid nick or password
 		}
 
-		// Create cipher for this user
-		user.Cipher, err = a.GenerateCipher()
+		// Create a challenge for this connection. Screen names that don't exist get one too, so that asking for a
+		// challenge doesn't give away which screen names are registered. Their login fails like a bad password would.
+		cipher, err := a.GenerateCipher()
 		if err != nil {
 			return ctx, err
 		}
-		if err = user.Update(ctx, db, "cipher"); err != nil {
-			return ctx, err
-		}
 
 		snac := oscar.NewSNAC(0x17, 0x07)
-		snac.Data.WriteUint16(uint16(len(user.Cipher)))
-		snac.Data.WriteString(user.Cipher)
+		snac.Data.WriteUint16(uint16(len(cipher)))
+		snac.Data.WriteString(cipher)
 
 		resp := oscar.NewFLAP(2)
 		resp.Data.WriteBinary(snac)
-		return ctx, session.Send(resp)
+		return newContextWithChallenge(ctx, cipher), session.Send(resp)
 
 	// Client Authorization Request
 	case 0x02:
@@ -176,21 +400,39 @@ func (a *AuthorizationRegistrationService) HandleSNAC(ctx context.Context, db *b
 			return ctx, errors.New("missing screen_name TLV 0x1")
 		}
 
+		// The login is hashed with the challenge this connection asked for with 0x17/0x06
+		challenge := challengeFromContext(ctx)
+
 		screen_name := string(screenNameTLV.Data)
+		if err := models.ValidateLogin(screen_name); err != nil {
+			logger.Info("Invalid login", "screen_name", screen_name, "err", err.Error())
+			return ctx, sendAuthError(session, screenNameTLV, 0x01) // error code 0x01: Invalid nick or password
+		}
+
 		ctx := context.Background()
-		user, err := models.UserByScreenName(ctx, db, screen_name)
+		user, err := models.UserByLogin(ctx, db, screen_name)
+		if err != nil {
+			return ctx, err
+		}
+
+		now := time.Now()
+		ip := sessionIP(session)
+		code, err := loginLockout(ctx, db, screen_name, user, ip, now)
 		if err != nil {
 			return ctx, err
 		}
+		if code != 0 {
+			logger.Info("Login locked out", "screen_name", screen_name, "code", code)
+			return ctx, refuseLogin(session, screenNameTLV, code)
+		}
 
+		// Users that don't exist are told the same thing as users with a bad password
 		if user == nil {
 			logger.Info("User does not exist", "screen_name", screen_name)
-			snac := oscar.NewSNAC(0x17, 0x03)
-			snac.Data.WriteBinary(screenNameTLV)
-			snac.Data.WriteBinary(oscar.NewTLV(0x08, []byte{0, 4}))
-			resp := oscar.NewFLAP(2)
-			resp.Data.WriteBinary(snac)
-			return ctx, session.Send(resp)
+			if err := models.RecordLoginAttempt(ctx, db, screen_name, nil, ip, models.LoginResultNoSuchUser, now); err != nil {
+				return ctx, err
+			}
+			return ctx, refuseLogin(session, screenNameTLV, 0x04) // error code 0x04: Incorrect nick or password
 		}
 
 		logger.Info("Attempting to authenticate", "screen_name", screen_name)
@@ -200,26 +442,19 @@ func (a *AuthorizationRegistrationService) HandleSNAC(ctx context.Context, db *b
 			return ctx, errors.New("missing password hash TLV 0x25")
 		}
 
-		// Compute password has that we expect the client to send back if the password was right
-		h := md5.New()
-		io.WriteString(h, user.Cipher)
-		io.WriteString(h, user.Password)
-		io.WriteString(h, AIM_MD5_STRING)
-		expectedPasswordHash := h.Sum(nil)
-
-		if !bytes.Equal(expectedPasswordHash, passwordHashTLV.Data) {
+		// Newer clients send TLV 0x4C to say they hashed the MD5 of the password rather than the password itself.
+		// Older clients can't log in once the user's password is hashed, since that needs the plaintext password.
+		hashedPassword := oscar.FindTLV(tlvs, 0x4C) != nil
+		if challenge == "" || !user.CheckMD5Login(challenge, passwordHashTLV.Data, hashedPassword) {
 			logger.Info("Invalid password", "screen_name", screen_name)
-			// Tell the client this was a bad password
-			badPasswordSnac := oscar.NewSNAC(0x17, 0x03)
-			badPasswordSnac.Data.WriteBinary(screenNameTLV)
-			badPasswordSnac.Data.WriteBinary(oscar.NewTLV(0x08, []byte{0, 4})) // incorrect nick/pass
-			badPasswordFlap := oscar.NewFLAP(2)
-			badPasswordFlap.Data.WriteBinary(badPasswordSnac)
-			session.Send(badPasswordFlap)
+			if err := models.RecordLoginAttempt(ctx, db, screen_name, user, ip, models.LoginResultBadPassword, now); err != nil {
+				return ctx, err
+			}
+			return ctx, refuseLogin(session, screenNameTLV, 0x04) // error code 0x04: Incorrect nick or password
+		}
 
-			// Tell them to leave
-			discoFlap := oscar.NewFLAP(4)
-			return ctx, session.Send(discoFlap)
+		if err := models.RecordLoginAttempt(ctx, db, screen_name, user, ip, models.LoginResultSuccess, now); err != nil {
+			return ctx, err
 		}
 
 		// Only users that have verified their email can use the service
@@ -244,12 +479,13 @@ func (a *AuthorizationRegistrationService) HandleSNAC(ctx context.Context, db *b
 		authSnac.Data.WriteBinary(screenNameTLV)
 		authSnac.Data.WriteBinary(oscar.NewTLV(0x5, []byte(a.BOSAddress)))
 
-		cookie, err := json.Marshal(AuthorizationCookie{
-			UIN: user.UIN,
-			X:   fmt.Sprintf("%x", expectedPasswordHash),
-		})
+		if err := newLoginNonce(ctx, db, user); err != nil {
+			return ctx, err
+		}
+
+		cookie, err := a.Cookies.Issue(session, user, time.Now())
 		if err != nil {
-			return ctx, errors.Wrap(err, "could not marshal authorization cookie")
+			return ctx, err
 		}
 
 		authSnac.Data.WriteBinary(oscar.NewTLV(0x6, cookie))
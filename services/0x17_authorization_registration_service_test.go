@@ -1,7 +1,9 @@
 package services
 
 import (
+	"aim-oscar/oscar"
 	"bytes"
+	"context"
 	"testing"
 )
 
@@ -12,3 +14,40 @@ func TestRoast(t *testing.T) {
 		t.Errorf("expected %+v, but got %+v", expected, result)
 	}
 }
+
+func TestKeyRequestKeepsChallengePerConnection(t *testing.T) {
+	a := &AuthorizationRegistrationService{}
+
+	keyRequest := func(c *testClient) (context.Context, string) {
+		snac := oscar.NewSNAC(0x17, 0x06)
+		snac.WriteTLV(oscar.NewTLV(0x01, []byte("toof")))
+
+		ctx, err := a.HandleSNAC(c.ctx, nil, snac)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		resp := c.next()
+		if resp == nil || resp.Header.Subtype != 0x07 {
+			t.Fatalf("expected a key response, got %v", resp)
+		}
+		key, err := resp.Data.ReadLPUint16String()
+		if err != nil {
+			t.Fatal(err)
+		}
+		return ctx, key
+	}
+
+	victimCtx, victimKey := keyRequest(newTestClient(t, ""))
+	strangerCtx, strangerKey := keyRequest(newTestClient(t, ""))
+
+	if challengeFromContext(victimCtx) != victimKey {
+		t.Error("expected the connection to keep the challenge it was sent")
+	}
+	if challengeFromContext(strangerCtx) != strangerKey || strangerKey == victimKey {
+		t.Error("expected another connection asking for the same screen name to get its own challenge")
+	}
+	if challengeFromContext(victimCtx) != victimKey {
+		t.Error("expected another connection's key request not to change the challenge")
+	}
+}
@@ -10,3 +10,34 @@ import (
 type Service interface {
 	HandleSNAC(context.Context, *bun.DB, *oscar.SNAC) (context.Context, error)
 }
+
+// SignOffService is a service that keeps state for signed on users, which it forgets when they sign off
+type SignOffService interface {
+	SignOff(screenName string)
+}
+
+// SessionFinder looks up the sessions of a user who is signed on
+type SessionFinder interface {
+	// GetSession returns the user's BOS connection
+	GetSession(screen_name string) *oscar.Session
+	// GetSessionForFamily returns the connection that handles a SNAC family
+	GetSessionForFamily(screen_name string, family uint16) *oscar.Session
+	// GetChatSession returns the user's connection to a chat room
+	GetChatSession(screen_name string, roomCookie string) *oscar.Session
+}
+
+func sendSNAC(session *oscar.Session, snac *oscar.SNAC) error {
+	flap := oscar.NewFLAP(2)
+	flap.Data.WriteBinary(snac)
+	return session.Send(flap)
+}
+
+// sendSNACError tells the client that their request to a family failed with an error code, like
+// 0x04 (recipient not logged in) or 0x14 (no match)
+func sendSNACError(session *oscar.Session, family uint16, code uint16) error {
+	errSnac := oscar.NewSNAC(family, 0x01)
+	errSnac.Data.WriteUint16(code)
+	errFlap := oscar.NewFLAP(2)
+	errFlap.Data.WriteBinary(errSnac)
+	return session.Send(errFlap)
+}
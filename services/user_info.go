@@ -0,0 +1,108 @@
+package services
+
+import (
+	"aim-oscar/models"
+	"aim-oscar/oscar"
+	"aim-oscar/util"
+	"time"
+)
+
+// User class flags in user info TLV 0x01
+const (
+	UserClassUnconfirmed = 0x0001
+	UserClassAdmin       = 0x0002
+	UserClassAOL         = 0x0004
+	UserClassCommercial  = 0x0008
+	UserClassFree        = 0x0010
+	UserClassAway        = 0x0020
+	UserClassICQ         = 0x0040
+	UserClassWireless    = 0x0080
+	UserClassBot         = 0x0400
+)
+
+// UserClass computes the class flags clients use to decorate a user in their buddy list. Nobody here is an AOL
+// member, everyone is a free AIM user or an ICQ user.
+func UserClass(user *models.User) uint16 {
+	var class uint16
+	if models.IsUIN(user.ScreenName) {
+		class |= UserClassICQ
+	} else {
+		class |= UserClassFree
+	}
+	if !user.Verified {
+		class |= UserClassUnconfirmed
+	}
+	if user.Admin {
+		class |= UserClassAdmin
+	}
+	if user.Bot {
+		class |= UserClassBot
+	}
+	// AIM clients show a user as away from the class rather than the status
+	if user.AwayMessage != "" {
+		class |= UserClassAway
+	}
+	return class
+}
+
+// UserInfoTLVs are the TLVs of a user's info block. The user's BOS session has the parts that only exist while
+// they're signed on, it's nil if they're offline.
+func UserInfoTLVs(user *models.User, session *oscar.Session) []*oscar.TLV {
+	tlvs := []*oscar.TLV{
+		oscar.NewTLV(0x01, util.Word(UserClass(user))),                // User class
+		oscar.NewTLV(0x06, util.Dword(uint32(user.Status.Flags()))),   // User status
+		oscar.NewTLV(0x05, util.Dword(uint32(user.CreatedAt.Unix()))), // Member since
+		IdleTLV(session), // Idle time
+	}
+
+	if session != nil {
+		if !session.SignonAt.IsZero() {
+			tlvs = append(tlvs, oscar.NewTLV(0x03, util.Dword(uint32(session.SignonAt.Unix())))) // Online since
+		}
+
+		if capabilities := session.Capabilities(); len(capabilities) > 0 {
+			tlvs = append(tlvs, oscar.NewTLV(0x0d, oscar.MarshalCapabilities(capabilities))) // Capabilities
+		}
+	}
+
+	if iconTLV := BuddyIconTLV(user); iconTLV != nil {
+		tlvs = append(tlvs, iconTLV)
+	}
+
+	return tlvs
+}
+
+// Supports returns true if a signed on user's client said it supports a capability. Clients that never sent a
+// capability list are assumed to support everything, older clients don't send one.
+func Supports(sessions SessionFinder, screen_name string, c oscar.Capability) bool {
+	session := sessions.GetSession(screen_name)
+	if session == nil {
+		return false
+	}
+	if len(session.Capabilities()) == 0 {
+		return true
+	}
+	return session.HasCapability(c)
+}
+
+// WriteUserInfo writes a user's info block: their screen name, warning level and info TLVs
+func WriteUserInfo(buf *oscar.Buffer, user *models.User, session *oscar.Session) {
+	buf.WriteLPString(user.ScreenName)
+	buf.WriteUint16(user.CurrentWarningLevel())
+
+	tlvs := UserInfoTLVs(user, session)
+	buf.WriteUint16(uint16(len(tlvs)))
+	for _, tlv := range tlvs {
+		buf.WriteBinary(tlv)
+	}
+}
+
+// IdleTLV is the user info TLV 0x0F with how many seconds a user has been idle, taken from their BOS session.
+// Users who are active or signed off have an idle time of 0.
+func IdleTLV(session *oscar.Session) *oscar.TLV {
+	var idle time.Duration
+	if session != nil {
+		idle = session.IdleTime(time.Now())
+	}
+	return oscar.NewTLV(0x0f, util.Dword(uint32(idle.Seconds())))
+}
@@ -0,0 +1,25 @@
+package services
+
+import (
+	"aim-oscar/models"
+	"testing"
+)
+
+func TestUserClass(t *testing.T) {
+	tests := []struct {
+		user     *models.User
+		expected uint16
+	}{
+		{&models.User{ScreenName: "toof", Verified: true}, UserClassFree},
+		{&models.User{ScreenName: "toof"}, UserClassFree | UserClassUnconfirmed},
+		{&models.User{ScreenName: "toof", Verified: true, AwayMessage: "brb"}, UserClassFree | UserClassAway},
+		{&models.User{ScreenName: "toof", Verified: true, Admin: true, Bot: true}, UserClassFree | UserClassAdmin | UserClassBot},
+		{&models.User{ScreenName: "100001", Verified: true}, UserClassICQ},
+	}
+
+	for _, test := range tests {
+		if class := UserClass(test.user); class != test.expected {
+			t.Errorf("expected %s to have class 0x%04x, got 0x%04x", test.user.ScreenName, test.expected, class)
+		}
+	}
+}
@@ -2,42 +2,171 @@ package main
 
 import (
 	"aim-oscar/oscar"
+	"net"
 	"sync"
 )
 
+// userSessions are all of the connections a user has open. The BOS connection is the one they signed on
+// with, the others were redirected to for a single service. Users can be in several chat rooms, so chat
+// connections are kept by room cookie.
+type userSessions struct {
+	bos      *oscar.Session
+	services []*oscar.Session
+	chats    map[string]*oscar.Session
+}
+
 // SessionManager maps screen names to user sessions
 type SessionManager struct {
-	sessions map[string]*oscar.Session
+	sessions map[string]*userSessions
 	mutex    *sync.RWMutex
 }
 
 func NewSessionManager() *SessionManager {
 	sm := &SessionManager{
-		sessions: make(map[string]*oscar.Session),
+		sessions: make(map[string]*userSessions),
 		mutex:    &sync.RWMutex{},
 	}
 	return sm
 }
 
+// SetSession adds a connection for a user. Sessions with a Family are added next to the user's BOS
+// connection, otherwise the session replaces the BOS connection.
 func (sm *SessionManager) SetSession(screen_name string, session *oscar.Session) {
 	sm.mutex.Lock()
-	sm.sessions[screen_name] = session
-	sm.mutex.Unlock()
+	defer sm.mutex.Unlock()
+
+	us := sm.userSessions(screen_name)
+
+	if session.Family == 0 {
+		us.bos = session
+		return
+	}
+
+	for _, s := range us.services {
+		if s == session {
+			return
+		}
+	}
+	us.services = append(us.services, session)
+}
+
+// SetChatSession adds a user's connection to a chat room
+func (sm *SessionManager) SetChatSession(screen_name string, roomCookie string, session *oscar.Session) {
+	sm.mutex.Lock()
+	defer sm.mutex.Unlock()
+
+	sm.userSessions(screen_name).chats[roomCookie] = session
+}
+
+// userSessions returns the user's sessions, adding them if the user has none yet. The caller holds the mutex.
+func (sm *SessionManager) userSessions(screen_name string) *userSessions {
+	us, ok := sm.sessions[screen_name]
+	if !ok {
+		us = &userSessions{chats: make(map[string]*oscar.Session)}
+		sm.sessions[screen_name] = us
+	}
+	return us
 }
 
+// GetSession returns the user's BOS connection
 func (sm *SessionManager) GetSession(screen_name string) *oscar.Session {
 	sm.mutex.RLock()
-	s, ok := sm.sessions[screen_name]
-	sm.mutex.RUnlock()
+	defer sm.mutex.RUnlock()
 
-	if ok {
-		return s
+	if us, ok := sm.sessions[screen_name]; ok {
+		return us.bos
 	}
 	return nil
 }
 
-func (sm *SessionManager) RemoveSession(screen_name string) {
+// GetSessionForFamily returns the connection that negotiated a SNAC family, falling back to the user's BOS
+// connection. Chat connections are for a single room, look them up with GetChatSession.
+func (sm *SessionManager) GetSessionForFamily(screen_name string, family uint16) *oscar.Session {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	us, ok := sm.sessions[screen_name]
+	if !ok || family == 0x0e {
+		return nil
+	}
+
+	for _, s := range us.services {
+		if s.Family == family {
+			return s
+		}
+	}
+	return us.bos
+}
+
+// SignedOnFrom is true if the user's BOS connection comes from the IP address
+func (sm *SessionManager) SignedOnFrom(screen_name string, ip net.IP) bool {
+	session := sm.GetSession(screen_name)
+	if session == nil {
+		return false
+	}
+
+	host, _, err := net.SplitHostPort(session.RemoteAddr().String())
+	if err != nil {
+		return false
+	}
+	return ip.Equal(net.ParseIP(host))
+}
+
+// GetChatSession returns the user's connection to a chat room
+func (sm *SessionManager) GetChatSession(screen_name string, roomCookie string) *oscar.Session {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	if us, ok := sm.sessions[screen_name]; ok {
+		return us.chats[roomCookie]
+	}
+	return nil
+}
+
+// GetServiceSessions returns every connection the user was redirected to, including their chat connections
+func (sm *SessionManager) GetServiceSessions(screen_name string) []*oscar.Session {
+	sm.mutex.RLock()
+	defer sm.mutex.RUnlock()
+
+	us, ok := sm.sessions[screen_name]
+	if !ok {
+		return nil
+	}
+
+	sessions := make([]*oscar.Session, 0, len(us.services)+len(us.chats))
+	sessions = append(sessions, us.services...)
+	for _, s := range us.chats {
+		sessions = append(sessions, s)
+	}
+	return sessions
+}
+
+// RemoveSession removes one of the user's connections. The user is forgotten once they have none left.
+func (sm *SessionManager) RemoveSession(screen_name string, session *oscar.Session) {
 	sm.mutex.Lock()
-	sm.sessions[screen_name] = nil
-	sm.mutex.Unlock()
+	defer sm.mutex.Unlock()
+
+	us, ok := sm.sessions[screen_name]
+	if !ok {
+		return
+	}
+
+	if us.bos == session {
+		us.bos = nil
+	}
+	for i, s := range us.services {
+		if s == session {
+			us.services = append(us.services[:i], us.services[i+1:]...)
+			break
+		}
+	}
+	for cookie, s := range us.chats {
+		if s == session {
+			delete(us.chats, cookie)
+		}
+	}
+
+	if us.bos == nil && len(us.services) == 0 && len(us.chats) == 0 {
+		delete(sm.sessions, screen_name)
+	}
 }
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"aim-oscar/oscar"
+	"testing"
+)
+
+func TestSessionManagerChatSessions(t *testing.T) {
+	sm := NewSessionManager()
+
+	bos := &oscar.Session{}
+	lobby := &oscar.Session{Family: 0x0e}
+	games := &oscar.Session{Family: 0x0e}
+	sm.SetSession("toof", bos)
+	sm.SetChatSession("toof", "4-0-lobby", lobby)
+	sm.SetChatSession("toof", "4-0-games", games)
+
+	if s := sm.GetChatSession("toof", "4-0-lobby"); s != lobby {
+		t.Error("expected the connection for the lobby")
+	}
+	if s := sm.GetChatSession("toof", "4-0-games"); s != games {
+		t.Error("expected the connection for the games room")
+	}
+	if s := sm.GetSessionForFamily("toof", 0x0e); s != nil {
+		t.Error("expected no connection for chat without a room")
+	}
+	if sessions := sm.GetServiceSessions("toof"); len(sessions) != 2 {
+		t.Errorf("expected both chat connections to be service connections, got %d", len(sessions))
+	}
+
+	sm.RemoveSession("toof", lobby)
+	if s := sm.GetChatSession("toof", "4-0-lobby"); s != nil {
+		t.Error("expected the lobby connection to be removed")
+	}
+	if s := sm.GetChatSession("toof", "4-0-games"); s != games {
+		t.Error("expected the games room connection to be kept")
+	}
+
+	sm.RemoveSession("toof", bos)
+	sm.RemoveSession("toof", games)
+	if _, ok := sm.sessions["toof"]; ok {
+		t.Error("expected the user to be forgotten once they have no connections")
+	}
+}